@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrObjectNotExist is returned by a Backend when the named object does not
+// exist.
+var ErrObjectNotExist = errors.New("backends: object doesn't exist")
+
+// ErrNotSupported is returned by a Backend that cannot perform an operation,
+// such as a store that has no notion of signed URLs.
+var ErrNotSupported = errors.New("backends: operation not supported")
+
+// Backend is an object store the proxy can serve from. The GET and HEAD paths
+// only talk to a Backend, so stores can be swapped without touching them.
+type Backend interface {
+	// Open returns a reader for the content of the named object.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// OpenRange returns a reader for length bytes of the named object,
+	// starting at offset. A negative length reads to the end of the object.
+	OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns the attributes of the named object.
+	Stat(ctx context.Context, name string) (*ObjectAttrs, error)
+	// Sign returns a URL which grants temporary access to the named object.
+	Sign(ctx context.Context, name string, opts SignOptions) (string, error)
+	// List returns the attributes of all objects whose names begin with prefix.
+	List(ctx context.Context, prefix string) ([]*ObjectAttrs, error)
+	// Put writes the content of r to the named object, with the given
+	// attributes. Name and Size in attrs are ignored.
+	Put(ctx context.Context, name string, attrs ObjectAttrs, r io.Reader) error
+	// Delete removes the named object.
+	Delete(ctx context.Context, name string) error
+}
+
+// ObjectAttrs is the subset of object metadata the proxy needs to serve an
+// object.
+type ObjectAttrs struct {
+	Name            string
+	Size            int64
+	ContentType     string
+	ContentEncoding string
+	ContentLanguage string
+	CacheControl    string
+	Generation      int64
+	Updated         time.Time
+	MD5             []byte
+	CRC32C          uint32
+	Metadata        map[string]string
+}
+
+// SignOptions controls the URL produced by Backend.Sign.
+type SignOptions struct {
+	// Method is the HTTP method the URL is valid for, e.g. "GET".
+	Method string
+	// Expires is the time after which the URL is no longer valid.
+	Expires time.Time
+	// ResponseContentDisposition, if set, is the Content-Disposition of
+	// responses to the URL.
+	ResponseContentDisposition string
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// These are variables so tests can make them small.
+var (
+	// flightJoinBytes is how much of an object a shared read buffers before
+	// it stops accepting new readers. Until then, every byte read is kept so
+	// late joiners can start from the beginning.
+	flightJoinBytes = 8 << 20
+	// flightAheadBytes bounds how far a shared read gets ahead of its
+	// slowest reader, once it has stopped accepting new readers.
+	flightAheadBytes = 8 << 20
+	// flightChunkBytes is the size of each read from the backend.
+	flightChunkBytes = 32 << 10
+)
+
+// attrsFlights coalesces concurrent metadata lookups for the same object.
+var attrsFlights singleflight.Group
+
+// mediaFlights holds the shared reads in progress, by object name.
+var mediaFlights = struct {
+	sync.Mutex
+	m map[string]*flight
+}{m: map[string]*flight{}}
+
+// detached is a context with the values of its parent, but not its
+// cancellation, for work shared with requests other than the one that
+// started it.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// flight is one read of an object from a backend, shared by every request
+// for that object that arrives while it is in progress. The body is fanned
+// out to all readers as it streams in.
+type flight struct {
+	name    string
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	base    int64
+	readers map[*flightReader]struct{}
+	// joinable is true while the flight is in mediaFlights.
+	joinable bool
+	done     bool
+	err      error
+}
+
+// openShared returns a reader for the whole named object, joining a read
+// already in progress if there is one.
+func openShared(ctx context.Context, store Backend, objectName string) (io.ReadCloser, error) {
+	for {
+		mediaFlights.Lock()
+		f, ok := mediaFlights.m[objectName]
+		mediaFlights.Unlock()
+		if ok {
+			// the flight may have stopped accepting readers since it was
+			// found; if so, it is gone from the map on the next pass
+			if reader := f.join(); reader != nil {
+				return reader, nil
+			}
+			continue
+		}
+		// this request leads a new flight. The read outlives the leader's
+		// request, since other requests may depend on it, and is canceled
+		// when every reader is gone.
+		ctx, cancel := context.WithCancel(detached{ctx})
+		f = &flight{
+			name:     objectName,
+			cancel:   cancel,
+			readers:  map[*flightReader]struct{}{},
+			joinable: true,
+		}
+		f.cond = sync.NewCond(&f.mu)
+		reader := f.join()
+		mediaFlights.Lock()
+		if _, raced := mediaFlights.m[objectName]; raced {
+			mediaFlights.Unlock()
+			cancel()
+			continue
+		}
+		mediaFlights.m[objectName] = f
+		mediaFlights.Unlock()
+
+		media, err := store.Open(ctx, objectName)
+		if err != nil {
+			f.finish(err)
+			reader.Close()
+			return nil, err
+		}
+		go f.fill(media)
+		return reader, nil
+	}
+}
+
+// join adds a reader to the flight, starting at the beginning of the object.
+// It returns nil if the flight no longer accepts readers.
+func (f *flight) join() *flightReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable {
+		return nil
+	}
+	r := &flightReader{flight: f}
+	f.readers[r] = struct{}{}
+	return r
+}
+
+// fill reads media from the backend into the flight's buffer until it ends,
+// fails, or every reader has gone.
+func (f *flight) fill(media io.ReadCloser) {
+	defer media.Close()
+	chunk := make([]byte, flightChunkBytes)
+	for {
+		n, err := media.Read(chunk)
+		f.mu.Lock()
+		f.buf = append(f.buf, chunk[:n]...)
+		if f.joinable && len(f.buf) > flightJoinBytes {
+			// from here on, bytes are dropped once every reader has them
+			f.leave()
+		}
+		f.trim()
+		f.cond.Broadcast()
+		// don't get too far ahead of the slowest reader
+		for err == nil && len(f.readers) > 0 && !f.joinable &&
+			f.base+int64(len(f.buf))-f.slowest() >= int64(flightAheadBytes) {
+			f.cond.Wait()
+		}
+		abandoned := len(f.readers) == 0
+		f.mu.Unlock()
+		if err == io.EOF {
+			f.finish(nil)
+			return
+		}
+		if err != nil || abandoned {
+			f.finish(err)
+			return
+		}
+	}
+}
+
+// finish marks the flight done, with err if it failed.
+func (f *flight) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leave()
+	f.done = true
+	f.err = err
+	f.cancel()
+	f.cond.Broadcast()
+}
+
+// leave removes the flight from mediaFlights, so later requests start their
+// own. Callers must hold f.mu; mediaFlights is never locked while waiting
+// for f.mu, so taking it here can't deadlock.
+func (f *flight) leave() {
+	if !f.joinable {
+		return
+	}
+	f.joinable = false
+	mediaFlights.Lock()
+	if mediaFlights.m[f.name] == f {
+		delete(mediaFlights.m, f.name)
+	}
+	mediaFlights.Unlock()
+}
+
+// slowest returns the offset of the reader furthest behind. Callers must
+// hold f.mu.
+func (f *flight) slowest() int64 {
+	slowest := f.base + int64(len(f.buf))
+	for r := range f.readers {
+		if r.offset < slowest {
+			slowest = r.offset
+		}
+	}
+	return slowest
+}
+
+// trim drops buffered bytes every reader has read, once no new reader can
+// join. Callers must hold f.mu.
+func (f *flight) trim() {
+	if f.joinable {
+		return
+	}
+	drop := f.slowest() - f.base
+	if drop <= 0 {
+		return
+	}
+	// copy, rather than reslice, so the dropped bytes can be collected
+	f.buf = append([]byte(nil), f.buf[drop:]...)
+	f.base += drop
+}
+
+// flightReader reads a flight's media from the beginning.
+type flightReader struct {
+	flight *flight
+	offset int64
+	closed bool
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.flight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !r.closed && r.offset >= f.base+int64(len(f.buf)) && !f.done {
+		f.cond.Wait()
+	}
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if r.offset < f.base+int64(len(f.buf)) {
+		n := copy(p, f.buf[r.offset-f.base:])
+		r.offset += int64(n)
+		// the fill may be waiting for the slowest reader to catch up
+		f.cond.Broadcast()
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, io.EOF
+}
+
+// Close removes the reader from the flight. The last reader to leave
+// cancels the backend read.
+func (r *flightReader) Close() error {
+	f := r.flight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	delete(f.readers, r)
+	if len(f.readers) == 0 {
+		f.leave()
+		f.cancel()
+	}
+	f.trim()
+	f.cond.Broadcast()
+	return nil
+}
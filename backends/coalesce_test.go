@@ -0,0 +1,445 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flightStore is a backend whose objects are read from sources the test
+// controls. Reads end when the context they were opened with is done.
+type flightStore struct {
+	Backend
+	opens   atomic.Int32
+	stats   atomic.Int32
+	openErr error
+	// source returns the media of a read
+	source func() io.Reader
+	// ctxs are the contexts reads were opened with
+	mu   sync.Mutex
+	ctxs []context.Context
+	// stat is called by Stat, if set
+	stat func() (*ObjectAttrs, error)
+}
+
+func (s *flightStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.opens.Add(1)
+	s.mu.Lock()
+	s.ctxs = append(s.ctxs, ctx)
+	s.mu.Unlock()
+	if s.openErr != nil {
+		return nil, s.openErr
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := io.Copy(writer, s.source())
+		writer.CloseWithError(err)
+	}()
+	go func() {
+		<-ctx.Done()
+		reader.CloseWithError(ctx.Err())
+	}()
+	return reader, nil
+}
+
+func (s *flightStore) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	s.stats.Add(1)
+	return s.stat()
+}
+
+// randomMedia returns n random bytes.
+func randomMedia(n int) []byte {
+	media := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(media)
+	return media
+}
+
+// readers returns how many readers the flight for name has, or -1 if there
+// is none.
+func readers(name string) int {
+	mediaFlights.Lock()
+	f, ok := mediaFlights.m[name]
+	mediaFlights.Unlock()
+	if !ok {
+		return -1
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.readers)
+}
+
+// waitFor waits up to a second for condition to hold.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOpenSharedConcurrent(t *testing.T) {
+	media := randomMedia(3<<20 + 17)
+	release := make(chan struct{})
+	store := &flightStore{source: func() io.Reader {
+		<-release
+		return bytes.NewReader(media)
+	}}
+	const n = 10
+	results := make([][]byte, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reader, err := openShared(context.Background(), store, "lpse1/public/big.bin")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer reader.Close()
+			results[i], err = io.ReadAll(reader)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// nothing flows until every request has joined
+	waitFor(t, "every reader to join", func() bool { return readers("lpse1/public/big.bin") == n })
+	close(release)
+	wg.Wait()
+	if opens := store.opens.Load(); opens != 1 {
+		t.Errorf("%d backend reads, want 1", opens)
+	}
+	for i, result := range results {
+		if !bytes.Equal(result, media) {
+			t.Errorf("reader %d got %d different bytes", i, len(result))
+		}
+	}
+	if readers("lpse1/public/big.bin") != -1 {
+		t.Error("the flight outlived its read")
+	}
+}
+
+func TestOpenSharedLateJoiner(t *testing.T) {
+	media := randomMedia(1 << 20)
+	source, feed := io.Pipe()
+	store := &flightStore{source: func() io.Reader { return source }}
+	first, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	go feed.Write(media[:100<<10])
+	if _, err := io.ReadFull(first, make([]byte, 100<<10)); err != nil {
+		t.Fatal(err)
+	}
+	// bytes have flowed; a new reader still starts from the beginning
+	late, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	go func() {
+		feed.Write(media[100<<10:])
+		feed.Close()
+	}()
+	got, err := io.ReadAll(late)
+	if err != nil || !bytes.Equal(got, media) {
+		t.Errorf("late reader got %d bytes, %v, want the whole object", len(got), err)
+	}
+	rest, err := io.ReadAll(first)
+	if err != nil || !bytes.Equal(rest, media[100<<10:]) {
+		t.Errorf("first reader got %d more bytes, %v, want the rest", len(rest), err)
+	}
+	if opens := store.opens.Load(); opens != 1 {
+		t.Errorf("%d backend reads, want 1", opens)
+	}
+}
+
+func TestOpenSharedLeaderCanceled(t *testing.T) {
+	media := randomMedia(1 << 20)
+	source, feed := io.Pipe()
+	store := &flightStore{source: func() io.Reader { return source }}
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader, err := openShared(leaderCtx, store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	go feed.Write(media[:1000])
+	io.ReadFull(leader, make([]byte, 1000))
+	// the leader's request ends; the read it started goes on
+	cancelLeader()
+	leader.Close()
+	go func() {
+		feed.Write(media[1000:])
+		feed.Close()
+	}()
+	got, err := io.ReadAll(follower)
+	if err != nil || !bytes.Equal(got, media) {
+		t.Errorf("follower got %d bytes, %v, want the whole object", len(got), err)
+	}
+	store.mu.Lock()
+	readCtx := store.ctxs[0]
+	store.mu.Unlock()
+	// once the last reader is gone, so is the read
+	follower.Close()
+	select {
+	case <-readCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("the backend read wasn't canceled when every reader had gone")
+	}
+}
+
+func TestOpenSharedAbandoned(t *testing.T) {
+	source, feed := io.Pipe()
+	defer feed.Close()
+	store := &flightStore{source: func() io.Reader { return source }}
+	reader, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go feed.Write(make([]byte, 10))
+	reader.Read(make([]byte, 10))
+	reader.Close()
+	store.mu.Lock()
+	readCtx := store.ctxs[0]
+	store.mu.Unlock()
+	select {
+	case <-readCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("the backend read wasn't canceled when its only reader closed")
+	}
+	if readers("lpse1/public/a.bin") != -1 {
+		t.Error("an abandoned flight can still be joined")
+	}
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestOpenSharedBackpressure(t *testing.T) {
+	defer func(join, ahead, chunk int) {
+		flightJoinBytes, flightAheadBytes, flightChunkBytes = join, ahead, chunk
+	}(flightJoinBytes, flightAheadBytes, flightChunkBytes)
+	flightJoinBytes, flightAheadBytes, flightChunkBytes = 64<<10, 128<<10, 16<<10
+	media := randomMedia(2 << 20)
+	source := &countingReader{Reader: bytes.NewReader(media)}
+	store := &flightStore{source: func() io.Reader { return source }}
+	slow, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	done := make(chan []byte)
+	go func() {
+		got, _ := io.ReadAll(fast)
+		done <- got
+	}()
+	// the fast reader can't get far ahead of the slow one, which reads
+	// nothing
+	waitFor(t, "the read to stall", func() bool {
+		before := source.n.Load()
+		time.Sleep(20 * time.Millisecond)
+		return before > 0 && source.n.Load() == before
+	})
+	f := slow.(*flightReader).flight
+	f.mu.Lock()
+	buffered := len(f.buf)
+	f.mu.Unlock()
+	if limit := flightAheadBytes + flightChunkBytes; buffered > limit {
+		t.Errorf("buffered %d bytes, want at most %d", buffered, limit)
+	}
+	// io.Copy into the store's pipe holds up to 32K more
+	if read, limit := source.n.Load(), int64(flightAheadBytes+flightChunkBytes+32<<10); read > limit {
+		t.Errorf("read %d bytes ahead of the slowest reader, want at most %d", read, limit)
+	}
+	// once it reads, both get everything
+	got, err := io.ReadAll(slow)
+	if err != nil || !bytes.Equal(got, media) {
+		t.Errorf("slow reader got %d bytes, %v, want the whole object", len(got), err)
+	}
+	if got := <-done; !bytes.Equal(got, media) {
+		t.Errorf("fast reader got %d bytes, want the whole object", len(got))
+	}
+}
+
+func TestOpenSharedJoinLimit(t *testing.T) {
+	defer func(join, chunk int) { flightJoinBytes, flightChunkBytes = join, chunk }(flightJoinBytes, flightChunkBytes)
+	flightJoinBytes, flightChunkBytes = 64<<10, 16<<10
+	media := randomMedia(256 << 10)
+	source, feed := io.Pipe()
+	store := &flightStore{}
+	// the first read comes from the test, the second all at once
+	sources := []io.Reader{source, bytes.NewReader(media)}
+	store.source = func() io.Reader { return sources[store.opens.Load()-1] }
+	first, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	go feed.Write(media[:128<<10])
+	io.ReadFull(first, make([]byte, 128<<10))
+	// past the join limit, a new request starts its own read
+	second, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(second)
+	second.Close()
+	if err != nil || !bytes.Equal(got, media) {
+		t.Errorf("second reader got %d bytes, %v, want the whole object", len(got), err)
+	}
+	if opens := store.opens.Load(); opens != 2 {
+		t.Errorf("%d backend reads, want 2", opens)
+	}
+	feed.Close()
+}
+
+func TestOpenSharedErrors(t *testing.T) {
+	errBackend := errors.New("backend down")
+	source, feed := io.Pipe()
+	store := &flightStore{source: func() io.Reader { return source }}
+	const n = 5
+	var readers []io.ReadCloser
+	for i := 0; i < n; i++ {
+		reader, err := openShared(context.Background(), store, "lpse1/public/a.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	go func() {
+		feed.Write([]byte("partial"))
+		feed.CloseWithError(errBackend)
+	}()
+	var wg sync.WaitGroup
+	for i, reader := range readers {
+		wg.Add(1)
+		go func(i int, reader io.Reader) {
+			defer wg.Done()
+			got, err := io.ReadAll(reader)
+			if string(got) != "partial" || !errors.Is(err, errBackend) {
+				t.Errorf("reader %d got %q, %v, want what came before the error, then it", i, got, err)
+			}
+		}(i, reader)
+	}
+	wg.Wait()
+
+	// a failed open fails the request, and isn't shared with later ones
+	store = &flightStore{openErr: errBackend}
+	if _, err := openShared(context.Background(), store, "lpse1/public/b.bin"); !errors.Is(err, errBackend) {
+		t.Errorf("openShared = %v, want %v", err, errBackend)
+	}
+	if _, err := openShared(context.Background(), store, "lpse1/public/b.bin"); !errors.Is(err, errBackend) || store.opens.Load() != 2 {
+		t.Errorf("openShared = %v after %d reads, want another read", err, store.opens.Load())
+	}
+}
+
+func TestStatShared(t *testing.T) {
+	objectMetadataCache.Flush()
+	defer objectMetadataCache.Flush()
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	store := &flightStore{stat: func() (*ObjectAttrs, error) {
+		entered <- struct{}{}
+		<-release
+		return &ObjectAttrs{Name: "lpse1/public/a.txt", CacheControl: "public, max-age=60"}, nil
+	}}
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([]*ObjectAttrs, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			attrs, _, err := getAttrs(context.Background(), store, "lpse1/public/a.txt")
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = attrs
+		}(i)
+	}
+	<-entered
+	close(release)
+	wg.Wait()
+	// requests arriving during the lookup share it, and later ones hit the
+	// cache it filled
+	if stats := store.stats.Load(); stats != 1 {
+		t.Errorf("%d lookups, want 1", stats)
+	}
+	for i, attrs := range results {
+		if attrs != results[0] {
+			t.Errorf("request %d got different attributes", i)
+		}
+	}
+
+	// errors are shared the same way
+	errBackend := errors.New("backend down")
+	release = make(chan struct{})
+	store = &flightStore{stat: func() (*ObjectAttrs, error) {
+		entered <- struct{}{}
+		<-release
+		return nil, errBackend
+	}}
+	failed := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := statShared(context.Background(), store, "lpse1/public/b.txt")
+			failed <- err
+		}()
+	}
+	<-entered
+	// the second caller may still be on its way; it shares the lookup or
+	// starts its own, but gets the error either way
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-failed; !errors.Is(err, errBackend) {
+			t.Errorf("statShared = %v, want %v", err, errBackend)
+		}
+	}
+	if stats := store.stats.Load(); stats > 2 {
+		t.Errorf("%d lookups for 2 requests", stats)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+)
+
+// etag returns a strong entity tag for the object. Objects with an MD5 hash
+// are tagged by content; others (e.g., composite objects) by generation and
+// CRC32C.
+func etag(objectAttrs *ObjectAttrs) string {
+	if len(objectAttrs.MD5) > 0 {
+		return `"` + hex.EncodeToString(objectAttrs.MD5) + `"`
+	}
+	if objectAttrs.Generation != 0 && objectAttrs.CRC32C != 0 {
+		return fmt.Sprintf(`"%d-%08x"`, objectAttrs.Generation, objectAttrs.CRC32C)
+	}
+	if objectAttrs.Generation != 0 {
+		return fmt.Sprintf(`"%d"`, objectAttrs.Generation)
+	}
+	return ""
+}
+
+// lastModified returns the object's modification time at the resolution of
+// an HTTP date.
+func lastModified(objectAttrs *ObjectAttrs) time.Time {
+	return objectAttrs.Updated.Truncate(time.Second)
+}
+
+// checkPreconditions evaluates the request's conditional headers against the
+// object, in the order given by RFC 7232 section 6. It returns
+// http.StatusNotModified or http.StatusPreconditionFailed if the request
+// should not be served, or 0 if it should.
+func checkPreconditions(request *http.Request, objectAttrs *ObjectAttrs) int {
+	tag := etag(objectAttrs)
+	modified := lastModified(objectAttrs)
+	if ifMatch := request.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, tag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(request.Header.Get("If-Unmodified-Since")); err == nil &&
+		!objectAttrs.Updated.IsZero() {
+		if modified.After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	safe := request.Method == http.MethodGet || request.Method == http.MethodHead
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, tag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(request.Header.Get("If-Modified-Since")); err == nil &&
+		safe && !objectAttrs.Updated.IsZero() {
+		if !modified.After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// writePreconditionStatus ends a response whose preconditions were not met.
+func writePreconditionStatus(response http.ResponseWriter, status int) {
+	if status == http.StatusNotModified {
+		// a 304 carries validators and caching headers, but no representation
+		header := response.Header()
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		header.Del("Content-Encoding")
+		header.Del("Accept-Ranges")
+		if header.Get("ETag") != "" {
+			header.Del("Last-Modified")
+		}
+		response.WriteHeader(status)
+		return
+	}
+	common.Error(response, "", status)
+}
+
+// etagListMatches reports whether tag matches any entity tag in list, a
+// comma-separated If-Match or If-None-Match value. Weak comparison ignores
+// the W/ prefix; strong comparison never matches weak tags. "*" matches
+// the object whatever its tag, even if it has none.
+func etagListMatches(list string, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = textproto.TrimString(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if tag == "" {
+			continue
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
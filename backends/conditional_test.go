@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	object := &ObjectAttrs{MD5: []byte{0xab, 0xcd}, Updated: updated}
+	untagged := &ObjectAttrs{Updated: updated}
+	before := updated.Add(-time.Hour).Format(http.TimeFormat)
+	same := updated.Format(http.TimeFormat)
+	after := updated.Add(time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		method string
+		object *ObjectAttrs
+		header []string
+		want   int
+	}{
+		{"no conditions", "GET", object, nil, 0},
+		// If-Match compares strongly
+		{"If-Match strong", "GET", object, []string{"If-Match", `"abcd"`}, 0},
+		{"If-Match list", "GET", object, []string{"If-Match", `"x", "abcd"`}, 0},
+		{"If-Match weak", "GET", object, []string{"If-Match", `W/"abcd"`}, http.StatusPreconditionFailed},
+		{"If-Match other", "GET", object, []string{"If-Match", `"x"`}, http.StatusPreconditionFailed},
+		{"If-Match any", "GET", object, []string{"If-Match", "*"}, 0},
+		{"If-Match any untagged", "GET", untagged, []string{"If-Match", "*"}, 0},
+		{"If-Match untagged", "GET", untagged, []string{"If-Match", `"abcd"`}, http.StatusPreconditionFailed},
+		// If-Unmodified-Since is ignored with If-Match
+		{"If-Unmodified-Since later", "GET", object, []string{"If-Unmodified-Since", after}, 0},
+		{"If-Unmodified-Since same second", "GET", object, []string{"If-Unmodified-Since", same}, 0},
+		{"If-Unmodified-Since earlier", "GET", object, []string{"If-Unmodified-Since", before}, http.StatusPreconditionFailed},
+		{"If-Match over If-Unmodified-Since", "GET", object,
+			[]string{"If-Match", `"abcd"`, "If-Unmodified-Since", before}, 0},
+		// If-None-Match compares weakly
+		{"If-None-Match strong", "GET", object, []string{"If-None-Match", `"abcd"`}, http.StatusNotModified},
+		{"If-None-Match weak", "GET", object, []string{"If-None-Match", `W/"abcd"`}, http.StatusNotModified},
+		{"If-None-Match other", "GET", object, []string{"If-None-Match", `"x"`}, 0},
+		{"If-None-Match any", "GET", object, []string{"If-None-Match", "*"}, http.StatusNotModified},
+		{"If-None-Match HEAD", "HEAD", object, []string{"If-None-Match", `"abcd"`}, http.StatusNotModified},
+		{"If-None-Match POST", "POST", object, []string{"If-None-Match", `"abcd"`}, http.StatusPreconditionFailed},
+		{"If-None-Match any PUT", "PUT", object, []string{"If-None-Match", "*"}, http.StatusPreconditionFailed},
+		// If-Modified-Since is for GET and HEAD, and ignored with If-None-Match
+		{"If-Modified-Since same second", "GET", object, []string{"If-Modified-Since", same}, http.StatusNotModified},
+		{"If-Modified-Since earlier", "GET", object, []string{"If-Modified-Since", before}, 0},
+		{"If-Modified-Since HEAD", "HEAD", object, []string{"If-Modified-Since", after}, http.StatusNotModified},
+		{"If-Modified-Since POST", "POST", object, []string{"If-Modified-Since", after}, 0},
+		{"If-Modified-Since bad date", "GET", object, []string{"If-Modified-Since", "yesterday"}, 0},
+		{"If-None-Match over If-Modified-Since", "GET", object,
+			[]string{"If-None-Match", `"x"`, "If-Modified-Since", after}, 0},
+		{"If-None-Match matching over If-Modified-Since", "GET", object,
+			[]string{"If-None-Match", `"abcd"`, "If-Modified-Since", before}, http.StatusNotModified},
+		// a failed If-Match decides before If-None-Match
+		{"If-Match before If-None-Match", "GET", object,
+			[]string{"If-Match", `"x"`, "If-None-Match", `"abcd"`}, http.StatusPreconditionFailed},
+		{"no update time", "GET", &ObjectAttrs{MD5: []byte{0xab, 0xcd}},
+			[]string{"If-Modified-Since", after, "If-Unmodified-Since", before}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "/public/a.txt", nil)
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				request.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			if got := checkPreconditions(request, tt.object); got != tt.want {
+				t.Errorf("checkPreconditions = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	tests := []struct {
+		object ObjectAttrs
+		want   string
+	}{
+		{ObjectAttrs{MD5: []byte{0x01, 0xff}, Generation: 7, CRC32C: 9}, `"01ff"`},
+		{ObjectAttrs{Generation: 7, CRC32C: 0xabc}, `"7-00000abc"`},
+		{ObjectAttrs{Generation: 7}, `"7"`},
+		{ObjectAttrs{}, ""},
+	}
+	for _, tt := range tests {
+		if got := etag(&tt.object); got != tt.want {
+			t.Errorf("etag(%+v) = %s, want %s", tt.object, got, tt.want)
+		}
+	}
+}
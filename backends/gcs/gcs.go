@@ -15,24 +15,133 @@ package gcs
 
 import (
 	"context"
+	"io"
+	"net/url"
 	"os"
 
 	storage "cloud.google.com/go/storage"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+	"google.golang.org/api/iterator"
 )
 
-var bucket string
-var gcs *storage.Client
+// Backend serves objects from a GCS bucket.
+type Backend struct {
+	client *storage.Client
+	bucket string
+}
+
+// Setup performs one-time setup for the GCS backend, using the bucket named
+// by the BUCKET_NAME environment variable.
+func Setup() (*Backend, error) {
+	return New(context.Background(), os.Getenv("BUCKET_NAME"))
+}
+
+// New returns a Backend for the given bucket.
+func New(ctx context.Context, bucket string) (*Backend, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{client: client, bucket: bucket}, nil
+}
 
-// setup performs one-time setup for the GCS backend.
-func Setup() error {
-	// set the bucket name from environment variable
-	bucket = os.Getenv("BUCKET_NAME")
+// Open returns a reader for the content of the named object.
+func (b *Backend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	// objects are read as stored, so the media matches the Content-Encoding
+	// and size in their attributes; filters decode them if need be
+	reader, err := b.client.Bucket(b.bucket).Object(name).ReadCompressed(true).NewReader(ctx)
+	return reader, convertErr(err)
+}
+
+// OpenRange returns a reader for part of the content of the named object.
+func (b *Backend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	reader, err := b.client.Bucket(b.bucket).Object(name).ReadCompressed(true).NewRangeReader(ctx, offset, length)
+	return reader, convertErr(err)
+}
 
-	// initialize the client
-	var err error
-	gcs, err = storage.NewClient(context.Background())
+// Stat returns the attributes of the named object.
+func (b *Backend) Stat(ctx context.Context, name string) (*backends.ObjectAttrs, error) {
+	// TODO(domz): no need for full projection here
+	attrs, err := b.client.Bucket(b.bucket).Object(name).Attrs(ctx)
 	if err != nil {
+		return nil, convertErr(err)
+	}
+	return convertAttrs(attrs), nil
+}
+
+// Sign returns a V4 signed URL for the named object.
+func (b *Backend) Sign(ctx context.Context, name string, opts backends.SignOptions) (string, error) {
+	signOpts := &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  opts.Method,
+		Expires: opts.Expires,
+	}
+	if opts.ResponseContentDisposition != "" {
+		signOpts.QueryParameters = url.Values{
+			"response-content-disposition": {opts.ResponseContentDisposition},
+		}
+	}
+	return b.client.Bucket(b.bucket).SignedURL(name, signOpts)
+}
+
+// List returns the attributes of all objects whose names begin with prefix.
+func (b *Backend) List(ctx context.Context, prefix string) ([]*backends.ObjectAttrs, error) {
+	it := b.client.Bucket(b.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	result := []*backends.ObjectAttrs{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, convertAttrs(attrs))
+	}
+	return result, nil
+}
+
+// Put writes the content of r to the named object.
+func (b *Backend) Put(ctx context.Context, name string, attrs backends.ObjectAttrs, r io.Reader) error {
+	writer := b.client.Bucket(b.bucket).Object(name).NewWriter(ctx)
+	writer.ContentType = attrs.ContentType
+	writer.ContentEncoding = attrs.ContentEncoding
+	writer.ContentLanguage = attrs.ContentLanguage
+	writer.CacheControl = attrs.CacheControl
+	writer.Metadata = attrs.Metadata
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Close()
 		return err
 	}
-	return nil
+	return writer.Close()
+}
+
+// Delete removes the named object.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	return convertErr(b.client.Bucket(b.bucket).Object(name).Delete(ctx))
+}
+
+// convertAttrs maps GCS object attributes to backend object attributes.
+func convertAttrs(attrs *storage.ObjectAttrs) *backends.ObjectAttrs {
+	return &backends.ObjectAttrs{
+		Name:            attrs.Name,
+		Size:            attrs.Size,
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		ContentLanguage: attrs.ContentLanguage,
+		CacheControl:    attrs.CacheControl,
+		Generation:      attrs.Generation,
+		Updated:         attrs.Updated,
+		MD5:             attrs.MD5,
+		CRC32C:          attrs.CRC32C,
+		Metadata:        attrs.Metadata,
+	}
+}
+
+// convertErr maps GCS errors to backend errors.
+func convertErr(err error) error {
+	if err == storage.ErrObjectNotExist {
+		return backends.ErrObjectNotExist
+	}
+	return err
 }
@@ -0,0 +1,328 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+	"github.com/rs/zerolog/log"
+)
+
+// Read returns objects from a backend, mapping the URL to object names.
+// Media caching is bypassed.
+func Read(ctx context.Context, store Backend, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline) {
+	ReadWithCache(ctx, store, response, request, pipeline, noCache, noStreamCache, filter.Pipeline{})
+}
+
+// noCache is a CacheGet that always misses.
+func noCache(string) ([]byte, time.Duration, bool) {
+	return nil, 0, false
+}
+
+// noStreamCache is a StreamCacheGet that always misses.
+func noStreamCache(string) (CachedMedia, time.Duration, bool) {
+	return nil, 0, false
+}
+
+// ReadPrivate serves private objects through the proxy, with pipeline
+// applied, mapping the URL to object names. Media caching is bypassed, and
+// responses are marked private (see PrivateResponse), so shared caches
+// don't keep them.
+func ReadPrivate(ctx context.Context, store Backend, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline) {
+	objectName := common.NormalizePath(request.Header.Get("x-lpse-id"), request.URL.Path)
+	readObject(ctx, store, objectName, PrivateResponse(response), request, pipeline, noCache, noStreamCache, filter.Pipeline{})
+}
+
+// ReadWithSignatureURL redirects to a signed URL for the object, valid for
+// 6 days, with 301 Moved Permanently. See ReadWithSignedRedirect.
+func ReadWithSignatureURL(ctx context.Context, store Backend, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline) {
+	ReadWithSignedRedirect(ctx, store, response, request, pipeline, 6*24*time.Hour, http.StatusMovedPermanently)
+}
+
+// ReadWithSignedRedirect redirects to a signed URL for the object, valid
+// for ttl, with status, mapping the URL to object names. Browsers may cache
+// the redirect, privately, for as long as the URL is valid. A
+// Content-Disposition already set on response is signed into the URL, for
+// the storage service to send, rather than sent with the redirect.
+//
+// Backends that can't sign URLs (e.g., local development) serve the object
+// with ReadPrivate instead. If signing fails otherwise, the response is 500
+// Internal Server Error.
+func ReadWithSignedRedirect(ctx context.Context, store Backend, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline, ttl time.Duration, status int) {
+	objectName := common.NormalizePath(request.Header.Get("x-lpse-id"), request.URL.Path)
+	opts := SignOptions{
+		Method:                     "GET",
+		Expires:                    time.Now().Add(ttl),
+		ResponseContentDisposition: response.Header().Get("Content-Disposition"),
+	}
+	url, signedErr := store.Sign(ctx, objectName, opts)
+	if signedErr == ErrNotSupported {
+		ReadPrivate(ctx, store, response, request, pipeline)
+		return
+	}
+	if signedErr != nil {
+		log.Error().Msgf("Sign(%q): %v", objectName, signedErr)
+		common.Error(response, "", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Del("Content-Disposition")
+	cacheControl := "private, max-age=" + fmt.Sprintf("%.0f", ttl.Seconds())
+	response.Header().Set("Cache-Control", cacheControl)
+	// the URL grants access to the object, so it isn't logged
+	log.Info().Msgf("redirecting %q to a URL signed until %s", objectName, opts.Expires.Format(time.RFC3339))
+	http.Redirect(response, request, url, status)
+}
+
+// CacheGet defines how CachedGet will try to get media from the cache.
+// Expired media may be returned, with how long ago it expired; fresh media
+// is returned with zero.
+type CacheGet func(string) ([]byte, time.Duration, bool)
+
+// StreamCacheGet defines how ReadWithCache will try to get media from a cache
+// tier that streams its entries rather than holding them in memory, such as
+// a disk cache. Like CacheGet, it may return expired media.
+type StreamCacheGet func(string) (CachedMedia, time.Duration, bool)
+
+// CachedMedia is an entry from a streaming cache tier. ReadWithCache closes it
+// when the response is done.
+type CachedMedia interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// memoryMedia adapts media from a CacheGet to CachedMedia.
+type memoryMedia struct {
+	*bytes.Reader
+}
+
+func (memoryMedia) Close() error {
+	return nil
+}
+
+// lookupMedia finds media in the cache tiers, preferring fresh media to
+// stale, and the cacheGet tier to the streamGet tier.
+func lookupMedia(cacheKey string, cacheGet CacheGet, streamGet StreamCacheGet) (
+	media CachedMedia, stale time.Duration, hit bool) {
+	if maybeMedia, memoryStale, memoryHit := cacheGet(cacheKey); memoryHit {
+		media, stale, hit = memoryMedia{bytes.NewReader(maybeMedia)}, memoryStale, true
+		if stale == 0 {
+			return
+		}
+	}
+	if maybeStream, streamStale, streamHit := streamGet(cacheKey); streamHit {
+		if hit && stale <= streamStale {
+			maybeStream.Close()
+			return
+		}
+		media, stale, hit = maybeStream, streamStale, true
+	}
+	return
+}
+
+// openCached opens a byte range of cached media. A negative length means
+// the rest of the media.
+func openCached(media CachedMedia, offset, length int64) io.ReadCloser {
+	if length < 0 {
+		length = media.Size() - offset
+	}
+	return io.NopCloser(io.NewSectionReader(media, offset, length))
+}
+
+// ReadWithCache returns objects from a backend, mapping the URL to object names.
+// Cached media may be served, sparing a trip to the backend. The cacheGet
+// tier is tried first, then the streamGet tier.
+//
+// Filters in missPipeline will be applied on cache misses. Cache fill
+// filters are a good idea here.
+//
+// Filters in hitPipeline will be applied on cache hits. Reducing the pipeline
+// to not repeat steps done on fill (e.g., compression, transcoding) is a good
+// idea here.
+func ReadWithCache(ctx context.Context, store Backend, response http.ResponseWriter,
+	request *http.Request, missPipeline filter.Pipeline, cacheGet CacheGet,
+	streamGet StreamCacheGet, hitPipeline filter.Pipeline) {
+	// normalize path
+	objectName := common.NormalizePathForPublicGet(request.Header.Get("x-lpse-id"), request.URL.Path)
+	readObject(ctx, store, objectName, response, request, missPipeline, cacheGet, streamGet, hitPipeline)
+}
+
+// readObject serves the named object, trying the media cache tiers first.
+func readObject(ctx context.Context, store Backend, objectName string,
+	response http.ResponseWriter, request *http.Request,
+	missPipeline filter.Pipeline, cacheGet CacheGet, streamGet StreamCacheGet,
+	hitPipeline filter.Pipeline) {
+	// get the object headers. Headers are always cached and obey
+	// Cache-Control header, so this will not call the backend unless there's
+	// a miss. In general, header hits and media hits should line up.
+	objectAttrs, err := setHeaders(ctx, store, objectName, response)
+	if err != nil {
+		if err == ErrObjectNotExist {
+			common.Error(response, "", http.StatusNotFound)
+			return
+		} else {
+			log.Error().Msgf("get: %v", err)
+		}
+	} else {
+		// serve a precompressed sibling instead, if the client accepts one.
+		// It is served as though it were the object, but filters and media
+		// caches see a request for the sibling.
+		if siblingAttrs, suffix := precompressedSibling(ctx, store, objectName, objectAttrs, request, response); siblingAttrs != nil {
+			log.Debug().Msgf("readObject: serving %q", objectName+suffix)
+			response.Header().Del("Accept-Ranges")
+			writeHeaders(response, siblingAttrs)
+			objectName, objectAttrs = objectName+suffix, siblingAttrs
+			request = siblingRequest(request, suffix)
+		}
+		if status := checkPreconditions(request, objectAttrs); status != 0 {
+			// answered from metadata alone; the media is never read
+			writePreconditionStatus(response, status)
+			return
+		}
+	}
+
+	// try the media cache. Expired media may still be served: right away
+	// within the object's stale-while-revalidate window, while it is
+	// refreshed in the background; or within its stale-if-error window, if
+	// the backend fails.
+	var pipeline filter.Pipeline
+	var open rangeOpener
+	// media is cached under the same key FillCache uses, so query-dependent
+	// transformations are cached separately
+	cacheKey := common.NormalizePath(request.Header.Get("x-lpse-id"), request.URL.String())
+	var cacheControl common.CacheControl
+	if objectAttrs != nil {
+		cacheControl = common.ParseCacheControl(objectAttrs.CacheControl)
+	}
+	cached, stale, hit := lookupMedia(cacheKey, cacheGet, streamGet)
+	var fallback CachedMedia
+	if hit {
+		defer cached.Close()
+		switch {
+		case stale == 0:
+			log.Debug().Msgf("ReadWithCache: HIT")
+		case stale <= cacheControl.StaleWhileRevalidate:
+			log.Debug().Msgf("ReadWithCache: STALE")
+			markStale(response)
+			refreshMedia(ctx, store, objectName, cacheKey, request, missPipeline)
+		case objectAttrs != nil && stale <= cacheControl.StaleIfError && cached.Size() == objectAttrs.Size:
+			// a fresh read is tried first; this is only served if it fails
+			fallback, cached = cached, nil
+		default:
+			cached = nil
+		}
+	}
+	if cached != nil {
+		open = func(offset, length int64) (io.ReadCloser, error) {
+			return openCached(cached, offset, length), nil
+		}
+		// transformations may be cached; use cached content length
+		response.Header().Set("Content-Length", fmt.Sprint(cached.Size()))
+		pipeline = hitPipeline
+	} else {
+		log.Debug().Msgf("ReadWithCache: MISS")
+		// TODO(domz): need an aggressive reader
+		open = func(offset, length int64) (io.ReadCloser, error) {
+			if offset == 0 && length < 0 {
+				// concurrent misses for the same object share one read
+				return openShared(ctx, store, objectName)
+			}
+			return store.OpenRange(ctx, objectName, offset, length)
+		}
+		pipeline = missPipeline
+	}
+
+	// work out which byte ranges to send. Encoded objects are always sent
+	// whole, since ranges of them are ambiguous.
+	var ranges []httpRange
+	if objectAttrs != nil && objectAttrs.ContentEncoding == "" {
+		size := objectAttrs.Size
+		if cached != nil {
+			size = cached.Size()
+		}
+		ranges, err = requestedRanges(request, objectAttrs, size)
+		if err == errNoOverlap {
+			response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			common.Error(response, "", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if len(ranges) == 1 {
+			response.Header().Set("Content-Range", ranges[0].contentRange(size))
+			response.Header().Set("Content-Length", fmt.Sprint(ranges[0].length))
+		} else if len(ranges) > 1 {
+			body, contentType, bodyLength := multipartRanges(ranges,
+				response.Header().Get("Content-Type"), size, open)
+			response.Header().Set("Content-Type", contentType)
+			response.Header().Set("Content-Length", fmt.Sprint(bodyLength))
+			open = func(offset, length int64) (io.ReadCloser, error) {
+				return body, nil
+			}
+		}
+	}
+
+	// get object content and send it
+	offset, length := int64(0), int64(-1)
+	if len(ranges) == 1 {
+		offset, length = ranges[0].start, ranges[0].length
+	}
+	media, err := open(offset, length)
+	if err != nil && fallback != nil {
+		log.Warn().Msgf("get: serving stale media for %q: %v", objectName, err)
+		markStale(response)
+		media, err = openCached(fallback, offset, length), nil
+		pipeline = hitPipeline
+	}
+	if err != nil {
+		log.Error().Msgf("get: %v", err)
+		common.Error(response, "", http.StatusInternalServerError)
+		return
+	}
+	defer media.Close()
+	if len(pipeline) > 0 {
+		// filters may still change the status
+		response = filter.DeferWriteHeader(response)
+	}
+	if len(ranges) > 0 {
+		response.WriteHeader(http.StatusPartialContent)
+	}
+
+	// serve the media
+	var written int64
+	if len(pipeline) > 0 {
+		// use a filter pipeline
+		written, err = filter.PipelineCopy(ctx, response, media, request, pipeline)
+	} else {
+		// unfiltered, simple copy
+		written, err = io.Copy(response, media)
+	}
+	if err != nil {
+		log.Error().Msgf("readObject: %v", err)
+		if written > 0 {
+			// the response is incomplete; abort it, so it isn't taken for
+			// a complete one
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
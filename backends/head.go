@@ -11,7 +11,7 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-package gcs
+package backends
 
 import (
 	"context"
@@ -22,30 +22,30 @@ import (
 	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
 
-	storage "cloud.google.com/go/storage"
 	"github.com/rs/zerolog/log"
 )
 
-// ReadMetadata returns object metadata from a GCS bucket, mapping the URL to
+// ReadMetadata returns object metadata from a backend, mapping the URL to
 // object names.
-func ReadMetadata(ctx context.Context, response http.ResponseWriter,
+func ReadMetadata(ctx context.Context, store Backend, response http.ResponseWriter,
 	request *http.Request, pipeline filter.Pipeline) {
 	// normalize path
 	objectName := common.NormalizePath(request.Header.Get("x-lpse-id"), request.URL.Path)
 
-	// get the object handle and headers. Attributes are always cached and obey
-	// Cache-Control header, so this will not call GCS unless there's a miss.
-	// In general, header hits and media hits should line up.
-	objectHandle := gcs.Bucket(bucket).Object(objectName)
-	// get static-serving metadata and set headers
-	err := setHeaders(ctx, objectHandle, response)
+	// get the object headers. Attributes are always cached and obey
+	// Cache-Control header, so this will not call the backend unless there's
+	// a miss. In general, header hits and media hits should line up.
+	objectAttrs, err := setHeaders(ctx, store, objectName, response)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			http.Error(response, "", http.StatusNotFound)
+		if err == ErrObjectNotExist {
+			common.Error(response, "", http.StatusNotFound)
 			return
 		} else {
 			log.Error().Msgf("get: %v", err)
 		}
+	} else if status := checkPreconditions(request, objectAttrs); status != 0 {
+		writePreconditionStatus(response, status)
+		return
 	}
 
 	// serve the metadata
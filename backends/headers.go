@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cache"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/rs/zerolog/log"
+)
+
+// objectMetadataCache stores object metadata to speed up serving of data.
+// The data itself is not cached, just values like Content-Type, Cache-Control,
+// etc.
+var objectMetadataCache = cache.NewMemory(cache.Options{
+	MaxBytes:          16 << 20,
+	MaxEntryBytes:     64 << 10,
+	Policy:            cache.LRU,
+	DefaultExpiration: 90 * time.Second,
+	MaxStale:          time.Hour,
+})
+
+// MetadataCache returns the object metadata cache, so it can be inspected
+// and purged.
+func MetadataCache() cache.Cache {
+	return objectMetadataCache
+}
+
+// attrsSize estimates the memory used by cached object attributes.
+func attrsSize(objectAttrs *ObjectAttrs) int64 {
+	// fixed fields and map overhead, roughly
+	size := 256 + len(objectAttrs.Name) + len(objectAttrs.ContentType) +
+		len(objectAttrs.ContentEncoding) + len(objectAttrs.ContentLanguage) +
+		len(objectAttrs.CacheControl) + len(objectAttrs.MD5)
+	for k, v := range objectAttrs.Metadata {
+		size += len(k) + len(v)
+	}
+	return int64(size)
+}
+
+// setHeaders will transfer HTTP headers from object metadata to the response.
+func setHeaders(ctx context.Context, store Backend, objectName string,
+	response http.ResponseWriter) (objectAttrs *ObjectAttrs, err error) {
+
+	// get object metadata. Use a cache to speed up TTFB.
+	objectAttrs, stale, err := getAttrs(ctx, store, objectName)
+	if err != nil {
+		return nil, err
+	}
+	writeHeaders(response, objectAttrs)
+	if stale {
+		markStale(response)
+	}
+	return
+}
+
+// writeHeaders sets the response headers that describe an object.
+func writeHeaders(response http.ResponseWriter, objectAttrs *ObjectAttrs) {
+	if objectAttrs.CacheControl != "" {
+		response.Header().Set("Cache-Control", objectAttrs.CacheControl)
+	}
+	if objectAttrs.ContentEncoding != "" {
+		response.Header().Set("Content-Encoding", objectAttrs.ContentEncoding)
+	}
+	if objectAttrs.ContentLanguage != "" {
+		response.Header().Set("Content-Language", objectAttrs.ContentLanguage)
+	}
+	if objectAttrs.ContentType != "" {
+		response.Header().Set("Content-Type", objectAttrs.ContentType)
+	}
+	response.Header().Set("Content-Length", fmt.Sprint(objectAttrs.Size))
+	if tag := etag(objectAttrs); tag != "" {
+		response.Header().Set("ETag", tag)
+	}
+	if !objectAttrs.Updated.IsZero() {
+		response.Header().Set("Last-Modified", objectAttrs.Updated.UTC().Format(http.TimeFormat))
+	}
+	if objectAttrs.ContentEncoding == "" {
+		response.Header().Set("Accept-Ranges", "bytes")
+	}
+}
+
+// getAttrs will get the metadata of an object, using a local cache to
+// store metadata and avoid repeated metadata GETs.
+//
+// Expired metadata is still used, and stale is set, within the object's
+// stale-while-revalidate window, while it is refreshed in the background;
+// and within its stale-if-error window, if the backend fails.
+func getAttrs(ctx context.Context, store Backend, objectName string) (
+	objectAttrs *ObjectAttrs, stale bool, err error) {
+	// get object metadata. Use a cache to speed up TTFB.
+	maybeAttrs, staleFor, hit := objectMetadataCache.GetStale(objectName)
+	if _, absent := maybeAttrs.(absentObject); hit && absent {
+		if staleFor == 0 {
+			return nil, false, ErrObjectNotExist
+		}
+		// it may exist by now
+		hit = false
+	}
+	if hit && staleFor == 0 {
+		return maybeAttrs.(*ObjectAttrs), false, nil
+	}
+	if !hit {
+		objectAttrs, err = statShared(ctx, store, objectName)
+		return objectAttrs, false, err
+	}
+	staleAttrs := maybeAttrs.(*ObjectAttrs)
+	cacheControl := common.ParseCacheControl(staleAttrs.CacheControl)
+	if staleFor <= cacheControl.StaleWhileRevalidate {
+		// the result is for later requests; DoChan doesn't wait for it
+		attrsFlights.DoChan(objectName, func() (interface{}, error) {
+			return fetchAttrs(detached{ctx}, store, objectName)
+		})
+		return staleAttrs, true, nil
+	}
+	objectAttrs, err = statShared(ctx, store, objectName)
+	if err != nil && err != ErrObjectNotExist && staleFor <= cacheControl.StaleIfError {
+		log.Warn().Msgf("getAttrs: serving stale metadata for %q: %v", objectName, err)
+		return staleAttrs, true, nil
+	}
+	return objectAttrs, false, err
+}
+
+// statShared fetches an object's metadata from the backend. Concurrent
+// calls for the same object share one lookup.
+func statShared(ctx context.Context, store Backend, objectName string) (*ObjectAttrs, error) {
+	shared, err, _ := attrsFlights.Do(objectName, func() (interface{}, error) {
+		return fetchAttrs(detached{ctx}, store, objectName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shared.(*ObjectAttrs), nil
+}
+
+// fetchAttrs fetches an object's metadata from the backend and caches it,
+// honoring Cache-Control.
+func fetchAttrs(ctx context.Context, store Backend, objectName string) (*ObjectAttrs, error) {
+	objectAttrs, err := store.Stat(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if expiry, ok := common.ParseCacheControl(objectAttrs.CacheControl).CacheFor(); ok {
+		objectMetadataCache.Set(objectName, objectAttrs, attrsSize(objectAttrs), expiry)
+	}
+	return objectAttrs, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+)
+
+// metaSuffix is appended to an object's file name to find its sidecar
+// metadata file.
+const metaSuffix = ".meta.json"
+
+// Backend serves objects from a directory tree, for development and tests.
+//
+// Object names map directly onto paths below the root, so the object
+// "lpse1/public/a.pdf" (x-lpse-id "lpse1", URL path "/public/a.pdf") is the
+// file ROOT/lpse1/public/a.pdf. Metadata that a filesystem can't hold lives in
+// a sidecar JSON file next to the object, e.g. ROOT/lpse1/public/a.pdf.meta.json:
+//
+//	{"contentType": "application/pdf", "cacheControl": "max-age=60"}
+type Backend struct {
+	root string
+}
+
+// sidecar is the on-disk format of an object's metadata file.
+type sidecar struct {
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	ContentLanguage string            `json:"contentLanguage,omitempty"`
+	CacheControl    string            `json:"cacheControl,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// Setup performs one-time setup for the local backend, serving from the
+// directory named by the LOCAL_ROOT environment variable.
+func Setup() (*Backend, error) {
+	root := os.Getenv("LOCAL_ROOT")
+	if root == "" {
+		root = "."
+	}
+	return New(root)
+}
+
+// New returns a Backend serving from the given directory.
+func New(root string) (*Backend, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local: %q is not a directory", abs)
+	}
+	return &Backend{root: abs}, nil
+}
+
+// Open returns a reader for the content of the named object.
+func (b *Backend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	filePath, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	return file, convertErr(err)
+}
+
+// OpenRange returns a reader for part of the content of the named object.
+func (b *Backend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	filePath, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// Stat returns the attributes of the named object.
+func (b *Backend) Stat(ctx context.Context, name string) (*backends.ObjectAttrs, error) {
+	filePath, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	if info.IsDir() {
+		return nil, backends.ErrObjectNotExist
+	}
+	return b.attrs(name, filePath, info)
+}
+
+// Sign is not supported by the local backend.
+func (b *Backend) Sign(ctx context.Context, name string, opts backends.SignOptions) (string, error) {
+	return "", backends.ErrNotSupported
+}
+
+// List returns the attributes of all objects whose names begin with prefix.
+func (b *Backend) List(ctx context.Context, prefix string) ([]*backends.ObjectAttrs, error) {
+	result := []*backends.ObjectAttrs{}
+	err := filepath.WalkDir(b.root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(filePath, metaSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		attrs, err := b.attrs(name, filePath, info)
+		if err != nil {
+			return err
+		}
+		result = append(result, attrs)
+		return nil
+	})
+	return result, err
+}
+
+// Put writes the content of r to the named object, and its attributes to the
+// object's sidecar file.
+func (b *Backend) Put(ctx context.Context, name string, attrs backends.ObjectAttrs, r io.Reader) error {
+	filePath, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(sidecar{
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		ContentLanguage: attrs.ContentLanguage,
+		CacheControl:    attrs.CacheControl,
+		Metadata:        attrs.Metadata,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath+metaSuffix, meta, 0o644)
+}
+
+// Delete removes the named object and its sidecar file.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	filePath, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil {
+		return convertErr(err)
+	}
+	if err := os.Remove(filePath + metaSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path maps an object name to a file below the root, refusing names which
+// would escape it.
+func (b *Backend) path(name string) (string, error) {
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		return "", backends.ErrObjectNotExist
+	}
+	return filepath.Join(b.root, filepath.FromSlash(cleaned)), nil
+}
+
+// attrs builds object attributes from a file and its sidecar, if any.
+func (b *Backend) attrs(name string, filePath string, info fs.FileInfo) (*backends.ObjectAttrs, error) {
+	meta := sidecar{}
+	metaBytes, err := os.ReadFile(filePath + metaSuffix)
+	if err == nil {
+		if err := json.Unmarshal(metaBytes, &meta); err != nil {
+			return nil, fmt.Errorf("local: %s%s: %v", name, metaSuffix, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = mime.TypeByExtension(path.Ext(name))
+	}
+	return &backends.ObjectAttrs{
+		Name:            name,
+		Size:            info.Size(),
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		ContentLanguage: meta.ContentLanguage,
+		CacheControl:    meta.CacheControl,
+		Generation:      info.ModTime().UnixNano(),
+		Updated:         info.ModTime(),
+		Metadata:        meta.Metadata,
+	}, nil
+}
+
+// convertErr maps filesystem errors to backend errors.
+func convertErr(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return backends.ErrObjectNotExist
+	}
+	return err
+}
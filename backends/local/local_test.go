@@ -0,0 +1,218 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package local
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+)
+
+// newBackend returns a Backend serving from an empty temporary directory.
+func newBackend(t *testing.T) *Backend {
+	t.Helper()
+	b, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// put stores an object, failing the test if it can't.
+func put(t *testing.T, b *Backend, name, content string, attrs backends.ObjectAttrs) {
+	t.Helper()
+	if err := b.Put(context.Background(), name, attrs, strings.NewReader(content)); err != nil {
+		t.Fatalf("Put(%q): %v", name, err)
+	}
+}
+
+// reader returns a function that reads and closes what Open returns,
+// failing the test on an error.
+func reader(t *testing.T) func(io.ReadCloser, error) string {
+	return func(r io.ReadCloser, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	put(t, b, "lpse1/public/a.txt", "hello, world", backends.ObjectAttrs{})
+
+	if got := reader(t)(b.Open(ctx, "lpse1/public/a.txt")); got != "hello, world" {
+		t.Errorf("Open = %q, want %q", got, "hello, world")
+	}
+	if _, err := b.Open(ctx, "lpse1/public/missing.txt"); err != backends.ErrObjectNotExist {
+		t.Errorf("Open(missing) error = %v, want ErrObjectNotExist", err)
+	}
+}
+
+func TestOpenRange(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	put(t, b, "a.txt", "0123456789", backends.ObjectAttrs{})
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{0, 4, "0123"},
+		{3, 4, "3456"},
+		{7, -1, "789"},
+		{7, 10, "789"},
+		{10, -1, ""},
+	}
+	for _, tt := range tests {
+		if got := reader(t)(b.OpenRange(ctx, "a.txt", tt.offset, tt.length)); got != tt.want {
+			t.Errorf("OpenRange(%d, %d) = %q, want %q", tt.offset, tt.length, got, tt.want)
+		}
+	}
+	if _, err := b.OpenRange(ctx, "missing.txt", 0, 1); err != backends.ErrObjectNotExist {
+		t.Errorf("OpenRange(missing) error = %v, want ErrObjectNotExist", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	put(t, b, "lpse1/public/a.txt", "hello", backends.ObjectAttrs{
+		ContentType:     "text/plain; charset=utf-8",
+		ContentLanguage: "id",
+		CacheControl:    "public, max-age=60",
+		Metadata:        map[string]string{"owner": "lpse1"},
+	})
+	put(t, b, "lpse1/public/b.pdf", "%PDF-", backends.ObjectAttrs{})
+
+	attrs, err := b.Stat(ctx, "lpse1/public/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != "lpse1/public/a.txt" || attrs.Size != 5 ||
+		attrs.ContentType != "text/plain; charset=utf-8" || attrs.ContentLanguage != "id" ||
+		attrs.CacheControl != "public, max-age=60" || attrs.Metadata["owner"] != "lpse1" {
+		t.Errorf("Stat = %+v", attrs)
+	}
+	if attrs.Updated.IsZero() || attrs.Generation == 0 {
+		t.Errorf("Stat = %+v, want Updated and Generation set", attrs)
+	}
+
+	// without a sidecar type, the type goes by the extension
+	if attrs, err := b.Stat(ctx, "lpse1/public/b.pdf"); err != nil || attrs.ContentType != "application/pdf" {
+		t.Errorf("Stat(b.pdf) = %+v, %v, want application/pdf", attrs, err)
+	}
+
+	for _, name := range []string{"lpse1/public/missing.txt", "lpse1/public", "", "/"} {
+		if _, err := b.Stat(ctx, name); err != backends.ErrObjectNotExist {
+			t.Errorf("Stat(%q) error = %v, want ErrObjectNotExist", name, err)
+		}
+	}
+}
+
+func TestPathsStayBelowRoot(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	put(t, b, "../../escape.txt", "contained", backends.ObjectAttrs{})
+
+	if got := reader(t)(b.Open(ctx, "escape.txt")); got != "contained" {
+		t.Errorf("Open(escape.txt) = %q, want %q", got, "contained")
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	for _, name := range []string{"lpse1/public/a.txt", "lpse1/public/b.txt", "lpse1/private/c.txt", "lpse2/public/a.txt"} {
+		put(t, b, name, name, backends.ObjectAttrs{ContentType: "text/plain"})
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"lpse1/public/", []string{"lpse1/public/a.txt", "lpse1/public/b.txt"}},
+		{"lpse1/", []string{"lpse1/private/c.txt", "lpse1/public/a.txt", "lpse1/public/b.txt"}},
+		{"lpse3/", nil},
+	}
+	for _, tt := range tests {
+		list, err := b.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, attrs := range list {
+			got = append(got, attrs.Name)
+			if attrs.ContentType != "text/plain" {
+				t.Errorf("List(%q): %s has type %q, want text/plain", tt.prefix, attrs.Name, attrs.ContentType)
+			}
+		}
+		// sidecar files aren't objects
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPutReplaces(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	put(t, b, "a.txt", "first", backends.ObjectAttrs{ContentType: "text/plain"})
+	put(t, b, "a.txt", "second", backends.ObjectAttrs{ContentType: "text/markdown"})
+
+	if got := reader(t)(b.Open(ctx, "a.txt")); got != "second" {
+		t.Errorf("Open = %q, want %q", got, "second")
+	}
+	if attrs, err := b.Stat(ctx, "a.txt"); err != nil || attrs.ContentType != "text/markdown" || attrs.Size != 6 {
+		t.Errorf("Stat = %+v, %v", attrs, err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend(t)
+	put(t, b, "a.txt", "hello", backends.ObjectAttrs{ContentType: "text/plain"})
+
+	if err := b.Delete(ctx, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, "a.txt"); err != backends.ErrObjectNotExist {
+		t.Errorf("Stat after Delete error = %v, want ErrObjectNotExist", err)
+	}
+	if list, err := b.List(ctx, ""); err != nil || len(list) != 0 {
+		t.Errorf("List after Delete = %v, %v, want nothing", list, err)
+	}
+	if err := b.Delete(ctx, "a.txt"); !errors.Is(err, backends.ErrObjectNotExist) {
+		t.Errorf("Delete again error = %v, want ErrObjectNotExist", err)
+	}
+}
+
+func TestSignNotSupported(t *testing.T) {
+	b := newBackend(t)
+	if _, err := b.Sign(context.Background(), "a.txt", backends.SignOptions{Method: "GET"}); err != backends.ErrNotSupported {
+		t.Errorf("Sign error = %v, want ErrNotSupported", err)
+	}
+}
@@ -11,35 +11,33 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-package gcs
+package backends
 
 import (
 	"context"
 	"net/http"
 	"time"
 
-	storage "cloud.google.com/go/storage"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
 	"github.com/rs/zerolog/log"
 )
 
-// Read returns objects from a GCS bucket, mapping the URL to object names.
-// Media caching is bypassed.
-func UploadFile(ctx context.Context, response http.ResponseWriter,
+// UploadFile redirects to a short-lived signed URL for the object, mapping the
+// URL to object names.
+func UploadFile(ctx context.Context, store Backend, response http.ResponseWriter,
 	request *http.Request, pipeline filter.Pipeline) {
 	objectName := common.NormalizePath(request.Header.Get("x-lpse-id"), request.URL.Path)
 	// GENERATE SIGNED_URL
-	opts := &storage.SignedURLOptions{
-		Scheme:  storage.SigningSchemeV4,
+	opts := SignOptions{
 		Method:  "GET",
 		Expires: time.Now().Add(15 * time.Minute),
 	}
-	url, signedErr := gcs.Bucket(bucket).SignedURL(objectName, opts)
+	url, signedErr := store.Sign(ctx, objectName, opts)
 	if signedErr != nil {
-		log.Error().Msgf("Bucket(%q).SignedURL: %w", bucket, signedErr)
+		log.Error().Msgf("Sign(%q): %v", objectName, signedErr)
 	}
-	log.Info().Msgf("bucket: %q; signed_url: %q", bucket, url)
+	log.Info().Msgf("signed_url: %q", url)
 	log.Info().Msgf("redirecting to: %q", url)
 	http.Redirect(response, request, url, http.StatusMovedPermanently)
 }
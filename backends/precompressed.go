@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/rs/zerolog/log"
+)
+
+// precompressedSuffixes are the name suffixes of precompressed siblings, by
+// content coding, e.g. app.js.br next to app.js.
+var precompressedSuffixes = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// precompressedEncodings are the codings of precompressed siblings, in
+// order of preference.
+var precompressedEncodings = []string{"br", "gzip"}
+
+// absentObject is cached in place of the metadata of a precompressed
+// sibling that doesn't exist, so it isn't looked for on every request.
+type absentObject struct{}
+
+// absentSiblingExpiry is how long a missing sibling of an object whose
+// metadata isn't cached, e.g. a private one, is remembered as missing.
+const absentSiblingExpiry = time.Minute
+
+// precompressedSibling looks for a precompressed sibling of the object the
+// client accepts, and returns its metadata, presented as the object's: with
+// the object's Content-Type, Cache-Control and Content-Language, and the
+// sibling's Content-Encoding. It returns nil if there is none, or the object
+// isn't worth compressing.
+//
+// Since the response then depends on Accept-Encoding, it says so in Vary.
+func precompressedSibling(ctx context.Context, store Backend, objectName string,
+	objectAttrs *ObjectAttrs, request *http.Request, response http.ResponseWriter) (
+	siblingAttrs *ObjectAttrs, suffix string) {
+	if objectAttrs.ContentEncoding != "" || !common.CompressibleType(objectAttrs.ContentType) {
+		return nil, ""
+	}
+	common.AddVary(response.Header(), "Accept-Encoding")
+	accepted := common.ParseAcceptEncoding(request.Header.Get("Accept-Encoding"))
+	for _, encoding := range accepted.Ranked(precompressedEncodings) {
+		suffix := precompressedSuffixes[encoding]
+		if knownAbsent(objectName + suffix) {
+			continue
+		}
+		sibling, _, err := getAttrs(ctx, store, objectName+suffix)
+		if err == ErrObjectNotExist {
+			// remember it's missing for as long as the object's metadata
+			// is cached, or for a while if it isn't, so objects that
+			// can't be cached don't cost a lookup per sibling every time
+			expiry, ok := common.ParseCacheControl(objectAttrs.CacheControl).CacheFor()
+			if !ok {
+				expiry = absentSiblingExpiry
+			}
+			objectMetadataCache.Set(objectName+suffix, absentObject{}, attrsSize(objectAttrs), expiry)
+			continue
+		}
+		if err != nil {
+			log.Error().Msgf("precompressedSibling: %v", err)
+			continue
+		}
+		presented := *sibling
+		presented.ContentType = objectAttrs.ContentType
+		presented.CacheControl = objectAttrs.CacheControl
+		presented.ContentLanguage = objectAttrs.ContentLanguage
+		presented.ContentEncoding = encoding
+		return &presented, suffix
+	}
+	return nil, ""
+}
+
+// knownAbsent reports whether the object is cached as missing. The marker
+// is left to expire, so an object uploaded since is found then.
+func knownAbsent(objectName string) bool {
+	cached, stale, hit := objectMetadataCache.GetStale(objectName)
+	_, absent := cached.(absentObject)
+	return hit && absent && stale == 0
+}
+
+// siblingRequest returns a copy of request for the sibling of the requested
+// object with suffix, so filters and media caches tell the two apart.
+func siblingRequest(request *http.Request, suffix string) *http.Request {
+	sibling := request.Clone(request.Context())
+	sibling.URL.Path += suffix
+	sibling.URL.RawPath = ""
+	return sibling
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PrivateResponse wraps response so its Cache-Control is made private
+// before the headers are sent: a public directive, and s-maxage, which only
+// shared caches heed, are dropped, and private is added. Browsers may still
+// cache the response as the object says; shared caches won't.
+func PrivateResponse(response http.ResponseWriter) http.ResponseWriter {
+	return &privateResponse{ResponseWriter: response}
+}
+
+// privateResponse is a ResponseWriter that marks its Cache-Control private.
+type privateResponse struct {
+	http.ResponseWriter
+	once sync.Once
+}
+
+func (r *privateResponse) WriteHeader(status int) {
+	r.once.Do(r.markPrivate)
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *privateResponse) Write(p []byte) (int, error) {
+	r.once.Do(r.markPrivate)
+	return r.ResponseWriter.Write(p)
+}
+
+// markPrivate rewrites the Cache-Control header.
+func (r *privateResponse) markPrivate() {
+	r.Header().Set("Cache-Control", privateCacheControl(r.Header().Get("Cache-Control")))
+}
+
+// privateCacheControl returns the Cache-Control value with public and
+// s-maxage removed and private added.
+func privateCacheControl(value string) string {
+	directives := []string{"private"}
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		name, _, _ := strings.Cut(directive, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "public", "private", "s-maxage":
+			continue
+		}
+		directives = append(directives, directive)
+	}
+	return strings.Join(directives, ", ")
+}
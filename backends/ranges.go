@@ -0,0 +1,233 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges is the most ranges served from one request. Requests for more
+// are served the whole object, so a client can't make us open the object
+// an unbounded number of times.
+const maxRanges = 16
+
+// errNoOverlap is returned by parseRange when no requested range overlaps the
+// object. The response should be 416 Range Not Satisfiable.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// errInvalidRange is returned by parseRange for a Range header that can't be
+// parsed. The header should be ignored.
+var errInvalidRange = errors.New("invalid range")
+
+// httpRange is a span of bytes requested in a Range header.
+type httpRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range value for the range.
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// mimeHeader returns the part header for the range in a multipart/byteranges
+// body.
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// requestedRanges returns the ranges of an object of the given size that the
+// request asks for. No ranges means the whole object should be served.
+//
+// Ranges of empty objects are ignored, as net/http does, rather than
+// refused: some clients ask for "bytes=0-" on every request.
+func requestedRanges(request *http.Request, objectAttrs *ObjectAttrs, size int64) ([]httpRange, error) {
+	rangeHeader := request.Header.Get("Range")
+	if rangeHeader == "" || size == 0 || !rangeApplies(request, objectAttrs) {
+		return nil, nil
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if err == errInvalidRange {
+		return nil, nil
+	}
+	return ranges, err
+}
+
+// rangeApplies reports whether the Range header should be honored, according
+// to the If-Range header.
+func rangeApplies(request *http.Request, objectAttrs *ObjectAttrs) bool {
+	ifRange := request.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// If-Range requires a strong match
+		return etagListMatches(ifRange, etag(objectAttrs), false)
+	}
+	modifiedSince, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return lastModified(objectAttrs).Equal(modifiedSince)
+}
+
+// parseRange parses a Range header value of the form "bytes=0-99,200-" for an
+// object of the given size.
+//
+// Ranges which don't overlap the object are dropped; if none are left,
+// errNoOverlap is returned. If serving the ranges would take more than
+// serving the whole object, no ranges are returned.
+func parseRange(rangeHeader string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return nil, errInvalidRange
+	}
+	ranges := []httpRange{}
+	noOverlap := false
+	for _, spec := range strings.Split(rangeHeader[len(prefix):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		startString, endString, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		startString = textproto.TrimString(startString)
+		endString = textproto.TrimString(endString)
+		var r httpRange
+		if startString == "" {
+			// suffix range, e.g. "-500" is the last 500 bytes
+			suffix, err := strconv.ParseInt(endString, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, errInvalidRange
+			}
+			if suffix == 0 {
+				noOverlap = true
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			r.start = size - suffix
+			r.length = suffix
+		} else {
+			start, err := strconv.ParseInt(startString, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = start
+			if endString == "" {
+				r.length = size - start
+			} else {
+				end, err := strconv.ParseInt(endString, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+				r.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errNoOverlap
+		}
+		return nil, errInvalidRange
+	}
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// rangeOpener opens length bytes of an object, starting at offset.
+type rangeOpener func(offset, length int64) (io.ReadCloser, error)
+
+// multipartRanges streams the given ranges as a multipart/byteranges body. It
+// returns the body, its Content-Type and its length.
+func multipartRanges(ranges []httpRange, contentType string, size int64,
+	open rangeOpener) (io.ReadCloser, string, int64) {
+	bodyReader, bodyWriter := io.Pipe()
+	parts := multipart.NewWriter(bodyWriter)
+	bodyLength := multipartLength(ranges, contentType, size, parts.Boundary())
+	go func() {
+		for _, r := range ranges {
+			part, err := parts.CreatePart(r.mimeHeader(contentType, size))
+			if err != nil {
+				bodyWriter.CloseWithError(err)
+				return
+			}
+			media, err := open(r.start, r.length)
+			if err != nil {
+				bodyWriter.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, media)
+			media.Close()
+			if err != nil {
+				bodyWriter.CloseWithError(err)
+				return
+			}
+		}
+		parts.Close()
+		bodyWriter.Close()
+	}()
+	return bodyReader, "multipart/byteranges; boundary=" + parts.Boundary(), bodyLength
+}
+
+// multipartLength returns the length of the multipart/byteranges body
+// multipartRanges will produce, by writing the part headers to a counter.
+func multipartLength(ranges []httpRange, contentType string, size int64, boundary string) int64 {
+	var counter countingWriter
+	parts := multipart.NewWriter(&counter)
+	parts.SetBoundary(boundary)
+	for _, r := range ranges {
+		parts.CreatePart(r.mimeHeader(contentType, size))
+		counter += countingWriter(r.length)
+	}
+	parts.Close()
+	return int64(counter)
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   []httpRange
+		err    error
+	}{
+		{"bytes=0-99", 1000, []httpRange{{0, 100}}, nil},
+		{"bytes=500-", 1000, []httpRange{{500, 500}}, nil},
+		{"bytes=900-2000", 1000, []httpRange{{900, 100}}, nil},
+		{"bytes=999-999", 1000, []httpRange{{999, 1}}, nil},
+		// suffix ranges count from the end, and are cut to the object
+		{"bytes=-500", 1000, []httpRange{{500, 500}}, nil},
+		{"bytes=-2000", 1000, []httpRange{{0, 1000}}, nil},
+		{"bytes=-1", 1, []httpRange{{0, 1}}, nil},
+		// multiple ranges are kept in order
+		{"bytes=0-0,-1", 1000, []httpRange{{0, 1}, {999, 1}}, nil},
+		{"bytes= 0-9 , 20-29,", 1000, []httpRange{{0, 10}, {20, 10}}, nil},
+		// ranges that don't overlap are dropped, or refused if none do
+		{"bytes=0-9,1000-", 1000, []httpRange{{0, 10}}, nil},
+		{"bytes=1000-", 1000, nil, errNoOverlap},
+		{"bytes=1000-1999", 1000, nil, errNoOverlap},
+		{"bytes=-0", 1000, nil, errNoOverlap},
+		// malformed headers are ignored
+		{"items=0-9", 1000, nil, errInvalidRange},
+		{"bytes=", 1000, nil, errInvalidRange},
+		{"bytes=9-0", 1000, nil, errInvalidRange},
+		{"bytes=a-9", 1000, nil, errInvalidRange},
+		{"bytes=0-9,x", 1000, nil, errInvalidRange},
+		{"bytes=--5", 1000, nil, errInvalidRange},
+		// ranges that would take more than the object get the object
+		{"bytes=0-599,400-999", 1000, nil, nil},
+		{"bytes=" + strings.Repeat("0-0,", maxRanges+1), 1000, nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, tt.size)
+		if err != tt.err || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseRange(%q, %d) = %v, %v, want %v, %v", tt.header, tt.size, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	tests := []struct {
+		r    httpRange
+		size int64
+		want string
+	}{
+		{httpRange{0, 100}, 1000, "bytes 0-99/1000"},
+		{httpRange{999, 1}, 1000, "bytes 999-999/1000"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.contentRange(tt.size); got != tt.want {
+			t.Errorf("%v.contentRange(%d) = %q, want %q", tt.r, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestMultipartLength(t *testing.T) {
+	// the length promised must be the length sent
+	content := []byte("0123456789abcdefghij")
+	ranges := []httpRange{{0, 3}, {10, 5}, {19, 1}}
+	open := func(offset, length int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content[offset : offset+length])), nil
+	}
+	body, contentType, length := multipartRanges(ranges, "text/plain", int64(len(content)), open)
+	defer body.Close()
+	sent, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sent)) != length {
+		t.Errorf("multipartRanges sent %d bytes, promised %d", len(sent), length)
+	}
+	if !strings.HasPrefix(contentType, "multipart/byteranges; boundary=") {
+		t.Errorf("multipartRanges Content-Type = %q", contentType)
+	}
+	for _, want := range []string{"Content-Range: bytes 10-14/20", "abcde", "Content-Range: bytes 19-19/20"} {
+		if !bytes.Contains(sent, []byte(want)) {
+			t.Errorf("multipartRanges body lacks %q:\n%s", want, sent)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/local"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// object is an object to put in a test store.
+type object struct {
+	content string
+	attrs   backends.ObjectAttrs
+}
+
+// newStore returns a local backend holding objects, by name. Metadata
+// cached by other tests is dropped, since it's shared.
+func newStore(t *testing.T, objects map[string]object) *local.Backend {
+	t.Helper()
+	store, err := local.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, o := range objects {
+		if err := store.Put(context.Background(), name, o.attrs, strings.NewReader(o.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backends.MetadataCache().Flush()
+	t.Cleanup(func() { backends.MetadataCache().Flush() })
+	return store
+}
+
+// newRequest returns a GET request from tenant lpse1 for path, with headers
+// given as name, value pairs.
+func newRequest(path string, header ...string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set("x-lpse-id", "lpse1")
+	for i := 0; i+1 < len(header); i += 2 {
+		request.Header.Set(header[i], header[i+1])
+	}
+	return request
+}
+
+// read serves request from store with Read, through pipeline.
+func read(store backends.Backend, request *http.Request, pipeline filter.Pipeline) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	backends.Read(request.Context(), store, response, request, pipeline)
+	return response
+}
+
+func TestReadRanges(t *testing.T) {
+	store := newStore(t, map[string]object{
+		"lpse1/public/digits.txt": {content: "0123456789", attrs: backends.ObjectAttrs{ContentType: "text/plain"}},
+		"lpse1/public/empty.txt":  {content: "", attrs: backends.ObjectAttrs{ContentType: "text/plain"}},
+	})
+	tests := []struct {
+		name         string
+		path         string
+		rangeHeader  string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"whole", "/public/digits.txt", "", http.StatusOK, "", "0123456789"},
+		{"first bytes", "/public/digits.txt", "bytes=0-3", http.StatusPartialContent, "bytes 0-3/10", "0123"},
+		{"open ended", "/public/digits.txt", "bytes=7-", http.StatusPartialContent, "bytes 7-9/10", "789"},
+		{"suffix", "/public/digits.txt", "bytes=-2", http.StatusPartialContent, "bytes 8-9/10", "89"},
+		{"past the end", "/public/digits.txt", "bytes=5-99", http.StatusPartialContent, "bytes 5-9/10", "56789"},
+		{"unsatisfiable", "/public/digits.txt", "bytes=10-", http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{"malformed", "/public/digits.txt", "bytes=x-y", http.StatusOK, "", "0123456789"},
+		{"empty object", "/public/empty.txt", "bytes=0-", http.StatusOK, "", ""},
+		{"empty object suffix", "/public/empty.txt", "bytes=-5", http.StatusOK, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := read(store, newRequest(tt.path, "Range", tt.rangeHeader), nil)
+			if response.Code != tt.status {
+				t.Errorf("status = %d, want %d", response.Code, tt.status)
+			}
+			if got := response.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.status == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			if got := response.Body.String(); got != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+			if got := response.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+		})
+	}
+}
+
+func TestReadMultipleRanges(t *testing.T) {
+	store := newStore(t, map[string]object{
+		"lpse1/public/digits.txt": {content: "0123456789", attrs: backends.ObjectAttrs{ContentType: "text/plain"}},
+	})
+	response := read(store, newRequest("/public/digits.txt", "Range", "bytes=0-1,-3"), nil)
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", response.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", response.Header().Get("Content-Type"))
+	}
+	if got, want := response.Header().Get("Content-Length"), strconv.Itoa(response.Body.Len()); got != want {
+		t.Errorf("Content-Length = %s, body is %s bytes", got, want)
+	}
+	parts := multipart.NewReader(response.Body, params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/10", "01"},
+		{"bytes 7-9/10", "789"},
+	}
+	for _, w := range want {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != w.contentRange || part.Header.Get("Content-Type") != "text/plain" || string(body) != w.body {
+			t.Errorf("part = %v %q, want %s %q", part.Header, body, w.contentRange, w.body)
+		}
+	}
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Errorf("more parts than ranges: %v", err)
+	}
+}
+
+func TestReadIfRange(t *testing.T) {
+	store := newStore(t, map[string]object{
+		"lpse1/public/digits.txt": {content: "0123456789", attrs: backends.ObjectAttrs{ContentType: "text/plain"}},
+	})
+	tag := read(store, newRequest("/public/digits.txt"), nil).Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("no ETag")
+	}
+	// the range is only served if the object is still the one the client has
+	if response := read(store, newRequest("/public/digits.txt", "Range", "bytes=0-1", "If-Range", tag), nil); response.Code != http.StatusPartialContent {
+		t.Errorf("matching If-Range: status = %d, want 206", response.Code)
+	}
+	if response := read(store, newRequest("/public/digits.txt", "Range", "bytes=0-1", "If-Range", `"other"`), nil); response.Code != http.StatusOK || response.Body.String() != "0123456789" {
+		t.Errorf("changed If-Range: status = %d, body %q, want the whole object", response.Code, response.Body)
+	}
+}
+
+// failingStore is a store whose objects can be found but not read.
+type failingStore struct {
+	*local.Backend
+}
+
+func (failingStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return nil, errors.New("backend down")
+}
+
+func (failingStore) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return nil, errors.New("backend down")
+}
+
+func TestReadErrors(t *testing.T) {
+	store := newStore(t, map[string]object{
+		"lpse1/public/digits.txt": {content: "0123456789", attrs: backends.ObjectAttrs{
+			ContentType: "text/plain", ContentLanguage: "id", CacheControl: "public, max-age=60"}},
+	})
+	tests := []struct {
+		name    string
+		store   backends.Backend
+		request *http.Request
+		status  int
+	}{
+		{"missing", store, newRequest("/public/missing.txt"), http.StatusNotFound},
+		{"If-Match", store, newRequest("/public/digits.txt", "If-Match", `"other"`), http.StatusPreconditionFailed},
+		{"If-Unmodified-Since", store, newRequest("/public/digits.txt",
+			"If-Unmodified-Since", "Mon, 01 Jan 2001 00:00:00 GMT"), http.StatusPreconditionFailed},
+		{"unsatisfiable range", store, newRequest("/public/digits.txt", "Range", "bytes=20-"), http.StatusRequestedRangeNotSatisfiable},
+		{"backend failure", failingStore{store}, newRequest("/public/digits.txt"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := read(tt.store, tt.request, nil)
+			if response.Code != tt.status {
+				t.Errorf("status = %d, want %d", response.Code, tt.status)
+			}
+			if got := response.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/plain", got)
+			}
+			// the error isn't the object, and mustn't be taken for it
+			for _, header := range []string{"Content-Length", "Content-Encoding", "Content-Language", "ETag", "Last-Modified", "Cache-Control"} {
+				if got := response.Header().Get(header); got != "" {
+					t.Errorf("%s = %q, want none", header, got)
+				}
+			}
+			if got := response.Body.String(); got != "\n" {
+				t.Errorf("body = %q, want an empty line", got)
+			}
+		})
+	}
+}
+
+// countingStore counts the lookups of each object.
+type countingStore struct {
+	*local.Backend
+	stats map[string]int
+}
+
+func (s countingStore) Stat(ctx context.Context, name string) (*backends.ObjectAttrs, error) {
+	s.stats[name]++
+	return s.Backend.Stat(ctx, name)
+}
+
+func TestReadPrecompressed(t *testing.T) {
+	store := newStore(t, map[string]object{
+		"lpse1/public/app.js": {content: "console.log(1)", attrs: backends.ObjectAttrs{
+			ContentType: "text/javascript", CacheControl: "public, max-age=60"}},
+		"lpse1/public/app.js.br": {content: "brotli", attrs: backends.ObjectAttrs{
+			ContentType: "application/octet-stream"}},
+	})
+	response := read(store, newRequest("/public/app.js", "Accept-Encoding", "gzip, br"), nil)
+	if response.Body.String() != "brotli" || response.Header().Get("Content-Encoding") != "br" ||
+		response.Header().Get("Content-Type") != "text/javascript" || response.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("response = %v %q, want the .br sibling as the object", response.Header(), response.Body)
+	}
+	if response.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", response.Header().Get("Vary"))
+	}
+	// the .gz sibling is missing, so gzip gets the object as it is
+	response = read(store, newRequest("/public/app.js", "Accept-Encoding", "gzip"), nil)
+	if response.Body.String() != "console.log(1)" || response.Header().Get("Content-Encoding") != "" {
+		t.Errorf("response = %v %q, want the object", response.Header(), response.Body)
+	}
+}
+
+func TestReadPrecompressedAbsent(t *testing.T) {
+	objects := newStore(t, map[string]object{
+		"lpse1/public/app.js": {content: "console.log(1)", attrs: backends.ObjectAttrs{
+			ContentType: "text/javascript", CacheControl: "public, max-age=60"}},
+	})
+	store := countingStore{objects, map[string]int{}}
+	expires := func() time.Time {
+		entries := backends.MetadataCache().Entries("lpse1/public/app.js.br")
+		if len(entries) != 1 {
+			t.Fatalf("metadata cache entries = %v, want the missing .br sibling", entries)
+		}
+		return entries[0].Expires
+	}
+	read(store, newRequest("/public/app.js", "Accept-Encoding", "br"), nil)
+	first := expires()
+	time.Sleep(10 * time.Millisecond)
+	read(store, newRequest("/public/app.js", "Accept-Encoding", "br"), nil)
+	// the marker isn't renewed by requests, so a sibling uploaded later is
+	// found once it expires
+	if got := expires(); !got.Equal(first) {
+		t.Errorf("marker expiry moved from %v to %v", first, got)
+	}
+	if store.stats["lpse1/public/app.js.br"] != 1 {
+		t.Errorf("looked for the .br sibling %d times, want 1", store.stats["lpse1/public/app.js.br"])
+	}
+	backends.MetadataCache().Delete("lpse1/public/app.js.br")
+	if err := objects.Put(context.Background(), "lpse1/public/app.js.br", backends.ObjectAttrs{}, strings.NewReader("brotli")); err != nil {
+		t.Fatal(err)
+	}
+	if response := read(store, newRequest("/public/app.js", "Accept-Encoding", "br"), nil); response.Body.String() != "brotli" {
+		t.Errorf("body = %q after the sibling was uploaded, want it", response.Body)
+	}
+}
+
+func TestReadPrecompressedPrivate(t *testing.T) {
+	// objects that can't be cached aren't looked up again for every request,
+	// and neither are their missing siblings
+	objects := newStore(t, map[string]object{
+		"lpse1/public/app.js": {content: "console.log(1)", attrs: backends.ObjectAttrs{
+			ContentType: "text/javascript", CacheControl: "private, max-age=60"}},
+	})
+	store := countingStore{objects, map[string]int{}}
+	for i := 0; i < 3; i++ {
+		if response := read(store, newRequest("/public/app.js", "Accept-Encoding", "gzip, br"), nil); response.Body.String() != "console.log(1)" {
+			t.Fatalf("body = %q, want the object", response.Body)
+		}
+	}
+	for _, sibling := range []string{"lpse1/public/app.js.br", "lpse1/public/app.js.gz"} {
+		if store.stats[sibling] != 1 {
+			t.Errorf("looked for %s %d times, want 1", sibling, store.stats[sibling])
+		}
+	}
+}
+
+// signingStore is a store that signs URLs with a secret, or fails to.
+type signingStore struct {
+	*local.Backend
+	err  error
+	opts *backends.SignOptions
+}
+
+func (s signingStore) Sign(ctx context.Context, name string, opts backends.SignOptions) (string, error) {
+	*s.opts = opts
+	if s.err != nil {
+		return "", s.err
+	}
+	return "https://storage.example/" + name + "?signature=secret", nil
+}
+
+func TestReadWithSignedRedirect(t *testing.T) {
+	objects := newStore(t, map[string]object{
+		"lpse1/private/a.txt": {content: "private", attrs: backends.ObjectAttrs{ContentType: "text/plain"}},
+	})
+	logged := new(strings.Builder)
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(logged)
+	redirect := func(store backends.Backend) *httptest.ResponseRecorder {
+		request := newRequest("/private/a.txt")
+		response := httptest.NewRecorder()
+		response.Header().Set("Content-Disposition", "attachment")
+		backends.ReadWithSignedRedirect(request.Context(), store, response, request, nil, 10*time.Minute, http.StatusFound)
+		return response
+	}
+
+	opts := &backends.SignOptions{}
+	response := redirect(signingStore{objects, nil, opts})
+	if response.Code != http.StatusFound || response.Header().Get("Location") != "https://storage.example/lpse1/private/a.txt?signature=secret" {
+		t.Errorf("response = %d to %q, want a redirect to the signed URL", response.Code, response.Header().Get("Location"))
+	}
+	if response.Header().Get("Cache-Control") != "private, max-age=600" || response.Header().Get("Content-Disposition") != "" {
+		t.Errorf("headers = %v, want them private, and the disposition signed instead", response.Header())
+	}
+	if opts.ResponseContentDisposition != "attachment" || time.Until(opts.Expires) > 10*time.Minute {
+		t.Errorf("signed %+v, want the disposition, for 10 minutes", *opts)
+	}
+	if strings.Contains(logged.String(), "secret") || !strings.Contains(logged.String(), "lpse1/private/a.txt") {
+		t.Errorf("logged %q, want the object but not the URL", logged)
+	}
+
+	// a signing failure isn't a redirect to nowhere
+	response = redirect(signingStore{objects, errors.New("no key"), opts})
+	if response.Code != http.StatusInternalServerError || response.Header().Get("Location") != "" {
+		t.Errorf("response = %d to %q, want 500", response.Code, response.Header().Get("Location"))
+	}
+
+	// backends that can't sign stream the object instead
+	response = redirect(objects)
+	if response.Code != http.StatusOK || response.Body.String() != "private" {
+		t.Errorf("response = %d %q, want the object", response.Code, response.Body)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+	"github.com/rs/zerolog/log"
+)
+
+// cacheStatusHeader tells clients that a response was served from an
+// expired cache entry.
+const cacheStatusHeader = "X-Cache-Status"
+
+// markStale flags the response as served from an expired cache entry.
+func markStale(response http.ResponseWriter) {
+	response.Header().Set(cacheStatusHeader, "STALE")
+}
+
+// refreshing holds the cache keys of media being refreshed in the
+// background, so each is refreshed once however many requests see it stale.
+var refreshing sync.Map
+
+// refreshMedia fetches an object again in the background, running it through
+// pipeline so its cache fill filters replace the stale media cached under
+// cacheKey.
+func refreshMedia(ctx context.Context, store Backend, objectName string,
+	cacheKey string, request *http.Request, pipeline filter.Pipeline) {
+	if len(pipeline) == 0 {
+		return
+	}
+	if _, busy := refreshing.LoadOrStore(cacheKey, true); busy {
+		return
+	}
+	ctx = detached{ctx}
+	// the refresh is of the whole object, whatever the client asked for
+	request = request.Clone(ctx)
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match",
+		"If-Modified-Since", "If-Unmodified-Since"} {
+		request.Header.Del(header)
+	}
+	go func() {
+		defer refreshing.Delete(cacheKey)
+		objectAttrs, err := fetchAttrs(ctx, store, objectName)
+		if err != nil {
+			log.Warn().Msgf("refreshMedia: %q: %v", objectName, err)
+			return
+		}
+		media, err := store.Open(ctx, objectName)
+		if err != nil {
+			log.Warn().Msgf("refreshMedia: %q: %v", objectName, err)
+			return
+		}
+		defer media.Close()
+		response := &discardResponse{header: http.Header{}}
+		writeHeaders(response, objectAttrs)
+		if _, err := filter.PipelineCopy(ctx, response, media, request, pipeline); err != nil {
+			log.Warn().Msgf("refreshMedia: %q: %v", objectName, err)
+		}
+	}()
+}
+
+// discardResponse is a response nobody reads, for running pipelines only
+// for their side effects.
+type discardResponse struct {
+	header http.Header
+}
+
+func (r *discardResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *discardResponse) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (r *discardResponse) WriteHeader(int) {}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+)
+
+// staleMedia is a CacheGet that finds media that expired stale ago.
+func staleMedia(media string, stale time.Duration) CacheGet {
+	return func(string) ([]byte, time.Duration, bool) {
+		return []byte(media), stale, true
+	}
+}
+
+// readStale serves the object at path, finding cached media with cacheGet,
+// and filling the cache with pipeline on misses and refreshes.
+func readStale(store Backend, path string, cacheGet CacheGet, pipeline filter.Pipeline) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set("x-lpse-id", "lpse1")
+	response := httptest.NewRecorder()
+	ReadWithCache(context.Background(), store, response, request, pipeline,
+		cacheGet, noStreamCache, filter.Pipeline{})
+	return response
+}
+
+// cacheAttrs caches attrs for the object they name, expiring after expiry.
+func cacheAttrs(attrs *ObjectAttrs, expiry time.Duration) {
+	objectMetadataCache.Set(attrs.Name, attrs, attrsSize(attrs), expiry)
+}
+
+func TestReadStaleWhileRevalidate(t *testing.T) {
+	objectMetadataCache.Flush()
+	defer objectMetadataCache.Flush()
+	attrs := &ObjectAttrs{Name: "lpse1/public/swr.txt", Size: 5, ContentType: "text/plain",
+		CacheControl: "max-age=60, stale-while-revalidate=60"}
+	cacheAttrs(attrs, time.Minute)
+	release := make(chan struct{})
+	store := &flightStore{
+		source: func() io.Reader {
+			<-release
+			return strings.NewReader("new!!")
+		},
+		stat: func() (*ObjectAttrs, error) { return attrs, nil },
+	}
+	filled := make(chan string, 10)
+	pipeline := filter.Pipeline{func(c context.Context, handle filter.MediaFilterHandle) error {
+		return filter.FillCache(c, handle, func(key string, media []byte, expiry time.Duration) {
+			filled <- string(media)
+		}, 1<<20)
+	}}
+
+	// every request is answered from the cache while one refresh is
+	// under way
+	for i := 0; i < 5; i++ {
+		response := readStale(store, "/public/swr.txt", staleMedia("old!!", 10*time.Second), pipeline)
+		if response.Code != http.StatusOK || response.Body.String() != "old!!" ||
+			response.Header().Get(cacheStatusHeader) != "STALE" {
+			t.Fatalf("request %d: %d %q, %s %q, want the stale media", i, response.Code,
+				response.Body.String(), cacheStatusHeader, response.Header().Get(cacheStatusHeader))
+		}
+	}
+	close(release)
+	select {
+	case media := <-filled:
+		if media != "new!!" {
+			t.Errorf("refreshed the cache with %q, want %q", media, "new!!")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the cache wasn't refreshed")
+	}
+	waitFor(t, "the refresh to end", func() bool {
+		_, busy := refreshing.Load("lpse1/public/swr.txt")
+		return !busy
+	})
+	if opens := store.opens.Load(); opens != 1 {
+		t.Errorf("%d refreshes, want 1", opens)
+	}
+
+	// media past the window is a miss
+	response := readStale(store, "/public/swr.txt", staleMedia("old!!", 2*time.Minute), pipeline)
+	if response.Body.String() != "new!!" || response.Header().Get(cacheStatusHeader) != "" {
+		t.Errorf("past the window: %q, %s %q, want the object", response.Body.String(),
+			cacheStatusHeader, response.Header().Get(cacheStatusHeader))
+	}
+}
+
+func TestReadStaleIfError(t *testing.T) {
+	objectMetadataCache.Flush()
+	defer objectMetadataCache.Flush()
+	attrs := &ObjectAttrs{Name: "lpse1/public/sie.txt", Size: 5, ContentType: "text/plain",
+		CacheControl: "max-age=60, stale-if-error=60"}
+	cacheAttrs(attrs, time.Minute)
+	failing := &flightStore{openErr: errors.New("backend down")}
+	working := &flightStore{source: func() io.Reader { return strings.NewReader("new!!") }}
+	for _, test := range []struct {
+		name   string
+		store  Backend
+		cached string
+		stale  time.Duration
+		code   int
+		body   string
+	}{
+		{"within the window", failing, "old!!", 10 * time.Second, http.StatusOK, "old!!"},
+		{"past the window", failing, "old!!", 2 * time.Minute, http.StatusInternalServerError, ""},
+		{"cut short", failing, "old", 10 * time.Second, http.StatusInternalServerError, ""},
+		{"backend up", working, "old!!", 10 * time.Second, http.StatusOK, "new!!"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			response := readStale(test.store, "/public/sie.txt", staleMedia(test.cached, test.stale), nil)
+			body := response.Body.String()
+			if test.code != http.StatusOK {
+				body = ""
+			}
+			if response.Code != test.code || body != test.body {
+				t.Errorf("got %d %q, want %d %q", response.Code, body, test.code, test.body)
+			}
+			wantStale := test.body == "old!!"
+			if stale := response.Header().Get(cacheStatusHeader) == "STALE"; stale != wantStale {
+				t.Errorf("marked stale: %v, want %v", stale, wantStale)
+			}
+		})
+	}
+}
+
+func TestGetAttrsStaleWhileRevalidate(t *testing.T) {
+	objectMetadataCache.Flush()
+	defer objectMetadataCache.Flush()
+	old := &ObjectAttrs{Name: "lpse1/public/a.txt", Generation: 1,
+		CacheControl: "max-age=60, stale-while-revalidate=60"}
+	cacheAttrs(old, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	fresh := *old
+	fresh.Generation = 2
+	release := make(chan struct{})
+	store := &flightStore{stat: func() (*ObjectAttrs, error) {
+		<-release
+		return &fresh, nil
+	}}
+	for i := 0; i < 5; i++ {
+		attrs, stale, err := getAttrs(context.Background(), store, old.Name)
+		if err != nil || !stale || attrs.Generation != 1 {
+			t.Fatalf("lookup %d: generation %d, stale %v, %v; want the stale metadata", i, attrs.Generation, stale, err)
+		}
+	}
+	close(release)
+	waitFor(t, "the refresh", func() bool {
+		attrs, stale, err := getAttrs(context.Background(), store, old.Name)
+		return err == nil && !stale && attrs.Generation == 2
+	})
+	if stats := store.stats.Load(); stats != 1 {
+		t.Errorf("%d refreshes, want 1", stats)
+	}
+}
+
+func TestGetAttrsStaleIfError(t *testing.T) {
+	errBackend := errors.New("backend down")
+	for _, test := range []struct {
+		name         string
+		cacheControl string
+		err          error
+		stale        bool
+	}{
+		{"within the window", "max-age=60, stale-if-error=60", errBackend, true},
+		{"no window", "max-age=60", errBackend, false},
+		{"gone", "max-age=60, stale-if-error=60", ErrObjectNotExist, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			objectMetadataCache.Flush()
+			defer objectMetadataCache.Flush()
+			cacheAttrs(&ObjectAttrs{Name: "lpse1/public/a.txt", CacheControl: test.cacheControl}, time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+			store := &flightStore{stat: func() (*ObjectAttrs, error) { return nil, test.err }}
+			attrs, stale, err := getAttrs(context.Background(), store, "lpse1/public/a.txt")
+			if test.stale {
+				if err != nil || !stale || attrs == nil {
+					t.Errorf("got %v, stale %v, %v; want the stale metadata", attrs, stale, err)
+				}
+			} else if !errors.Is(err, test.err) {
+				t.Errorf("got %v, stale %v, %v; want %v", attrs, stale, err, test.err)
+			}
+		})
+	}
+}
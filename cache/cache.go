@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// Cache is what the cache tiers have in common: enough to inspect and purge
+// them, whatever they hold.
+type Cache interface {
+	// Entries describes the entries whose keys start with prefix, sorted by
+	// key. Expired entries still kept for stale serving are included.
+	Entries(prefix string) []EntryInfo
+	// Delete removes the entry for key, and reports whether there was one.
+	Delete(key string) bool
+	// DeletePrefix removes the entries whose keys start with prefix, and
+	// returns how many there were.
+	DeletePrefix(prefix string) int
+	// Flush removes every entry, and returns how many there were.
+	Flush() int
+	// Stats returns a snapshot of the cache's counters.
+	Stats() Stats
+}
+
+var (
+	_ Cache = (*Memory)(nil)
+	_ Cache = (*Disk)(nil)
+)
+
+// EntryInfo describes one cache entry.
+type EntryInfo struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// Expires is the zero time for entries that don't expire.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// sortEntries sorts entries by key.
+func sortEntries(entries []EntryInfo) []EntryInfo {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
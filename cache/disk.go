@@ -0,0 +1,451 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// indexSaveDelay batches index writes, so a burst of fills writes the index
+// once.
+const indexSaveDelay = 2 * time.Second
+
+// DiskOptions configures a Disk cache.
+type DiskOptions struct {
+	// Dir is where cached media and the index are kept.
+	Dir string
+	// MaxBytes is the budget for the media on disk.
+	MaxBytes int64
+	// MaxEntryBytes is the largest single entry that will be stored.
+	// Zero means MaxBytes.
+	MaxEntryBytes int64
+	// DefaultExpiration is used for entries created with DefaultExpiration.
+	DefaultExpiration time.Duration
+	// MaxStale is how long expired entries are kept, so they can still be
+	// served stale with OpenStale.
+	MaxStale time.Duration
+}
+
+// Disk is a cache of media on local disk, for objects too big to keep in
+// memory. Entries are streamed in and out rather than buffered.
+//
+// Media is content-addressed: each file is named by the SHA-256 of its
+// content, so keys with identical media (e.g., the same object requested
+// with different query strings) share one file. An index maps keys to
+// content and is persisted so the cache survives restarts. Entries are
+// evicted least recently used first.
+type Disk struct {
+	mu        sync.Mutex
+	opts      DiskOptions
+	entries   map[string]*diskEntry
+	order     *list.List
+	refs      map[string]int
+	stats     Stats
+	saveTimer *time.Timer
+}
+
+// diskEntry is one key in the index.
+type diskEntry struct {
+	Key     string    `json:"key"`
+	Content string    `json:"content"`
+	Size    int64     `json:"size"`
+	Expires time.Time `json:"expires,omitempty"`
+	element *list.Element
+}
+
+// NewDisk opens, or creates, a Disk cache in opts.Dir.
+func NewDisk(opts DiskOptions) (*Disk, error) {
+	if opts.MaxEntryBytes <= 0 || opts.MaxEntryBytes > opts.MaxBytes {
+		opts.MaxEntryBytes = opts.MaxBytes
+	}
+	for _, dir := range []string{opts.Dir, filepath.Join(opts.Dir, "objects"), filepath.Join(opts.Dir, "tmp")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	c := &Disk{
+		opts:    opts,
+		entries: map[string]*diskEntry{},
+		order:   list.New(),
+		refs:    map[string]int{},
+	}
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DiskReader reads one cached entry. It must be closed.
+type DiskReader struct {
+	*os.File
+	size int64
+}
+
+// Size returns the length of the cached media.
+func (r *DiskReader) Size() int64 {
+	return r.size
+}
+
+// Open returns a reader for the media cached under key, if there is an
+// unexpired entry.
+func (c *Disk) Open(key string) (*DiskReader, bool) {
+	reader, stale, ok := c.OpenStale(key)
+	if ok && stale > 0 {
+		reader.Close()
+		return nil, false
+	}
+	return reader, ok
+}
+
+// OpenStale returns a reader for the media cached under key, even if it has
+// expired, as long as it is within the cache's MaxStale. stale is how long
+// ago the entry expired, or zero if it hasn't. Only unexpired entries count
+// as hits.
+func (c *Disk) OpenStale(key string) (reader *DiskReader, stale time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e, ok := c.entries[key]
+	if ok && !e.Expires.IsZero() && now.After(e.Expires.Add(c.opts.MaxStale)) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, 0, false
+	}
+	// an open file outlives its eviction, so readers are never cut short
+	file, err := c.openContent(e)
+	if err != nil {
+		log.Error().Msgf("disk cache: %v", err)
+		c.remove(e)
+		c.stats.Misses++
+		return nil, 0, false
+	}
+	if !e.Expires.IsZero() && now.After(e.Expires) {
+		c.stats.Misses++
+		stale = now.Sub(e.Expires)
+	} else {
+		c.stats.Hits++
+	}
+	c.order.MoveToFront(e.element)
+	return &DiskReader{File: file, size: e.Size}, stale, true
+}
+
+// Create starts a new entry for key. Media written to the returned writer
+// is cached when it is committed.
+func (c *Disk) Create(key string, ttl time.Duration) (*DiskWriter, error) {
+	file, err := os.CreateTemp(filepath.Join(c.opts.Dir, "tmp"), "fill-")
+	if err != nil {
+		return nil, err
+	}
+	if ttl == DefaultExpiration {
+		ttl = c.opts.DefaultExpiration
+	}
+	return &DiskWriter{cache: c, key: key, ttl: ttl, file: file, hash: sha256.New()}, nil
+}
+
+// Delete removes the entry for key, and reports whether there was one.
+func (c *Disk) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.remove(e)
+	}
+	return ok
+}
+
+// Entries describes the entries whose keys start with prefix, sorted by key.
+func (c *Disk) Entries(prefix string) []EntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []EntryInfo{}
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, EntryInfo{Key: key, Size: e.Size, Expires: e.Expires})
+		}
+	}
+	return sortEntries(entries)
+}
+
+// DeletePrefix removes the entries whose keys start with prefix, and
+// returns how many there were.
+func (c *Disk) DeletePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes every entry, and returns how many there were.
+func (c *Disk) Flush() int {
+	return c.DeletePrefix("")
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Disk) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// DiskWriter streams media into a new Disk cache entry.
+//
+// Write never fails, so it is safe to tee a response into: write errors, and
+// media bigger than the cache's entry limit, make Commit discard the entry.
+type DiskWriter struct {
+	cache  *Disk
+	key    string
+	ttl    time.Duration
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	failed bool
+}
+
+func (w *DiskWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return len(p), nil
+	}
+	if w.size+int64(len(p)) > w.cache.opts.MaxEntryBytes {
+		w.failed = true
+		return len(p), nil
+	}
+	if _, err := w.file.Write(p); err != nil {
+		log.Error().Msgf("disk cache: %v", err)
+		w.failed = true
+		return len(p), nil
+	}
+	w.hash.Write(p)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// Commit adds the written media to the cache.
+func (w *DiskWriter) Commit() error {
+	if w.failed {
+		w.Abort()
+		return nil
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	content := hex.EncodeToString(w.hash.Sum(nil))
+	return w.cache.add(w.file.Name(), &diskEntry{Key: w.key, Content: content, Size: w.size, Expires: expiry(w.ttl)})
+}
+
+// Abort discards the written media.
+func (w *DiskWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// add moves a filled temporary file into place, indexes it and evicts
+// other entries to stay within budget. The move happens under the lock, so
+// it can't race with removal of another entry with the same content.
+func (c *Disk) add(tmpName string, e *diskEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmpName, c.contentPath(e.Content)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	c.replace(e)
+	for c.stats.Bytes > c.opts.MaxBytes && c.order.Len() > 1 {
+		c.remove(c.order.Back().Value.(*diskEntry))
+		c.stats.Evictions++
+	}
+	c.scheduleSave()
+	return nil
+}
+
+// replace adds e to the index in place of any entry for the same key. The
+// new entry is added first, so content the two share is kept. Callers must
+// hold c.mu.
+func (c *Disk) replace(e *diskEntry) {
+	old, ok := c.entries[e.Key]
+	c.insert(e)
+	if ok {
+		c.remove(old)
+	}
+}
+
+// insert adds e to the index. Callers must hold c.mu.
+func (c *Disk) insert(e *diskEntry) {
+	e.element = c.order.PushFront(e)
+	c.entries[e.Key] = e
+	if c.refs[e.Content] == 0 {
+		c.stats.Bytes += e.Size
+	}
+	c.refs[e.Content]++
+	c.stats.Entries++
+}
+
+// remove drops e from the index, deleting its media if no other key refers
+// to it. Callers must hold c.mu.
+func (c *Disk) remove(e *diskEntry) {
+	c.order.Remove(e.element)
+	if c.entries[e.Key] == e {
+		delete(c.entries, e.Key)
+	}
+	c.stats.Entries--
+	c.refs[e.Content]--
+	if c.refs[e.Content] == 0 {
+		delete(c.refs, e.Content)
+		c.stats.Bytes -= e.Size
+		if err := os.Remove(c.contentPath(e.Content)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Error().Msgf("disk cache: %v", err)
+		}
+	}
+	c.scheduleSave()
+}
+
+// openContent opens the media of e, checking it's all there: a file cut
+// short, as by a full disk, is as good as missing.
+func (c *Disk) openContent(e *diskEntry) (*os.File, error) {
+	file, err := os.Open(c.contentPath(e.Content))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() != e.Size {
+		err = fmt.Errorf("%s is %d bytes, not %d", file.Name(), info.Size(), e.Size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// contentPath returns the file holding the given content.
+func (c *Disk) contentPath(content string) string {
+	return filepath.Join(c.opts.Dir, "objects", content)
+}
+
+// indexPath returns the file holding the index.
+func (c *Disk) indexPath() string {
+	return filepath.Join(c.opts.Dir, "index.json")
+}
+
+// scheduleSave arranges for the index to be saved soon. Callers must hold
+// c.mu.
+func (c *Disk) scheduleSave() {
+	if c.saveTimer == nil {
+		c.saveTimer = time.AfterFunc(indexSaveDelay, c.saveIndex)
+	}
+}
+
+// saveIndex writes the index, most recently used entry first.
+func (c *Disk) saveIndex() {
+	c.mu.Lock()
+	c.saveTimer = nil
+	index := make([]*diskEntry, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		index = append(index, element.Value.(*diskEntry))
+	}
+	indexBytes, err := json.Marshal(index)
+	c.mu.Unlock()
+	if err != nil {
+		log.Error().Msgf("disk cache: %v", err)
+		return
+	}
+	tmp := c.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, indexBytes, 0o644); err != nil {
+		log.Error().Msgf("disk cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.indexPath()); err != nil {
+		log.Error().Msgf("disk cache: %v", err)
+	}
+}
+
+// loadIndex restores the index from disk, dropping entries whose media is
+// gone, cut short or too stale to serve, and deleting media no entry refers
+// to.
+func (c *Disk) loadIndex() error {
+	index := []*diskEntry{}
+	indexBytes, err := os.ReadFile(c.indexPath())
+	if err == nil {
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			log.Warn().Msgf("disk cache: discarding unreadable index: %v", err)
+			index = nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	now := time.Now()
+	// the index is saved most recent first; insert oldest first to keep order
+	for i := len(index) - 1; i >= 0; i-- {
+		e := index[i]
+		if !e.Expires.IsZero() && now.After(e.Expires.Add(c.opts.MaxStale)) {
+			continue
+		}
+		if info, err := os.Stat(c.contentPath(e.Content)); err != nil || info.Size() != e.Size {
+			continue
+		}
+		c.replace(e)
+	}
+	for c.stats.Bytes > c.opts.MaxBytes && c.order.Len() > 0 {
+		c.remove(c.order.Back().Value.(*diskEntry))
+	}
+	// sweep media and partial fills left behind
+	files, err := os.ReadDir(filepath.Join(c.opts.Dir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if c.refs[file.Name()] == 0 {
+			os.Remove(c.contentPath(file.Name()))
+		}
+	}
+	tmpFiles, err := os.ReadDir(filepath.Join(c.opts.Dir, "tmp"))
+	if err != nil {
+		return err
+	}
+	for _, file := range tmpFiles {
+		os.Remove(filepath.Join(c.opts.Dir, "tmp", file.Name()))
+	}
+	return nil
+}
+
+// expiry returns the expiration time for a TTL, or the zero time for none.
+func expiry(ttl time.Duration) time.Time {
+	if ttl > 0 {
+		return time.Now().Add(ttl)
+	}
+	return time.Time{}
+}
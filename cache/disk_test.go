@@ -0,0 +1,220 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newDisk returns a Disk cache that stops saving its index when the test
+// ends, so no save outlives the test's directory.
+func newDisk(t *testing.T, opts DiskOptions) *Disk {
+	t.Helper()
+	c, err := NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopSaving(c) })
+	return c
+}
+
+// stopSaving cancels a scheduled index save.
+func stopSaving(c *Disk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+}
+
+// fill caches media under key.
+func fill(t *testing.T, c *Disk, key, media string, ttl time.Duration) {
+	t.Helper()
+	writer, err := c.Create(key, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(writer, media)
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cached returns the media cached under key, or "" if there is none.
+func cached(t *testing.T, c *Disk, key string) string {
+	t.Helper()
+	reader, ok := c.Open(key)
+	if !ok {
+		return ""
+	}
+	defer reader.Close()
+	media, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(media)) != reader.Size() {
+		t.Errorf("%s: read %d bytes of %d", key, len(media), reader.Size())
+	}
+	return string(media)
+}
+
+// blobs returns how many media files c keeps.
+func blobs(t *testing.T, c *Disk) int {
+	t.Helper()
+	files, err := os.ReadDir(filepath.Join(c.opts.Dir, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestDiskSharedContent(t *testing.T) {
+	c := newDisk(t, DiskOptions{Dir: t.TempDir(), MaxBytes: 100})
+	fill(t, c, "a.jpg", "same", NoExpiration)
+	fill(t, c, "a.jpg?v=1", "same", NoExpiration)
+	fill(t, c, "b.jpg", "other", NoExpiration)
+	if n := blobs(t, c); n != 2 {
+		t.Errorf("%d files, want 2: identical media is kept once", n)
+	}
+	if stats := c.Stats(); stats.Bytes != 9 || stats.Entries != 3 {
+		t.Errorf("stats = %+v, want shared media counted once", stats)
+	}
+	// overwriting a key with the same media keeps it
+	fill(t, c, "a.jpg", "same", NoExpiration)
+	c.Delete("a.jpg")
+	if cached(t, c, "a.jpg?v=1") != "same" || blobs(t, c) != 2 {
+		t.Error("media was deleted while a key still referred to it")
+	}
+	c.Delete("a.jpg?v=1")
+	if blobs(t, c) != 1 || c.Stats().Bytes != 5 {
+		t.Errorf("%d files, %d bytes, want the shared media deleted with its last key", blobs(t, c), c.Stats().Bytes)
+	}
+}
+
+func TestDiskEviction(t *testing.T) {
+	c := newDisk(t, DiskOptions{Dir: t.TempDir(), MaxBytes: 10, MaxEntryBytes: 6})
+	fill(t, c, "a", "aaaa", NoExpiration)
+	fill(t, c, "b", "bbbb", NoExpiration)
+	cached(t, c, "a")
+	// b is the least recently used
+	fill(t, c, "c", "cccc", NoExpiration)
+	if cached(t, c, "b") != "" || cached(t, c, "a") != "aaaa" || cached(t, c, "c") != "cccc" {
+		t.Error("eviction didn't take the least recently used entry")
+	}
+	if stats := c.Stats(); stats.Bytes > 10 || stats.Evictions != 1 || blobs(t, c) != 2 {
+		t.Errorf("stats = %+v with %d files, want 2 entries within 10 bytes", stats, blobs(t, c))
+	}
+	// media over MaxEntryBytes isn't cached, and evicts nothing
+	fill(t, c, "big", "0123456", NoExpiration)
+	if cached(t, c, "big") != "" || c.Stats().Entries != 2 {
+		t.Error("an entry over MaxEntryBytes was cached")
+	}
+	if files, _ := os.ReadDir(filepath.Join(c.opts.Dir, "tmp")); len(files) != 0 {
+		t.Errorf("%d partial fills left behind", len(files))
+	}
+}
+
+func TestDiskMissingContent(t *testing.T) {
+	c := newDisk(t, DiskOptions{Dir: t.TempDir(), MaxBytes: 100})
+	fill(t, c, "gone", "gone", NoExpiration)
+	fill(t, c, "short", "short", NoExpiration)
+	os.Remove(c.contentPath(c.entries["gone"].Content))
+	os.WriteFile(c.contentPath(c.entries["short"].Content), []byte("sh"), 0o644)
+	for _, key := range []string{"gone", "short"} {
+		if media := cached(t, c, key); media != "" {
+			t.Errorf("%s = %q, want a miss", key, media)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 || stats.Misses != 2 {
+		t.Errorf("stats = %+v, want the broken entries dropped as misses", stats)
+	}
+}
+
+func TestDiskExpiry(t *testing.T) {
+	c := newDisk(t, DiskOptions{Dir: t.TempDir(), MaxBytes: 100, MaxStale: time.Hour})
+	fill(t, c, "a", "aaaa", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if cached(t, c, "a") != "" {
+		t.Error("Open returned an expired entry")
+	}
+	reader, stale, ok := c.OpenStale("a")
+	if !ok || stale <= 0 {
+		t.Fatalf("OpenStale = %v, %v, want the stale entry", stale, ok)
+	}
+	reader.Close()
+}
+
+func TestDiskReload(t *testing.T) {
+	dir := t.TempDir()
+	opts := DiskOptions{Dir: dir, MaxBytes: 100, MaxStale: time.Millisecond}
+	c := newDisk(t, opts)
+	fill(t, c, "old", "old", NoExpiration)
+	fill(t, c, "shared1", "shared", NoExpiration)
+	fill(t, c, "shared2", "shared", NoExpiration)
+	fill(t, c, "expired", "expired", time.Millisecond)
+	fill(t, c, "gone", "gone", NoExpiration)
+	cached(t, c, "old")
+	os.Remove(c.contentPath(c.entries["gone"].Content))
+	stopSaving(c)
+	c.saveIndex()
+	// a fill that never finished, and media the index doesn't know
+	os.WriteFile(filepath.Join(dir, "tmp", "fill-1"), []byte("partial"), 0o644)
+	os.WriteFile(filepath.Join(dir, "objects", "stray"), []byte("stray"), 0o644)
+	time.Sleep(5 * time.Millisecond)
+
+	reopened := newDisk(t, opts)
+	for key, want := range map[string]string{"old": "old", "shared1": "shared", "shared2": "shared", "expired": "", "gone": ""} {
+		if got := cached(t, reopened, key); got != want {
+			t.Errorf("%s = %q after reopening, want %q", key, got, want)
+		}
+	}
+	if stats := reopened.Stats(); stats.Entries != 3 || stats.Bytes != 9 {
+		t.Errorf("stats = %+v after reopening, want 3 entries in 9 bytes", stats)
+	}
+	if n := blobs(t, reopened); n != 2 {
+		t.Errorf("%d files after reopening, want 2", n)
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(files) != 0 {
+		t.Errorf("%d partial fills left after reopening", len(files))
+	}
+
+	// recency survives too: old was used last, so shared1 goes first
+	small := newDisk(t, DiskOptions{Dir: dir, MaxBytes: 9})
+	stopSaving(small)
+	fill(t, small, "new", "new", NoExpiration)
+	if cached(t, small, "old") != "old" || cached(t, small, "shared1") != "" {
+		t.Error("eviction after reopening didn't go by the saved recency")
+	}
+}
+
+func TestDiskPrefix(t *testing.T) {
+	c := newDisk(t, DiskOptions{Dir: t.TempDir(), MaxBytes: 100})
+	fill(t, c, "lpse1/a", "1", NoExpiration)
+	fill(t, c, "lpse1/b", "2", NoExpiration)
+	fill(t, c, "lpse2/a", "3", NoExpiration)
+	if entries := c.Entries("lpse1/"); len(entries) != 2 || entries[0].Key != "lpse1/a" {
+		t.Errorf("Entries = %v, want lpse1's, sorted", entries)
+	}
+	if removed := c.DeletePrefix("lpse1/"); removed != 2 || blobs(t, c) != 1 {
+		t.Errorf("DeletePrefix removed %d, leaving %d files", removed, blobs(t, c))
+	}
+	if removed := c.Flush(); removed != 1 || blobs(t, c) != 0 {
+		t.Errorf("Flush removed %d, leaving %d files", removed, blobs(t, c))
+	}
+}
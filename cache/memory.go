@@ -0,0 +1,309 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultExpiration, passed to Set, uses the cache's default expiration.
+	DefaultExpiration time.Duration = 0
+	// NoExpiration, passed to Set, keeps the entry until it is evicted.
+	NoExpiration time.Duration = -1
+)
+
+// Policy decides which entry is evicted when a cache is full.
+type Policy int
+
+const (
+	// LRU evicts the least recently used entry.
+	LRU Policy = iota
+	// LFU evicts the least frequently used entry, breaking ties by recency.
+	LFU
+)
+
+// ParsePolicy returns the policy named by s, "lru" or "lfu".
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "", "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	}
+	return LRU, fmt.Errorf("cache: unknown eviction policy %q", s)
+}
+
+// Options configures a Memory cache.
+type Options struct {
+	// MaxBytes is the budget for the sizes of all entries.
+	MaxBytes int64
+	// MaxEntryBytes is the largest single entry that will be stored.
+	// Zero means MaxBytes.
+	MaxEntryBytes int64
+	// Policy picks entries to evict when the budget is exceeded.
+	Policy Policy
+	// DefaultExpiration is used for entries set with DefaultExpiration.
+	DefaultExpiration time.Duration
+	// MaxStale is how long expired entries are kept, so they can still be
+	// served stale with GetStale.
+	MaxStale time.Duration
+}
+
+// Stats are counters describing a cache's effectiveness.
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int64 `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Memory is an in-memory cache with a byte budget. Callers say how big each
+// entry is when they set it; when the total exceeds the budget, entries are
+// evicted according to the cache's policy.
+type Memory struct {
+	mu      sync.Mutex
+	opts    Options
+	entries map[string]*entry
+	queue   evictionQueue
+	clock   int64
+	stats   Stats
+}
+
+// entry is one cached value, and its position in the eviction queue.
+type entry struct {
+	key      string
+	value    interface{}
+	size     int64
+	expires  time.Time
+	uses     int64
+	lastUsed int64
+	index    int
+}
+
+// NewMemory returns an empty Memory cache.
+func NewMemory(opts Options) *Memory {
+	if opts.MaxEntryBytes <= 0 || opts.MaxEntryBytes > opts.MaxBytes {
+		opts.MaxEntryBytes = opts.MaxBytes
+	}
+	return &Memory{
+		opts:    opts,
+		entries: map[string]*entry{},
+		queue:   evictionQueue{policy: opts.Policy},
+	}
+}
+
+// Get returns the value cached under key, if there is an unexpired one.
+func (c *Memory) Get(key string) (interface{}, bool) {
+	value, stale, ok := c.GetStale(key)
+	if !ok || stale > 0 {
+		return nil, false
+	}
+	return value, true
+}
+
+// GetStale returns the value cached under key, even if it has expired, as
+// long as it is within the cache's MaxStale. stale is how long ago the
+// value expired, or zero if it hasn't. Only unexpired values count as hits.
+func (c *Memory) GetStale(key string) (value interface{}, stale time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e, ok := c.entries[key]
+	if ok && e.expired(now.Add(-c.opts.MaxStale)) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, 0, false
+	}
+	if e.expired(now) {
+		c.stats.Misses++
+		stale = now.Sub(e.expires)
+	} else {
+		c.stats.Hits++
+	}
+	c.touch(e)
+	return e.value, stale, true
+}
+
+// Set caches value under key. Size is the number of bytes charged against
+// the budget for the value. It returns false if the value is too big to
+// cache.
+func (c *Memory) Set(key string, value interface{}, size int64, ttl time.Duration) bool {
+	if size > c.opts.MaxEntryBytes {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	if ttl == DefaultExpiration {
+		ttl = c.opts.DefaultExpiration
+	}
+	e := &entry{key: key, value: value, size: size}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	c.touch(e)
+	c.entries[key] = e
+	heap.Push(&c.queue, e)
+	c.stats.Bytes += size
+	c.stats.Entries++
+	for c.stats.Bytes > c.opts.MaxBytes {
+		c.remove(c.victim(e))
+		c.stats.Evictions++
+	}
+	return true
+}
+
+// Delete removes the value cached under key, and reports whether there was
+// one.
+func (c *Memory) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.remove(e)
+	}
+	return ok
+}
+
+// Entries describes the entries whose keys start with prefix, sorted by key.
+func (c *Memory) Entries(prefix string) []EntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []EntryInfo{}
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, EntryInfo{Key: key, Size: e.size, Expires: e.expires})
+		}
+	}
+	return sortEntries(entries)
+}
+
+// DeletePrefix removes the values cached under keys starting with prefix,
+// and returns how many there were.
+func (c *Memory) DeletePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes every value, and returns how many there were.
+func (c *Memory) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := len(c.entries)
+	c.entries = map[string]*entry{}
+	c.queue.entries = nil
+	c.stats.Bytes = 0
+	c.stats.Entries = 0
+	return removed
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Memory) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// victim returns the next entry to evict, sparing the newly set entry e,
+// which would otherwise always lose under LFU. Callers must hold c.mu.
+func (c *Memory) victim(e *entry) *entry {
+	victim := c.queue.entries[0]
+	if victim == e && c.queue.Len() > 1 {
+		// the next candidate is the lesser of the root's children
+		victim = c.queue.entries[1]
+		if c.queue.Len() > 2 && c.queue.Less(2, 1) {
+			victim = c.queue.entries[2]
+		}
+	}
+	return victim
+}
+
+// touch records a use of e. Callers must hold c.mu.
+func (c *Memory) touch(e *entry) {
+	c.clock++
+	e.uses++
+	e.lastUsed = c.clock
+	if _, queued := c.entries[e.key]; queued {
+		heap.Fix(&c.queue, e.index)
+	}
+}
+
+// remove drops e from the cache. Callers must hold c.mu.
+func (c *Memory) remove(e *entry) {
+	heap.Remove(&c.queue, e.index)
+	delete(c.entries, e.key)
+	c.stats.Bytes -= e.size
+	c.stats.Entries--
+}
+
+// expired reports whether e has expired at time now.
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// evictionQueue is a heap of entries, with the next to evict at the root.
+type evictionQueue struct {
+	policy  Policy
+	entries []*entry
+}
+
+func (q evictionQueue) Len() int { return len(q.entries) }
+
+func (q evictionQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if q.policy == LFU && a.uses != b.uses {
+		return a.uses < b.uses
+	}
+	return a.lastUsed < b.lastUsed
+}
+
+func (q evictionQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].index = i
+	q.entries[j].index = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	last := len(q.entries) - 1
+	e := q.entries[last]
+	q.entries[last] = nil
+	q.entries = q.entries[:last]
+	e.index = -1
+	return e
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// has returns which of keys c holds unexpired values for.
+func has(c *Memory, keys ...string) string {
+	held := ""
+	for _, key := range keys {
+		if _, ok := c.Get(key); ok {
+			held += key
+		}
+	}
+	return held
+}
+
+func TestMemoryBytes(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 100})
+	c.Set("a", "a", 30, NoExpiration)
+	c.Set("b", "b", 20, NoExpiration)
+	// overwriting charges the new size, not both
+	c.Set("a", "a2", 50, NoExpiration)
+	if stats := c.Stats(); stats.Bytes != 70 || stats.Entries != 2 {
+		t.Errorf("stats = %+v, want 70 bytes in 2 entries", stats)
+	}
+	if value, _ := c.Get("a"); value != "a2" {
+		t.Errorf("a = %v, want the new value", value)
+	}
+	c.Delete("b")
+	if stats := c.Stats(); stats.Bytes != 50 || stats.Entries != 1 {
+		t.Errorf("stats = %+v after Delete, want 50 bytes in 1 entry", stats)
+	}
+	c.Flush()
+	if stats := c.Stats(); stats.Bytes != 0 || stats.Entries != 0 {
+		t.Errorf("stats = %+v after Flush, want none", stats)
+	}
+}
+
+func TestMemoryOversize(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 100, MaxEntryBytes: 40})
+	c.Set("small", "s", 10, NoExpiration)
+	if c.Set("big", "b", 41, NoExpiration) {
+		t.Error("Set stored an entry over MaxEntryBytes")
+	}
+	if has(c, "small", "big") != "small" || c.Stats().Evictions != 0 {
+		t.Errorf("an oversize entry evicted others, or was stored")
+	}
+	// MaxEntryBytes is at most MaxBytes
+	c = NewMemory(Options{MaxBytes: 100, MaxEntryBytes: 1000})
+	if c.Set("big", "b", 101, NoExpiration) {
+		t.Error("Set stored an entry over MaxBytes")
+	}
+}
+
+func TestMemoryLRU(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 30, Policy: LRU})
+	c.Set("a", "a", 10, NoExpiration)
+	c.Set("b", "b", 10, NoExpiration)
+	c.Set("c", "c", 10, NoExpiration)
+	c.Get("a")
+	// b is the least recently used
+	c.Set("d", "d", 10, NoExpiration)
+	if got := has(c, "a", "b", "c", "d"); got != "acd" {
+		t.Errorf("held %s, want acd", got)
+	}
+	// a big entry evicts as many as it needs to, oldest first
+	c.Set("e", "e", 20, NoExpiration)
+	if got := has(c, "a", "c", "d", "e"); got != "de" {
+		t.Errorf("held %s, want de", got)
+	}
+	if evictions := c.Stats().Evictions; evictions != 3 {
+		t.Errorf("%d evictions, want 3", evictions)
+	}
+}
+
+func TestMemoryLFU(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 30, Policy: LFU})
+	c.Set("a", "a", 10, NoExpiration)
+	c.Set("b", "b", 10, NoExpiration)
+	c.Set("c", "c", 10, NoExpiration)
+	for i := 0; i < 3; i++ {
+		c.Get("a")
+		c.Get("c")
+	}
+	c.Get("b")
+	c.Get("a")
+	// b is used least, though not least recently; the new entry is spared
+	c.Set("d", "d", 10, NoExpiration)
+	if got := has(c, "a", "b", "c", "d"); got != "acd" {
+		t.Errorf("held %s, want acd", got)
+	}
+	// ties go by recency: d and the new e have been used once each
+	c.Set("e", "e", 10, NoExpiration)
+	if got := has(c, "a", "c", "d", "e"); got != "ace" {
+		t.Errorf("held %s, want ace", got)
+	}
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 100, DefaultExpiration: 100 * time.Millisecond, MaxStale: time.Hour})
+	c.Set("short", "s", 10, 20*time.Millisecond)
+	c.Set("default", "d", 10, DefaultExpiration)
+	c.Set("forever", "f", 10, NoExpiration)
+	if got := has(c, "short", "default", "forever"); got != "shortdefaultforever" {
+		t.Fatalf("held %s, want all", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := has(c, "short", "default", "forever"); got != "defaultforever" {
+		t.Errorf("held %s after 50ms, want default and forever", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := has(c, "short", "default", "forever"); got != "forever" {
+		t.Errorf("held %s after 110ms, want forever", got)
+	}
+	// expired entries within MaxStale can still be had stale
+	value, stale, ok := c.GetStale("short")
+	if !ok || value != "s" || stale <= 0 {
+		t.Errorf("GetStale = %v, %v, %v, want the stale value", value, stale, ok)
+	}
+	// but not beyond it
+	c = NewMemory(Options{MaxBytes: 100})
+	c.Set("short", "s", 10, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, _, ok := c.GetStale("short"); ok {
+		t.Error("GetStale returned a value expired beyond MaxStale")
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("stats = %+v, want the expired entry dropped", stats)
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 100})
+	c.Set("a", "a", 10, NoExpiration)
+	c.Get("a")
+	c.Get("a")
+	c.Get("missing")
+	if stats := c.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("stats = %+v, want 2 hits and 1 miss", stats)
+	}
+}
+
+func TestMemoryPrefix(t *testing.T) {
+	c := NewMemory(Options{MaxBytes: 100})
+	for _, key := range []string{"lpse1/a", "lpse1/b", "lpse2/a"} {
+		c.Set(key, key, 1, NoExpiration)
+	}
+	if entries := c.Entries("lpse1/"); len(entries) != 2 || entries[0].Key != "lpse1/a" || entries[1].Key != "lpse1/b" {
+		t.Errorf("Entries = %v, want lpse1's, sorted", entries)
+	}
+	if removed := c.DeletePrefix("lpse1/"); removed != 2 || has(c, "lpse1/a", "lpse2/a") != "lpse2/a" {
+		t.Errorf("DeletePrefix removed %d, want lpse1's 2", removed)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for s, want := range map[string]Policy{"": LRU, "lru": LRU, "LFU": LFU} {
+		if got, err := ParsePolicy(s); err != nil || got != want {
+			t.Errorf("ParsePolicy(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParsePolicy("fifo"); err == nil {
+		t.Error("ParsePolicy(fifo) succeeded")
+	}
+}
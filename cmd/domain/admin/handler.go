@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/apierror"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/respond"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+type Handler interface {
+	CacheStats(w http.ResponseWriter, req *http.Request)
+	CacheEntries(w http.ResponseWriter, req *http.Request)
+	PurgeEntries(w http.ResponseWriter, req *http.Request)
+	FlushCaches(w http.ResponseWriter, req *http.Request)
+	PipelineConfig(w http.ResponseWriter, req *http.Request)
+	Redactions(w http.ResponseWriter, req *http.Request)
+}
+
+type handler struct {
+	svc Service
+}
+
+func NewHandler(svc Service) Handler {
+	return &handler{
+		svc: svc,
+	}
+}
+
+// tenantPrefix returns the key prefix of a tenant's entries. Keys are
+// normalized paths, so every key for an x-lpse-id starts with it and a slash.
+func tenantPrefix(lpseId string) string {
+	return common.NormalizePath(lpseId, "/")
+}
+
+func (ths *handler) CacheStats(w http.ResponseWriter, req *http.Request) {
+	respond.Success(w, ths.svc.Stats(req.Context()), http.StatusOK)
+}
+
+// CacheEntries lists a cache's entries, optionally only those whose keys
+// start with the prefix query parameter, or belong to the lpse tenant.
+func (ths *handler) CacheEntries(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	if lpseId := req.URL.Query().Get("lpse"); lpseId != "" {
+		prefix = tenantPrefix(lpseId) + prefix
+	}
+	res, err := ths.svc.Entries(req.Context(), chi.URLParam(req, "cache"), prefix)
+	if err == ErrUnknownCache {
+		respond.Error(w, req.Context(), apierror.WithDesc(apierror.CodeEntityNotFound, "Unknown cache"), http.StatusNotFound)
+		return
+	}
+	respond.Success(w, res, http.StatusOK)
+}
+
+// PurgeEntries removes entries from every cache: the one named by the key
+// query parameter, those whose keys start with prefix, or those belonging
+// to the lpse tenant. Exactly one must be given.
+func (ths *handler) PurgeEntries(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	key, prefix, lpseId := query.Get("key"), query.Get("prefix"), query.Get("lpse")
+	given := 0
+	for _, param := range []string{key, prefix, lpseId} {
+		if param != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		respond.Error(w, req.Context(), apierror.WithDesc(apierror.CodeInvalidRequest, "Exactly one of key, prefix or lpse is required"), http.StatusBadRequest)
+		return
+	}
+	var res *PurgeRes
+	switch {
+	case key != "":
+		log.Info().Msgf("admin: purging key %q", key)
+		res = ths.svc.Purge(req.Context(), key)
+	case prefix != "":
+		log.Info().Msgf("admin: purging prefix %q", prefix)
+		res = ths.svc.PurgePrefix(req.Context(), prefix)
+	default:
+		log.Info().Msgf("admin: purging tenant %q", lpseId)
+		res = ths.svc.PurgePrefix(req.Context(), tenantPrefix(lpseId))
+	}
+	respond.Success(w, res, http.StatusOK)
+}
+
+func (ths *handler) FlushCaches(w http.ResponseWriter, req *http.Request) {
+	log.Info().Msgf("admin: flushing all caches")
+	respond.Success(w, ths.svc.Flush(req.Context()), http.StatusOK)
+}
+
+// PipelineConfig reports which version of the pipeline config is in use,
+// and why the last reload failed, if it did.
+func (ths *handler) PipelineConfig(w http.ResponseWriter, req *http.Request) {
+	respond.Success(w, ths.svc.PipelineConfig(req.Context()), http.StatusOK)
+}
+
+// Redactions reports how many matches of each pattern the redact filter has
+// masked since the proxy started.
+func (ths *handler) Redactions(w http.ResponseWriter, req *http.Request) {
+	respond.Success(w, ths.svc.Redactions(req.Context()), http.StatusOK)
+}
@@ -0,0 +1,13 @@
+package admin
+
+import "github.com/DomZippilli/gcs-proxy-cloud-function/cache"
+
+type EntriesRes struct {
+	Cache   string            `json:"cache"`
+	Entries []cache.EntryInfo `json:"entries"`
+}
+
+type PurgeRes struct {
+	// Removed counts the entries removed from each cache.
+	Removed map[string]int `json:"removed"`
+}
@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cache"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/config"
+)
+
+var ErrUnknownCache = errors.New("unknown cache")
+
+type Service interface {
+	Stats(ctx context.Context) map[string]cache.Stats
+	Entries(ctx context.Context, cacheName string, prefix string) (*EntriesRes, error)
+	Purge(ctx context.Context, key string) *PurgeRes
+	PurgePrefix(ctx context.Context, prefix string) *PurgeRes
+	Flush(ctx context.Context) *PurgeRes
+	PipelineConfig(ctx context.Context) config.PipelineConfigStatus
+	Redactions(ctx context.Context) map[string]uint64
+}
+type service struct {
+	caches         func() map[string]cache.Cache
+	pipelineConfig func() config.PipelineConfigStatus
+	redactions     func() map[string]uint64
+}
+
+// NewService returns a Service over the caches returned by caches, which is
+// called on every request so caches replaced at runtime are seen, and the
+// pipeline config pipelineConfig reports, and the redaction counters
+// redactions reports.
+func NewService(
+	caches func() map[string]cache.Cache,
+	pipelineConfig func() config.PipelineConfigStatus,
+	redactions func() map[string]uint64,
+) Service {
+	return &service{
+		caches:         caches,
+		pipelineConfig: pipelineConfig,
+		redactions:     redactions,
+	}
+}
+
+func (ths *service) Stats(ctx context.Context) map[string]cache.Stats {
+	stats := map[string]cache.Stats{}
+	for name, c := range ths.caches() {
+		stats[name] = c.Stats()
+	}
+	return stats
+}
+
+func (ths *service) Entries(ctx context.Context, cacheName string, prefix string) (*EntriesRes, error) {
+	c, ok := ths.caches()[cacheName]
+	if !ok {
+		return nil, ErrUnknownCache
+	}
+	return &EntriesRes{
+		Cache:   cacheName,
+		Entries: c.Entries(prefix),
+	}, nil
+}
+
+func (ths *service) Purge(ctx context.Context, key string) *PurgeRes {
+	removed := map[string]int{}
+	for name, c := range ths.caches() {
+		removed[name] = 0
+		if c.Delete(key) {
+			removed[name] = 1
+		}
+	}
+	return &PurgeRes{Removed: removed}
+}
+
+func (ths *service) PurgePrefix(ctx context.Context, prefix string) *PurgeRes {
+	removed := map[string]int{}
+	for name, c := range ths.caches() {
+		removed[name] = c.DeletePrefix(prefix)
+	}
+	return &PurgeRes{Removed: removed}
+}
+
+func (ths *service) Flush(ctx context.Context) *PurgeRes {
+	removed := map[string]int{}
+	for name, c := range ths.caches() {
+		removed[name] = c.Flush()
+	}
+	return &PurgeRes{Removed: removed}
+}
+
+func (ths *service) PipelineConfig(ctx context.Context) config.PipelineConfigStatus {
+	return ths.pipelineConfig()
+}
+
+func (ths *service) Redactions(ctx context.Context) map[string]uint64 {
+	return ths.redactions()
+}
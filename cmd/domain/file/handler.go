@@ -109,12 +109,15 @@ func (ths *handler) DownloadFile(w http.ResponseWriter, req *http.Request) {
 		respond.Error(w, req.Context(), apierror.WithDesc(apierror.CodeInternalServerError, "Internal Server Error"), http.StatusBadRequest)
 		return
 	}
+	// ?download and ?filename, or the tenant's default, are passed on to
+	// the storage service
+	downloadUrl := ths.svc.DownloadUrl(req.Context(), req, res)
 	if strings.Compare(res.SignedUrl, "") != 0 {
-		log.Info().Msgf("Download fileID %s will be redirected to signedUrl %s", id, res.SignedUrl)
-		http.Redirect(w, req, res.SignedUrl, http.StatusMovedPermanently)
+		log.Info().Msgf("Download fileID %s will be redirected to signedUrl %s", id, downloadUrl)
+		http.Redirect(w, req, downloadUrl, http.StatusMovedPermanently)
 	} else {
-		log.Info().Msgf("Download fileID %s will be redirected to publicUrl %s", id, res.PublicUrl)
-		http.Redirect(w, req, res.PublicUrl, http.StatusMovedPermanently)
+		log.Info().Msgf("Download fileID %s will be redirected to publicUrl %s", id, downloadUrl)
+		http.Redirect(w, req, downloadUrl, http.StatusMovedPermanently)
 	}
 	w.Header().Set("Cache-Control", "private, max-age="+fmt.Sprintf("%d", (6*24*60*60)))
 	respond.Success(w, res, http.StatusOK)
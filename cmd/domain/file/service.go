@@ -2,27 +2,49 @@ package file
 
 import (
 	"context"
+	"net/http"
+	"time"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
 	uploaderclient "github.com/DomZippilli/gcs-proxy-cloud-function/backends/clients/uploader-client"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/commonutils"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/rs/zerolog/log"
 	"github.com/ztrue/tracerr"
 )
 
 type Service interface {
 	UploadFile(ctx context.Context, input FileUploadReq) (*UploadSignedUrlRes, error)
 	DownloadFile(ctx context.Context, input string) (*uploaderclient.RequestDownloadUrlRes, error)
+	DownloadUrl(ctx context.Context, req *http.Request, file *uploaderclient.RequestDownloadUrlRes) string
 	VerifyAndDecodeToken(ctx context.Context, input VerifyAndDecodeTokenReq) (string, error)
 	UploadStatus(ctx context.Context, input UploadStatusReq) error
 }
 type service struct {
 	uploaderClient uploaderclient.Client
+	bucket         string
+	disposition    func(req *http.Request, objectName string) string
+	sign           func(ctx context.Context, objectName string, opts backends.SignOptions) (string, error)
 }
 
+// downloadTTL is how long download URLs are valid.
+const downloadTTL = 6 * 24 * time.Hour
+
+// NewService returns a Service that gets URLs from uploaderClient. Download
+// URLs for objects in bucket that a Content-Disposition applies to, as
+// disposition says, are signed again with sign, for the storage service to
+// send it.
 func NewService(
 	uploaderClient uploaderclient.Client,
+	bucket string,
+	disposition func(req *http.Request, objectName string) string,
+	sign func(ctx context.Context, objectName string, opts backends.SignOptions) (string, error),
 ) Service {
 	return &service{
 		uploaderClient: uploaderClient,
+		bucket:         bucket,
+		disposition:    disposition,
+		sign:           sign,
 	}
 }
 
@@ -95,11 +117,43 @@ func (ths *service) DownloadFile(ctx context.Context, input string) (*uploadercl
 	tmp = append(tmp, input)
 	file, _ := ths.uploaderClient.RequestDownloadUrl(commonutils.ReqIDFromContext(ctx), uploaderclient.RequestDownloadUrlReq{
 		Token:          tmp,
-		ExpiryInSecond: 6 * 24 * 60 * 60,
+		ExpiryInSecond: int(downloadTTL.Seconds()),
 	})
 	return &file[0], nil
 }
 
+// DownloadUrl returns the URL to download file from, with the
+// Content-Disposition req asks for, or its tenant's default. A signed URL
+// covers its parameters, so it's signed again with the disposition; if it
+// can't be, it's used as it is.
+func (ths *service) DownloadUrl(ctx context.Context, req *http.Request, file *uploaderclient.RequestDownloadUrlRes) string {
+	rawUrl := file.SignedUrl
+	if rawUrl == "" {
+		rawUrl = file.PublicUrl
+	}
+	objectName, ok := common.ObjectFromURL(rawUrl, ths.bucket)
+	if !ok {
+		return rawUrl
+	}
+	disposition := ths.disposition(req, objectName)
+	if disposition == "" {
+		return rawUrl
+	}
+	if file.SignedUrl == "" {
+		return common.WithResponseDisposition(rawUrl, disposition)
+	}
+	signedUrl, err := ths.sign(ctx, objectName, backends.SignOptions{
+		Method:                     http.MethodGet,
+		Expires:                    time.Now().Add(downloadTTL),
+		ResponseContentDisposition: disposition,
+	})
+	if err != nil {
+		log.Warn().Msgf("DownloadUrl: signing %q: %v", objectName, err)
+		return rawUrl
+	}
+	return signedUrl
+}
+
 func (ths *service) UploadStatus(ctx context.Context, input UploadStatusReq) error {
 	err := ths.uploaderClient.UploadStatus(commonutils.ReqIDFromContext(ctx), uploaderclient.UploadStatusReq{
 		Tokens: input.Tokens,
@@ -0,0 +1,86 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+	uploaderclient "github.com/DomZippilli/gcs-proxy-cloud-function/backends/clients/uploader-client"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+)
+
+// signer records what it signs, and returns a URL saying so, or err.
+type signer struct {
+	err  error
+	name string
+	opts backends.SignOptions
+}
+
+func (s *signer) sign(ctx context.Context, objectName string, opts backends.SignOptions) (string, error) {
+	s.name, s.opts = objectName, opts
+	return "https://storage.googleapis.com/bucket/" + objectName + "?X-Goog-Signature=new", s.err
+}
+
+// tenantDefault is a disposition func, with attachment as lpse1's default.
+func tenantDefault(req *http.Request, objectName string) string {
+	defaultType := ""
+	if req.Header.Get("x-lpse-id") == "lpse1" {
+		defaultType = "attachment"
+	}
+	return common.RequestedDisposition(req.URL.Query(), defaultType, objectName)
+}
+
+func TestDownloadUrl(t *testing.T) {
+	signedUrl := "https://storage.googleapis.com/bucket/lpse2/private/Laporan%20Akhir.pdf?X-Goog-Signature=old"
+	for _, test := range []struct {
+		name, target, tenant string
+		signErr              error
+		want, disposition    string
+	}{
+		{"no disposition", "/download/1", "lpse2", nil, signedUrl, ""},
+		{"download", "/download/1?download", "lpse2", nil, "new", `attachment; filename="Laporan Akhir.pdf"`},
+		{"filename", "/download/1?filename=a.pdf", "lpse2", nil, "new", `attachment; filename="a.pdf"`},
+		{"tenant default", "/download/1", "lpse1", nil, "new", `attachment; filename="Laporan Akhir.pdf"`},
+		{"can't sign", "/download/1?download", "lpse2", backends.ErrNotSupported, signedUrl, `attachment; filename="Laporan Akhir.pdf"`},
+		{"signing fails", "/download/1?download", "lpse2", errors.New("no key"), signedUrl, `attachment; filename="Laporan Akhir.pdf"`},
+	} {
+		s := &signer{err: test.signErr}
+		svc := NewService(nil, "bucket", tenantDefault, s.sign)
+		req := httptest.NewRequest(http.MethodGet, test.target, nil)
+		req.Header.Set("x-lpse-id", test.tenant)
+		got := svc.DownloadUrl(context.Background(), req, &uploaderclient.RequestDownloadUrlRes{SignedUrl: signedUrl})
+		if test.want == "new" && !strings.HasSuffix(got, "?X-Goog-Signature=new") || test.want != "new" && got != test.want {
+			t.Errorf("%s: DownloadUrl = %q", test.name, got)
+		}
+		if s.opts.ResponseContentDisposition != test.disposition {
+			t.Errorf("%s: signed with disposition %q, want %q", test.name, s.opts.ResponseContentDisposition, test.disposition)
+		}
+		if test.disposition != "" && (s.name != "lpse2/private/Laporan Akhir.pdf" || s.opts.Method != http.MethodGet) {
+			t.Errorf("%s: signed %s %q", test.name, s.opts.Method, s.name)
+		}
+	}
+}
+
+func TestDownloadUrlPublic(t *testing.T) {
+	s := &signer{}
+	svc := NewService(nil, "bucket", tenantDefault, s.sign)
+	req := httptest.NewRequest(http.MethodGet, "/download/1?download=1", nil)
+	got := svc.DownloadUrl(context.Background(), req, &uploaderclient.RequestDownloadUrlRes{
+		PublicUrl: "https://storage.googleapis.com/bucket/lpse2/public/a.txt",
+	})
+	if want := "https://storage.googleapis.com/bucket/lpse2/public/a.txt?response-content-disposition=attachment%3B+filename%3D%22a.txt%22"; got != want {
+		t.Errorf("DownloadUrl = %q, want %q", got, want)
+	}
+	if s.name != "" {
+		t.Errorf("public URL signed for %q", s.name)
+	}
+	// URLs of other buckets are left as they are
+	other := "https://storage.googleapis.com/elsewhere/a.txt?X-Goog-Signature=old"
+	if got := svc.DownloadUrl(context.Background(), req, &uploaderclient.RequestDownloadUrlRes{SignedUrl: other}); got != other || s.name != "" {
+		t.Errorf("DownloadUrl = %q, signed %q, want %q unsigned", got, s.name, other)
+	}
+}
@@ -0,0 +1,56 @@
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/apierror"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/logger"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/respond"
+)
+
+type Handler interface {
+	StoragePush(w http.ResponseWriter, req *http.Request)
+}
+
+type handler struct {
+	svc Service
+}
+
+func NewHandler(svc Service) Handler {
+	return &handler{
+		svc: svc,
+	}
+}
+
+// StoragePush receives Cloud Storage object change notifications pushed by a
+// Pub/Sub subscription, and evicts the changed object from the caches. Any
+// 2xx response acknowledges the message.
+func (ths *handler) StoragePush(w http.ResponseWriter, req *http.Request) {
+	var input PushReq
+	err := json.NewDecoder(req.Body).Decode(&input)
+	if err != nil {
+		logger.Warn(req.Context(), "%v", err)
+		respond.Error(w, req.Context(), apierror.WithDesc(apierror.CodeInvalidRequest, "Invalid request"), http.StatusBadRequest)
+		return
+	}
+	event := ObjectEvent{
+		EventType: input.Message.Attributes["eventType"],
+		Bucket:    input.Message.Attributes["bucketId"],
+		Object:    input.Message.Attributes["objectId"],
+	}
+	// the attributes may have been dropped along the way, but the object
+	// resource is always in the data
+	if event.Object == "" && len(input.Message.Data) > 0 {
+		var object ObjectResource
+		if err := json.Unmarshal(input.Message.Data, &object); err == nil {
+			event.Bucket, event.Object = object.Bucket, object.Name
+		}
+	}
+	if event.EventType == "" || event.Object == "" {
+		logger.Warn(req.Context(), "notification without event type or object: %q", input.Message.MessageID)
+		respond.Error(w, req.Context(), apierror.WithDesc(apierror.CodeInvalidRequest, "Not an object change notification"), http.StatusBadRequest)
+		return
+	}
+	respond.Success(w, ths.svc.Evict(req.Context(), event), http.StatusOK)
+}
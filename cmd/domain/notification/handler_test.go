@@ -0,0 +1,136 @@
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cache"
+)
+
+// response is the JSON body of every response, as respond writes it.
+type response struct {
+	Data   *EvictRes `json:"data"`
+	Errors []struct {
+		ReqID   string `json:"reqId"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// newCaches returns a metadata and a media cache holding entries for
+// lpse1/public/a.txt and lpse1/public/b.txt.
+func newCaches() map[string]cache.Cache {
+	metadata := cache.NewMemory(cache.Options{MaxBytes: 1 << 20})
+	media := cache.NewMemory(cache.Options{MaxBytes: 1 << 20})
+	for _, name := range []string{"lpse1/public/a.txt", "lpse1/public/b.txt"} {
+		metadata.Set(name, name, 1, time.Hour)
+		media.Set(name, name, 1, time.Hour)
+		media.Set(name+"?w=100", name, 1, time.Hour)
+	}
+	return map[string]cache.Cache{"metadata": metadata, "media": media}
+}
+
+// push POSTs body to a handler over caches, for bucket, and decodes the
+// response.
+func push(t *testing.T, caches map[string]cache.Cache, bucket, body string) (*httptest.ResponseRecorder, response) {
+	t.Helper()
+	handler := NewHandler(NewService(func() map[string]cache.Cache { return caches }, bucket))
+	recorder := httptest.NewRecorder()
+	handler.StoragePush(recorder, httptest.NewRequest(http.MethodPost, "/notifications/storage", strings.NewReader(body)))
+	if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var decoded response
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("body %q is not JSON: %v", recorder.Body, err)
+	}
+	return recorder, decoded
+}
+
+func TestStoragePushEvicts(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"attributes", `{"message": {"attributes": {"eventType": "OBJECT_FINALIZE",
+			"bucketId": "bucket", "objectId": "lpse1/public/a.txt"}, "messageId": "1"}}`},
+		// {"bucket": "bucket", "name": "lpse1/public/a.txt"}, in base64
+		{"data only", `{"message": {"attributes": {"eventType": "OBJECT_DELETE"},
+			"data": "eyJidWNrZXQiOiAiYnVja2V0IiwgIm5hbWUiOiAibHBzZTEvcHVibGljL2EudHh0In0=", "messageId": "2"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caches := newCaches()
+			recorder, decoded := push(t, caches, "bucket", tt.body)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", recorder.Code)
+			}
+			if len(decoded.Errors) != 0 || decoded.Data == nil {
+				t.Fatalf("body = %s, want data without errors", recorder.Body)
+			}
+			if decoded.Data.Object != "lpse1/public/a.txt" || decoded.Data.Bucket != "bucket" || decoded.Data.Ignored {
+				t.Errorf("data = %+v", decoded.Data)
+			}
+			if decoded.Data.Removed["metadata"] != 1 || decoded.Data.Removed["media"] != 2 {
+				t.Errorf("removed = %v, want 1 metadata and 2 media entries", decoded.Data.Removed)
+			}
+			// other objects are left alone
+			if len(caches["media"].Entries("lpse1/public/b.txt")) != 2 || len(caches["media"].Entries("lpse1/public/a.txt")) != 0 {
+				t.Errorf("media entries = %v", caches["media"].Entries(""))
+			}
+		})
+	}
+}
+
+func TestStoragePushIgnores(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"other bucket", `{"message": {"attributes": {"eventType": "OBJECT_FINALIZE",
+			"bucketId": "other", "objectId": "lpse1/public/a.txt"}}}`},
+		{"other event", `{"message": {"attributes": {"eventType": "OBJECT_ACL_UPDATE",
+			"bucketId": "bucket", "objectId": "lpse1/public/a.txt"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caches := newCaches()
+			recorder, decoded := push(t, caches, "bucket", tt.body)
+			if recorder.Code != http.StatusOK || decoded.Data == nil || !decoded.Data.Ignored {
+				t.Errorf("status = %d, body = %s, want 200 and ignored", recorder.Code, recorder.Body)
+			}
+			if got := len(caches["media"].Entries("")); got != 4 {
+				t.Errorf("%d media entries left, want 4", got)
+			}
+		})
+	}
+}
+
+func TestStoragePushErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"not JSON", `{"message": `, "Invalid request"},
+		{"data not base64", `{"message": {"data": "%%%"}}`, "Invalid request"},
+		{"no event type", `{"message": {"attributes": {"objectId": "lpse1/public/a.txt"}}}`, "Not an object change notification"},
+		{"no object", `{"message": {"attributes": {"eventType": "OBJECT_FINALIZE"}}}`, "Not an object change notification"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder, decoded := push(t, newCaches(), "", tt.body)
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", recorder.Code)
+			}
+			if decoded.Data != nil || len(decoded.Errors) != 1 ||
+				decoded.Errors[0].Code != "InvalidRequest" || decoded.Errors[0].Message != tt.message {
+				t.Errorf("body = %s, want one InvalidRequest error %q", recorder.Body, tt.message)
+			}
+		})
+	}
+}
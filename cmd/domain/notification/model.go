@@ -0,0 +1,44 @@
+package notification
+
+// Event types of Cloud Storage object change notifications.
+const (
+	OBJECT_FINALIZE        = "OBJECT_FINALIZE"
+	OBJECT_DELETE          = "OBJECT_DELETE"
+	OBJECT_METADATA_UPDATE = "OBJECT_METADATA_UPDATE"
+	OBJECT_ARCHIVE         = "OBJECT_ARCHIVE"
+)
+
+// PushReq is the body of a Pub/Sub push delivery.
+type PushReq struct {
+	Message      PushMessage `json:"message"`
+	Subscription string      `json:"subscription"`
+}
+
+type PushMessage struct {
+	Attributes map[string]string `json:"attributes"`
+	// Data is the object resource, as JSON. It is base64 on the wire.
+	Data        []byte `json:"data"`
+	MessageID   string `json:"messageId"`
+	PublishTime string `json:"publishTime"`
+}
+
+// ObjectResource is the part of the object resource in a notification's
+// data that identifies the object.
+type ObjectResource struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+type ObjectEvent struct {
+	EventType string `json:"eventType"`
+	Bucket    string `json:"bucket"`
+	Object    string `json:"object"`
+}
+
+type EvictRes struct {
+	ObjectEvent
+	// Ignored is set for events about other buckets, or that don't change
+	// what is served.
+	Ignored bool           `json:"ignored,omitempty"`
+	Removed map[string]int `json:"removed,omitempty"`
+}
@@ -0,0 +1,55 @@
+package notification
+
+import (
+	"context"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cache"
+	"github.com/rs/zerolog/log"
+)
+
+type Service interface {
+	Evict(ctx context.Context, event ObjectEvent) *EvictRes
+}
+type service struct {
+	caches func() map[string]cache.Cache
+	bucket string
+}
+
+// NewService returns a Service that evicts changed objects from the caches
+// returned by caches. Events for buckets other than bucket are ignored,
+// unless bucket is empty.
+func NewService(
+	caches func() map[string]cache.Cache,
+	bucket string,
+) Service {
+	return &service{
+		caches: caches,
+		bucket: bucket,
+	}
+}
+
+func (ths *service) Evict(ctx context.Context, event ObjectEvent) *EvictRes {
+	res := &EvictRes{ObjectEvent: event}
+	switch event.EventType {
+	case OBJECT_FINALIZE, OBJECT_DELETE, OBJECT_METADATA_UPDATE, OBJECT_ARCHIVE:
+	default:
+		res.Ignored = true
+		return res
+	}
+	if ths.bucket != "" && event.Bucket != ths.bucket {
+		res.Ignored = true
+		return res
+	}
+	// metadata is cached under the object name, and media under the object
+	// name and any query string
+	res.Removed = map[string]int{}
+	for name, c := range ths.caches() {
+		removed := c.DeletePrefix(event.Object + "?")
+		if c.Delete(event.Object) {
+			removed++
+		}
+		res.Removed[name] = removed
+	}
+	log.Info().Msgf("notification: %s %q evicted %v", event.EventType, event.Object, res.Removed)
+	return res
+}
@@ -19,11 +19,14 @@ import (
 	"os"
 
 	uploaderclient "github.com/DomZippilli/gcs-proxy-cloud-function/backends/clients/uploader-client"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/admin"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/file"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/notification"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/server"
 	"github.com/go-chi/chi/v5"
 
 	"github.com/DomZippilli/gcs-proxy-cloud-function/config"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
@@ -45,16 +48,39 @@ func main() {
 	if err := config.Setup(); err != nil {
 		log.Fatal().Msgf("main setup: %v", err)
 	}
-	uploaderClient, err := uploaderclient.NewClient("https://upload.eproc.dev", nil)
-	fileSvc := file.NewService(uploaderClient)
+	var uploaderClient uploaderclient.Client
+	client, err := uploaderclient.NewClient("https://upload.eproc.dev", nil)
+	if err == nil {
+		uploaderClient = client
+	} else if config.Offline() {
+		// serving still works offline; only the upload routes need this
+		log.Warn().Msgf("main: uploader client unavailable: %v", err)
+	} else {
+		log.Fatal().Msgf("main: %v", err)
+	}
+	fileSvc := file.NewService(uploaderClient, os.Getenv("BUCKET_NAME"), config.DownloadDisposition, config.SignURL)
 	fileHandler := file.NewHandler(fileSvc)
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Warn().Msgf("main: ADMIN_TOKEN unset, admin API disabled")
+	}
+	adminHandler := admin.NewHandler(admin.NewService(config.Caches, config.LoadedPipelineConfig, filter.Redactions))
+	notificationToken := os.Getenv("NOTIFICATION_TOKEN")
+	if notificationToken == "" {
+		log.Warn().Msgf("main: NOTIFICATION_TOKEN unset, storage notifications disabled")
+	}
+	notificationHandler := notification.NewHandler(notification.NewService(config.Caches, os.Getenv("BUCKET_NAME")))
 	router := chi.NewRouter()
 	http2server := &http2.Server{}
 	h2cHandler := h2c.NewHandler(handler, http2server)
-	server.SetupRouter(router, server.Handler{FileHandler: fileHandler, H2cHandler: h2cHandler})
-	if err != nil {
-		log.Fatal().Msgf("main: %v", err)
-	}
+	server.SetupRouter(router, server.Handler{
+		FileHandler:         fileHandler,
+		AdminHandler:        adminHandler,
+		AdminToken:          adminToken,
+		NotificationHandler: notificationHandler,
+		NotificationToken:   notificationToken,
+		H2cHandler:          h2cHandler,
+	})
 	// Start HTTP server.
 	log.Printf("listening on port %s", port)
 
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/admin"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/justinas/alice"
+)
+
+// adminRouter serves the admin API. Every route requires the admin token as
+// a bearer token.
+func adminRouter(handler admin.Handler, token string) *chi.Mux {
+	r := chi.NewRouter()
+	middlewares := alice.New(middleware.Recoverer, requireToken(token))
+	r.Method(http.MethodGet, "/caches", middlewares.ThenFunc(handler.CacheStats))
+	r.Method(http.MethodDelete, "/caches", middlewares.ThenFunc(handler.FlushCaches))
+	r.Method(http.MethodDelete, "/caches/entries", middlewares.ThenFunc(handler.PurgeEntries))
+	r.Method(http.MethodGet, "/caches/{cache}/entries", middlewares.ThenFunc(handler.CacheEntries))
+	r.Method(http.MethodGet, "/config", middlewares.ThenFunc(handler.PipelineConfig))
+	r.Method(http.MethodGet, "/redactions", middlewares.ThenFunc(handler.Redactions))
+	return r
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/apierror"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/shared-libs/go/respond"
+	"github.com/justinas/alice"
+)
+
+// requireToken rejects requests without "Authorization: Bearer <token>".
+func requireToken(token string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !tokenMatches(given, token) {
+				unauthorized(w, req)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// requireQueryToken rejects requests without a token query parameter, for
+// callers like Pub/Sub push subscriptions that can't set headers.
+func requireQueryToken(token string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !tokenMatches(req.URL.Query().Get("token"), token) {
+				unauthorized(w, req)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// tokenMatches compares tokens in constant time.
+func tokenMatches(given, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func unauthorized(w http.ResponseWriter, req *http.Request) {
+	respond.Error(w, req.Context(), apierror.WithDesc(apierror.CodeUnauthorized, "Unauthorized"), http.StatusUnauthorized)
+}
@@ -3,15 +3,24 @@ package server
 import (
 	"net/http"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/admin"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/file"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cmd/domain/notification"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/justinas/alice"
 )
 
 type Handler struct {
-	FileHandler file.Handler
-	H2cHandler  http.Handler
+	FileHandler  file.Handler
+	AdminHandler admin.Handler
+	// AdminToken protects the admin API, which is only mounted if it is set.
+	AdminToken          string
+	NotificationHandler notification.Handler
+	// NotificationToken protects the storage notification endpoint, which is
+	// only mounted if it is set.
+	NotificationToken string
+	H2cHandler        http.Handler
 }
 
 func SetupRouter(r *chi.Mux, handler Handler) {
@@ -31,6 +40,13 @@ func SetupRouter(r *chi.Mux, handler Handler) {
 	r.Method(http.MethodPost, "/upload", middlewares.ThenFunc(handler.FileHandler.UploadFile))
 	r.Method(http.MethodPost, "/decodeToken", middlewares.ThenFunc(handler.FileHandler.VerifyAndDecodeToken))
 	r.Method(http.MethodPost, "/upload/check", middlewares.ThenFunc(handler.FileHandler.UploadStatus))
+	if handler.NotificationHandler != nil && handler.NotificationToken != "" {
+		r.Method(http.MethodPost, "/notifications/storage",
+			middlewares.Append(requireQueryToken(handler.NotificationToken)).ThenFunc(handler.NotificationHandler.StoragePush))
+	}
+	if handler.AdminHandler != nil && handler.AdminToken != "" {
+		r.Mount("/admin", adminRouter(handler.AdminHandler, handler.AdminToken))
+	}
 	r.Method(http.MethodOptions, "/*", middlewares.ThenFunc(handler.FileHandler.HandlingOption))
 	r.Method(http.MethodGet, "/*", handler.H2cHandler)
 }
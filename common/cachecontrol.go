@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl holds the directives of a Cache-Control header that matter to
+// the proxy's caches (RFC 9111, RFC 5861 and RFC 8246).
+type CacheControl struct {
+	// MaxAge is meaningful only if HasMaxAge is set; likewise SMaxAge.
+	MaxAge     time.Duration
+	HasMaxAge  bool
+	SMaxAge    time.Duration
+	HasSMaxAge bool
+
+	NoStore   bool
+	NoCache   bool
+	Private   bool
+	Public    bool
+	Immutable bool
+
+	// StaleWhileRevalidate and StaleIfError are zero when absent.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// ParseCacheControl parses a Cache-Control header value. Directive names are
+// case-insensitive and unknown directives are ignored. When a directive is
+// repeated, the first occurrence wins. A malformed age is treated as zero,
+// which makes the response stale, as RFC 9111 recommends.
+func ParseCacheControl(value string) CacheControl {
+	var cc CacheControl
+	seen := map[string]bool{}
+	for _, directive := range splitDirectives(value) {
+		name, arg, _ := strings.Cut(directive, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		arg = strings.Trim(strings.TrimSpace(arg), `"`)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		switch name {
+		case "max-age":
+			cc.MaxAge, cc.HasMaxAge = parseDeltaSeconds(arg), true
+		case "s-maxage":
+			cc.SMaxAge, cc.HasSMaxAge = parseDeltaSeconds(arg), true
+		case "no-store":
+			cc.NoStore = true
+		case "no-cache":
+			cc.NoCache = true
+		case "private":
+			cc.Private = true
+		case "public":
+			cc.Public = true
+		case "immutable":
+			cc.Immutable = true
+		case "stale-while-revalidate":
+			cc.StaleWhileRevalidate = parseDeltaSeconds(arg)
+		case "stale-if-error":
+			cc.StaleIfError = parseDeltaSeconds(arg)
+		}
+	}
+	return cc
+}
+
+// Storable reports whether a shared cache may keep the response. The
+// proxy's caches can't revalidate entries, so no-cache, which allows
+// storing only with revalidation on every use, counts as not storable.
+func (cc CacheControl) Storable() bool {
+	return !cc.NoStore && !cc.NoCache && !cc.Private
+}
+
+// Lifetime returns how long the response stays fresh in a shared cache:
+// s-maxage if given, otherwise max-age. It returns false if neither is.
+func (cc CacheControl) Lifetime() (time.Duration, bool) {
+	if cc.HasSMaxAge {
+		return cc.SMaxAge, true
+	}
+	if cc.HasMaxAge {
+		return cc.MaxAge, true
+	}
+	return 0, false
+}
+
+// CacheFor returns how long a shared cache should keep the response, and
+// false if it must not keep it at all. A zero duration means the response
+// gives no lifetime, so the cache's default applies.
+func (cc CacheControl) CacheFor() (time.Duration, bool) {
+	if !cc.Storable() {
+		return 0, false
+	}
+	lifetime, ok := cc.Lifetime()
+	if !ok {
+		return 0, true
+	}
+	// a zero lifetime is stale as soon as it is stored
+	return lifetime, lifetime > 0
+}
+
+// splitDirectives splits a Cache-Control value on commas outside of quoted
+// strings.
+func splitDirectives(value string) []string {
+	var directives []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				directives = append(directives, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(directives, value[start:])
+}
+
+// parseDeltaSeconds parses a delta-seconds value, returning zero if it is
+// malformed. Values too big to represent are capped, per RFC 9111.
+func parseDeltaSeconds(arg string) time.Duration {
+	secs, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			secs = 1 << 31
+		} else {
+			return 0
+		}
+	}
+	if secs > 1<<31 {
+		secs = 1 << 31
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		value string
+		want  CacheControl
+	}{
+		{"", CacheControl{}},
+		{"max-age=60", CacheControl{MaxAge: time.Minute, HasMaxAge: true}},
+		{"public, max-age=60, s-maxage=600", CacheControl{
+			MaxAge: time.Minute, HasMaxAge: true, SMaxAge: 10 * time.Minute, HasSMaxAge: true, Public: true}},
+		// names are case-insensitive, and space is allowed around them
+		{" Max-Age = 60 ,NO-STORE", CacheControl{MaxAge: time.Minute, HasMaxAge: true, NoStore: true}},
+		// quoted values are unquoted, and commas in them don't split
+		{`max-age="60"`, CacheControl{MaxAge: time.Minute, HasMaxAge: true}},
+		{`private="Set-Cookie, X-Session", max-age=60`, CacheControl{MaxAge: time.Minute, HasMaxAge: true, Private: true}},
+		{`no-cache="a\", b", immutable`, CacheControl{NoCache: true, Immutable: true}},
+		// the first of repeated directives wins
+		{"max-age=60, max-age=0", CacheControl{MaxAge: time.Minute, HasMaxAge: true}},
+		{"max-age=0, max-age=60", CacheControl{HasMaxAge: true}},
+		{"stale-if-error=10, stale-if-error=99", CacheControl{StaleIfError: 10 * time.Second}},
+		// malformed ages are stale, huge ones are capped
+		{"max-age=abc", CacheControl{HasMaxAge: true}},
+		{"max-age=-1", CacheControl{HasMaxAge: true}},
+		{"max-age=99999999999999999999", CacheControl{MaxAge: (1 << 31) * time.Second, HasMaxAge: true}},
+		{"max-age=4294967296", CacheControl{MaxAge: (1 << 31) * time.Second, HasMaxAge: true}},
+		{"max-age=60, stale-while-revalidate=30, stale-if-error=86400", CacheControl{
+			MaxAge: time.Minute, HasMaxAge: true, StaleWhileRevalidate: 30 * time.Second, StaleIfError: 24 * time.Hour}},
+		// unknown directives and empty ones are ignored
+		{"no-transform,, must-revalidate, x-foo=bar", CacheControl{}},
+	}
+	for _, tt := range tests {
+		if got := ParseCacheControl(tt.value); got != tt.want {
+			t.Errorf("ParseCacheControl(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCacheFor(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, true},
+		{"public", 0, true},
+		{"max-age=60", time.Minute, true},
+		// shared caches go by s-maxage first
+		{"max-age=60, s-maxage=600", 10 * time.Minute, true},
+		{"max-age=600, s-maxage=0", 0, false},
+		{"max-age=0", 0, false},
+		{"max-age=abc", 0, false},
+		{"no-store, max-age=60", 0, false},
+		{"no-cache, max-age=60", 0, false},
+		{"private, max-age=60", 0, false},
+		{`private="Set-Cookie", max-age=60`, 0, false},
+		{"max-age=60, immutable, stale-while-revalidate=30", time.Minute, true},
+	}
+	for _, tt := range tests {
+		got, ok := ParseCacheControl(tt.value).CacheFor()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("CacheFor(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ContentDisposition returns a Content-Disposition header value (RFC 6266)
+// of dispositionType, "inline" or "attachment", for filename. The name is
+// given as a quoted filename parameter, in ASCII, for clients that only
+// support that, and as a filename* parameter in UTF-8 (RFC 5987) if it
+// isn't plain ASCII. An empty filename is left out.
+func ContentDisposition(dispositionType, filename string) string {
+	if filename == "" {
+		return dispositionType
+	}
+	var fallback strings.Builder
+	plain := true
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < ' ' || r == 0x7F || r > 0x7E:
+			fallback.WriteByte('_')
+			plain = false
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	value := fmt.Sprintf(`%s; filename="%s"`, dispositionType, fallback.String())
+	if !plain {
+		value += "; filename*=UTF-8''" + encodeExtValue(filename)
+	}
+	return value
+}
+
+// encodeExtValue percent-encodes s for an RFC 5987 ext-value, leaving only
+// attr-chars as they are.
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// RequestedDisposition returns the Content-Disposition for objectName that
+// query asks for: download (or download=1) for an attachment, download=0 to
+// show it inline, and filename to name it, which implies download unless
+// download says otherwise. Without either parameter, it's defaultType, if that's set,
+// with the object's own name. It returns "" if no disposition is asked for.
+func RequestedDisposition(query url.Values, defaultType string, objectName string) string {
+	dispositionType := defaultType
+	if query.Has("filename") {
+		dispositionType = "attachment"
+	}
+	if query.Has("download") {
+		dispositionType = "inline"
+		download, err := strconv.ParseBool(query.Get("download"))
+		if query.Get("download") == "" || err == nil && download {
+			dispositionType = "attachment"
+		}
+	}
+	if dispositionType == "" {
+		return ""
+	}
+	filename := path.Base(objectName)
+	if query.Get("filename") != "" {
+		// only a name; it's never a path
+		filename = path.Base(strings.ReplaceAll(query.Get("filename"), "\\", "/"))
+	}
+	if filename == "." || filename == "/" {
+		filename = ""
+	}
+	return ContentDisposition(dispositionType, filename)
+}
+
+// WithResponseDisposition adds a response-content-disposition parameter to
+// a Cloud Storage URL, for the storage service to send disposition with
+// the object. URLs signed with V4 signatures cover their parameters, so
+// they can't be changed, and are returned as they are, as is every URL if
+// disposition is "".
+func WithResponseDisposition(rawURL string, disposition string) string {
+	if disposition == "" {
+		return rawURL
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := parsed.Query()
+	if query.Has("X-Goog-Signature") {
+		return rawURL
+	}
+	query.Set("response-content-disposition", disposition)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// ObjectFromURL returns the name of the object rawURL points to, if it's a
+// Cloud Storage URL for an object in bucket: a path-style URL on
+// storage.googleapis.com, or a virtual-hosted one on
+// <bucket>.storage.googleapis.com, signed or not.
+func ObjectFromURL(rawURL string, bucket string) (string, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || bucket == "" {
+		return "", false
+	}
+	var name string
+	switch host := strings.ToLower(parsed.Hostname()); host {
+	case "storage.googleapis.com", "storage.cloud.google.com":
+		inBucket, object, ok := strings.Cut(strings.TrimPrefix(parsed.Path, "/"), "/")
+		if !ok || inBucket != bucket {
+			return "", false
+		}
+		name = object
+	case strings.ToLower(bucket) + ".storage.googleapis.com":
+		name = strings.TrimPrefix(parsed.Path, "/")
+	default:
+		return "", false
+	}
+	return name, name != ""
+}
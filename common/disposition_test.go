@@ -0,0 +1,36 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import "testing"
+
+func TestObjectFromURL(t *testing.T) {
+	for _, test := range []struct {
+		url, bucket, want string
+		ok                bool
+	}{
+		{"https://storage.googleapis.com/b/lpse1/private/a%20b.pdf?X-Goog-Signature=x", "b", "lpse1/private/a b.pdf", true},
+		{"https://b.storage.googleapis.com/lpse1/a.pdf", "b", "lpse1/a.pdf", true},
+		{"https://storage.cloud.google.com/b/a.pdf", "b", "a.pdf", true},
+		{"https://storage.googleapis.com/other/a.pdf", "b", "", false},
+		{"https://storage.googleapis.com/b/", "b", "", false},
+		{"https://example.com/b/a.pdf", "b", "", false},
+		{"https://storage.googleapis.com/b/a.pdf", "", "", false},
+		{"://", "b", "", false},
+	} {
+		if got, ok := ObjectFromURL(test.url, test.bucket); got != test.want || ok != test.ok {
+			t.Errorf("ObjectFromURL(%q, %q) = %q, %v, want %q, %v", test.url, test.bucket, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AcceptEncoding holds the q-values of an Accept-Encoding header, by
+// content coding.
+type AcceptEncoding map[string]float64
+
+// ParseAcceptEncoding parses an Accept-Encoding header value. Codings are
+// case-insensitive, and x-gzip is taken for gzip. A malformed q-value is
+// treated as zero, making the coding unacceptable.
+func ParseAcceptEncoding(value string) AcceptEncoding {
+	accepted := AcceptEncoding{}
+	for _, element := range strings.Split(value, ",") {
+		coding, params, _ := strings.Cut(element, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, arg, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// Q returns the q-value of coding: its own, or else that of "*", or else 0.
+func (a AcceptEncoding) Q(coding string) float64 {
+	if q, ok := a[coding]; ok {
+		return q
+	}
+	return a["*"]
+}
+
+// Allows reports whether coding is acceptable.
+func (a AcceptEncoding) Allows(coding string) bool {
+	return a.Q(coding) > 0
+}
+
+// Ranked returns the acceptable codings among offered, from the highest
+// q-value to the lowest; codings with equal q-values keep their order.
+func (a AcceptEncoding) Ranked(offered []string) []string {
+	ranked := []string{}
+	for _, coding := range offered {
+		if a.Allows(coding) {
+			ranked = append(ranked, coding)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return a.Q(ranked[i]) > a.Q(ranked[j])
+	})
+	return ranked
+}
+
+// Choose returns the coding Ranked puts first, or "" if none of offered are
+// acceptable.
+func (a AcceptEncoding) Choose(offered []string) string {
+	if ranked := a.Ranked(offered); len(ranked) > 0 {
+		return ranked[0]
+	}
+	return ""
+}
+
+// CompressibleType reports whether media of a Content-Type is worth
+// compressing; it isn't if the format is already compressed, like most
+// images, video, audio and archives.
+func CompressibleType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "font/woff"):
+		return false
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip",
+		"application/zstd", "application/x-bzip2", "application/x-xz",
+		"application/x-7z-compressed", "application/vnd.rar",
+		"application/x-rar-compressed":
+		return false
+	}
+	return true
+}
+
+// AddVary adds name to the Vary header, unless it's already there.
+func AddVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"net/http"
+	"strings"
+)
+
+// representationHeaders describe an object. They don't belong on an error
+// sent instead of it.
+var representationHeaders = []string{"Content-Length", "Content-Range", "Content-Encoding",
+	"Content-Language", "Content-Disposition", "ETag", "Last-Modified", "Accept-Ranges", "Cache-Control"}
+
+// Error replies to the request with an error, like http.Error, for responses
+// whose headers may already describe the object: those headers are dropped
+// first, so the error isn't taken for the object, or cached as it would be.
+// A 416 Range Not Satisfiable keeps the length of the object from
+// Content-Range, as "bytes */length".
+func Error(response http.ResponseWriter, message string, status int) {
+	header := response.Header()
+	_, length, hasLength := strings.Cut(header.Get("Content-Range"), "/")
+	for _, name := range representationHeaders {
+		header.Del(name)
+	}
+	if status == http.StatusRequestedRangeNotSatisfiable && hasLength {
+		header.Set("Content-Range", "bytes */"+length)
+	}
+	http.Error(response, message, status)
+}
@@ -17,16 +17,71 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"os"
 	"strings"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/gcs"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/local"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
 	"github.com/agrison/go-commons-lang/stringUtils"
 	"github.com/rs/zerolog/log"
 )
 
+// store is the backend objects are served from.
+var store backends.Backend
+
+// translator translates media for the translate filter.
+var translator filter.Translator = filter.NewCloudTranslator()
+
 // Setup will be called once at the start of the program.
+//
+// The BACKEND environment variable picks the store: "gcs" (the default) or
+// "local", which serves a directory tree for offline development, with a
+// fake translator. The PIPELINE_CONFIG environment variable names a file of
+// routes that pick the filters applied to media (see PipelineConfig).
 func Setup() error {
-	return gcs.Setup()
+	if err := setupMediaCache(); err != nil {
+		return err
+	}
+	if err := setupDiskCache(); err != nil {
+		return err
+	}
+	if err := setupImages(); err != nil {
+		return err
+	}
+	if Offline() {
+		translator = filter.FakeTranslator{}
+	}
+	if err := setupRoutes(); err != nil {
+		return err
+	}
+	var err error
+	if Offline() {
+		store, err = local.Setup()
+	} else {
+		store, err = gcs.Setup()
+	}
+	return err
+}
+
+// Offline reports whether the proxy is configured to run without Google
+// services, using the local backend.
+func Offline() bool {
+	return os.Getenv("BACKEND") == "local"
+}
+
+// DownloadDisposition returns the Content-Disposition for objectName that
+// request asks for with its download and filename parameters, or else its
+// tenant's default, or "" if neither says. See common.RequestedDisposition.
+func DownloadDisposition(request *http.Request, objectName string) string {
+	return activeRoutes.Load().disposition(request, objectName)
+}
+
+// SignURL returns a URL signed for the named object by the backend objects
+// are served from, or backends.ErrNotSupported if it can't sign URLs.
+func SignURL(ctx context.Context, objectName string, opts backends.SignOptions) (string, error) {
+	return store.Sign(ctx, objectName, opts)
 }
 
 // GET will be called in main.go for GET requests
@@ -43,17 +98,31 @@ func GET(ctx context.Context, output http.ResponseWriter, input *http.Request) {
 	}
 	log.Info().Msgf("request header: %q", string(requestHeadersJson))
 
+	// the whole request is served by one version of the pipeline config,
+	// even if it's reloaded meanwhile
+	table := activeRoutes.Load()
+	table.usePresetSegment(input)
+	table.dropRanges(input)
+	table.setContentDisposition(output, input)
+
 	if strings.Contains(input.URL.Path, "/public/") {
-		gcs.Read(ctx, output, input, LoggingOnly)
+		table.readPublic(ctx, output, input)
 	} else {
-		gcs.ReadWithSignatureURL(ctx, output, input, LoggingOnly)
+		table.readPrivate(ctx, output, input)
 	}
-	//gcs.ReadWithCache(ctx, output, input, CacheMedia, cacheGetter, LoggingOnly)
 }
 
 // HEAD will be called in main.go for HEAD requests
 func HEAD(ctx context.Context, output http.ResponseWriter, input *http.Request) {
-	gcs.ReadMetadata(ctx, output, input, LoggingOnly)
+	table := activeRoutes.Load()
+	table.usePresetSegment(input)
+	table.dropRanges(input)
+	table.setContentDisposition(output, input)
+	ctx = table.withMediaHead(ctx, input)
+	if !strings.Contains(input.URL.Path, "/public/") {
+		output = backends.PrivateResponse(output)
+	}
+	backends.ReadMetadata(ctx, store, output, input, table.mediaPipeline())
 }
 
 // func POST
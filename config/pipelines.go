@@ -15,14 +15,18 @@ package config
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/cache"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
-	gocache "github.com/patrickmn/go-cache"
 	"golang.org/x/text/language"
 )
 
@@ -59,10 +63,16 @@ func htmlEnglishToSpanish(c context.Context, mfh filter.MediaFilterHandle) error
 }
 
 // englishToSpanish is MediaFilter that translates media from English to Spanish,
-// using the MIME type of the source in the call to Translate API. This uses
-// a translate API best for content under 30k code points.
+// using the MIME type of the source in the call to Translate API, and caching
+// translations in mediaCache.
 func englishToSpanish(c context.Context, mfh filter.MediaFilterHandle) error {
-	return filter.Translate(c, mfh, language.English, language.Spanish)
+	return filter.TranslateWith(c, mfh, filter.TranslateOptions{
+		From:       language.English,
+		To:         language.Spanish,
+		Translator: translator,
+		Getter:     variantCacheGetter,
+		Setter:     cacheSetter,
+	})
 }
 
 // isHTML tests whether a file ends with "html".
@@ -86,32 +96,179 @@ func blockSSNs(c context.Context, mfh filter.MediaFilterHandle) error {
 	return filter.BlockRegex(c, mfh, regexes)
 }
 
-// EXAMPLE: Cache media in the proxy's memory.
+// EXAMPLE: Cache media in the proxy's memory, and on local disk if
+// MEDIA_DISK_CACHE_DIR is set.
 var CacheMedia = filter.Pipeline{
 	cacheMedia,
+	cacheMediaOnDisk,
 	filter.LogRequest,
 }
 
+// EXAMPLE: Resize and convert images as the w, h, fit, q and fmt query
+// parameters say, caching the variants in mediaCache.
+var ResizingProxy = filter.Pipeline{
+	resizeImage,
+	filter.LogRequest,
+}
+
+// resizeImage applies mediaCache and the tenants' image presets from
+// PIPELINE_CONFIG to the ResizeImageWith filter.
+func resizeImage(c context.Context, mfh filter.MediaFilterHandle) error {
+	var presets map[string]filter.ImagePresets
+	if table := routesFrom(c); table != nil {
+		presets = table.imagePresets
+	}
+	return filter.ResizeImageWith(c, mfh, presets, variantCacheGetter, cacheSetter)
+}
+
+// setupImages bounds the images the image filter decodes by the
+// IMAGE_MAX_PIXELS environment variable, if it is set.
+func setupImages() error {
+	value := os.Getenv("IMAGE_MAX_PIXELS")
+	if value == "" {
+		return nil
+	}
+	pixels, err := strconv.Atoi(value)
+	if err != nil || pixels <= 0 {
+		return fmt.Errorf("IMAGE_MAX_PIXELS: invalid pixel count %q", value)
+	}
+	filter.MaxImagePixels = pixels
+	return nil
+}
+
+// mediaCacheOptions bounds mediaCache. They can be overridden with the
+// MEDIA_CACHE_MAX_BYTES, MEDIA_CACHE_MAX_ENTRY_BYTES and MEDIA_CACHE_POLICY
+// environment variables.
+var mediaCacheOptions = cache.Options{
+	MaxBytes:          256 << 20,
+	MaxEntryBytes:     16 << 20,
+	Policy:            cache.LRU,
+	DefaultExpiration: 5 * time.Minute,
+	MaxStale:          time.Hour,
+}
+
 // mediaCache is a cache for media.
-// TODO(domz): Gonna need some memory bounds here.
-var mediaCache = gocache.New(5*time.Minute, 10*time.Minute)
+var mediaCache = cache.NewMemory(mediaCacheOptions)
+
+// setupMediaCache sizes mediaCache from the environment.
+func setupMediaCache() error {
+	var err error
+	if mediaCacheOptions.MaxBytes, err = envBytes("MEDIA_CACHE_MAX_BYTES", mediaCacheOptions.MaxBytes); err != nil {
+		return err
+	}
+	if mediaCacheOptions.MaxEntryBytes, err = envBytes("MEDIA_CACHE_MAX_ENTRY_BYTES", mediaCacheOptions.MaxEntryBytes); err != nil {
+		return err
+	}
+	if mediaCacheOptions.Policy, err = cache.ParsePolicy(os.Getenv("MEDIA_CACHE_POLICY")); err != nil {
+		return err
+	}
+	mediaCache = cache.NewMemory(mediaCacheOptions)
+	return nil
+}
+
+// envBytes reads a byte count from an environment variable, or returns def
+// if it is unset.
+func envBytes(name string, def int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid byte count %q", name, value)
+	}
+	return n, nil
+}
 
 // cacheSetter matches the filter.CacheSet type.
 func cacheSetter(k string, b []byte, d time.Duration) {
-	mediaCache.Set(k, b, d)
+	mediaCache.Set(k, b, int64(len(b)), d)
 }
 
-// cacheSetter matches the gcs.CacheGet type.
+// cacheGetter matches the backends.CacheGet type.
 // Basically, we have to deal with the conversion from ifc/nil to []byte here.
-func cacheGetter(k string) ([]byte, bool) {
-	ifc, hit := mediaCache.Get(k)
+func cacheGetter(k string) ([]byte, time.Duration, bool) {
+	ifc, stale, hit := mediaCache.GetStale(k)
 	if hit {
+		return ifc.([]byte), stale, true
+	}
+	return []byte{}, 0, false
+}
+
+// variantCacheGetter matches the filter.CacheGet type.
+func variantCacheGetter(k string) ([]byte, bool) {
+	if ifc, hit := mediaCache.Get(k); hit {
 		return ifc.([]byte), true
 	}
-	return []byte{}, false
+	return nil, false
 }
 
 // cacheMedia applies mediaCache to the FillCache filter.
 func cacheMedia(c context.Context, mfh filter.MediaFilterHandle) error {
-	return filter.FillCache(c, mfh, cacheSetter)
+	return filter.FillCache(c, mfh, cacheSetter, mediaCacheOptions.MaxEntryBytes)
+}
+
+// diskCache is a second cache tier for media too big for mediaCache. It is
+// nil unless MEDIA_DISK_CACHE_DIR is set.
+var diskCache *cache.Disk
+
+// setupDiskCache opens diskCache, sized by MEDIA_DISK_CACHE_MAX_BYTES and
+// MEDIA_DISK_CACHE_MAX_ENTRY_BYTES.
+func setupDiskCache() error {
+	dir := os.Getenv("MEDIA_DISK_CACHE_DIR")
+	if dir == "" {
+		return nil
+	}
+	opts := cache.DiskOptions{
+		Dir:               dir,
+		DefaultExpiration: mediaCacheOptions.DefaultExpiration,
+		MaxStale:          mediaCacheOptions.MaxStale,
+	}
+	var err error
+	if opts.MaxBytes, err = envBytes("MEDIA_DISK_CACHE_MAX_BYTES", 10<<30); err != nil {
+		return err
+	}
+	if opts.MaxEntryBytes, err = envBytes("MEDIA_DISK_CACHE_MAX_ENTRY_BYTES", 1<<30); err != nil {
+		return err
+	}
+	diskCache, err = cache.NewDisk(opts)
+	return err
+}
+
+// diskCacheSetter matches the filter.StreamCacheSet type.
+func diskCacheSetter(k string, d time.Duration) (filter.CacheWriter, error) {
+	return diskCache.Create(k, d)
+}
+
+// diskCacheGetter matches the backends.StreamCacheGet type.
+func diskCacheGetter(k string) (backends.CachedMedia, time.Duration, bool) {
+	if diskCache == nil {
+		return nil, 0, false
+	}
+	media, stale, hit := diskCache.OpenStale(k)
+	if !hit {
+		return nil, 0, false
+	}
+	return media, stale, true
+}
+
+// cacheMediaOnDisk applies diskCache to the FillStreamCache filter.
+func cacheMediaOnDisk(c context.Context, mfh filter.MediaFilterHandle) error {
+	if diskCache == nil {
+		return filter.NoOp(c, mfh)
+	}
+	return filter.FillStreamCache(c, mfh, diskCacheSetter)
+}
+
+// Caches returns the caches in use, by name, so they can be inspected and
+// purged. It must be called after Setup.
+func Caches() map[string]cache.Cache {
+	caches := map[string]cache.Cache{
+		"media":    mediaCache,
+		"metadata": backends.MetadataCache(),
+	}
+	if diskCache != nil {
+		caches["disk"] = diskCache
+	}
+	return caches
 }
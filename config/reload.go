@@ -0,0 +1,159 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PipelineConfigStatus describes the pipeline config in use.
+type PipelineConfigStatus struct {
+	// Path is the file the config is loaded from; empty if PIPELINE_CONFIG
+	// is unset.
+	Path string `json:"path"`
+	// Version identifies the contents of the loaded config, by a prefix of
+	// their SHA-256.
+	Version  string    `json:"version"`
+	Routes   int       `json:"routes"`
+	LoadedAt time.Time `json:"loadedAt"`
+	// LastError is why the config could not be reloaded, if the last
+	// attempt failed. The previous version stays in use.
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// activeRoutes is the pipeline config in use, or nil if PIPELINE_CONFIG is
+// unset.
+var activeRoutes atomic.Pointer[routeTable]
+
+// pipelineConfig tracks the loaded config. Holding it serializes reloads.
+var pipelineConfig struct {
+	sync.Mutex
+	status PipelineConfigStatus
+}
+
+// LoadedPipelineConfig returns the status of the pipeline config.
+func LoadedPipelineConfig() PipelineConfigStatus {
+	pipelineConfig.Lock()
+	defer pipelineConfig.Unlock()
+	return pipelineConfig.status
+}
+
+// setupRoutes loads the pipeline config from the file PIPELINE_CONFIG names,
+// if any, and watches it for changes.
+//
+// The file is checked for changes every PIPELINE_CONFIG_POLL (5s by
+// default; 0 to only reload on SIGHUP), and reloaded on SIGHUP. A config
+// that fails to load at startup is an error; later, the previous config
+// stays in use.
+func setupRoutes() error {
+	path := os.Getenv("PIPELINE_CONFIG")
+	if path == "" {
+		return nil
+	}
+	poll := 5 * time.Second
+	if value := os.Getenv("PIPELINE_CONFIG_POLL"); value != "" {
+		var err error
+		if poll, err = time.ParseDuration(value); err != nil || poll < 0 {
+			return fmt.Errorf("PIPELINE_CONFIG_POLL: invalid duration %q", value)
+		}
+	}
+	pipelineConfig.status.Path = path
+	if err := reloadRoutes(); err != nil {
+		return fmt.Errorf("PIPELINE_CONFIG %s: %v", path, err)
+	}
+	go watchRoutes(path, poll, nil)
+	return nil
+}
+
+// reloadRoutes loads the pipeline config, and puts it in use if it is valid
+// and has changed.
+func reloadRoutes() error {
+	pipelineConfig.Lock()
+	defer pipelineConfig.Unlock()
+	status := &pipelineConfig.status
+	err := func() error {
+		data, err := os.ReadFile(status.Path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		version := hex.EncodeToString(sum[:6])
+		if version == status.Version {
+			return nil
+		}
+		table, err := parseRoutes(status.Path, data)
+		if err != nil {
+			return err
+		}
+		activeRoutes.Store(table)
+		status.Version = version
+		status.Routes = len(table.routes)
+		status.LoadedAt = time.Now()
+		log.Info().Msgf("pipeline config: loaded version %s from %s, %d routes", version, status.Path, len(table.routes))
+		return nil
+	}()
+	if err != nil {
+		now := time.Now()
+		status.LastError, status.LastErrorAt = err.Error(), &now
+		return err
+	}
+	status.LastError, status.LastErrorAt = "", nil
+	return nil
+}
+
+// watchRoutes reloads the pipeline config at path on SIGHUP, and when its
+// modification time or size changes, checked every poll, until stop is
+// closed. A nil stop watches for good.
+func watchRoutes(path string, poll time.Duration, stop <-chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	var tick <-chan time.Time
+	if poll > 0 {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last, _ := os.Stat(path)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangup:
+			log.Info().Msgf("pipeline config: reloading on SIGHUP")
+		case <-tick:
+			info, err := os.Stat(path)
+			if err != nil || last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				// a missing file is likely being replaced, and is picked
+				// up once it's back
+				continue
+			}
+			last = info
+		}
+		if err := reloadRoutes(); err != nil {
+			log.Error().Msgf("pipeline config: keeping version %s: %v", LoadedPipelineConfig().Version, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// routesFile points the pipeline config at a file in a temporary
+// directory, restoring the config in use when the test ends.
+func routesFile(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	pipelineConfig.Lock()
+	status := pipelineConfig.status
+	pipelineConfig.status = PipelineConfigStatus{Path: path}
+	pipelineConfig.Unlock()
+	table := activeRoutes.Load()
+	t.Cleanup(func() {
+		pipelineConfig.Lock()
+		pipelineConfig.status = status
+		pipelineConfig.Unlock()
+		activeRoutes.Store(table)
+	})
+	return path
+}
+
+// writeRoutes writes a config of n routes to path, or an invalid one if n
+// is 0. It is JSON, so YAML too.
+func writeRoutes(t *testing.T, path string, n int) {
+	t.Helper()
+	config := `{"routes": [{"filters": ["nope"]}]}`
+	if n > 0 {
+		config = `{"routes": [` + strings.Repeat(`{"filters": ["log"]}, `, n-1) + `{"filters": ["log"]}]}`
+	}
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// routeCount returns how many routes the config in use has.
+func routeCount() int {
+	if table := activeRoutes.Load(); table != nil {
+		return len(table.routes)
+	}
+	return -1
+}
+
+// eventually waits up to a second for condition to hold.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReloadRoutes(t *testing.T) {
+	path := routesFile(t, "pipelines.yaml")
+	writeRoutes(t, path, 1)
+	if err := reloadRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	first := activeRoutes.Load()
+	status := LoadedPipelineConfig()
+	if routeCount() != 1 || status.Routes != 1 || status.Version == "" || status.LoadedAt.IsZero() {
+		t.Fatalf("loaded %d routes, status %+v", routeCount(), status)
+	}
+
+	// an unchanged file isn't loaded again
+	if err := reloadRoutes(); err != nil || activeRoutes.Load() != first {
+		t.Errorf("reloading an unchanged file: %v, table replaced %v", err, activeRoutes.Load() != first)
+	}
+
+	// a bad config, or none, keeps the one in use
+	writeRoutes(t, path, 0)
+	if err := reloadRoutes(); err == nil || !strings.Contains(err.Error(), `unknown filter "nope"`) {
+		t.Errorf("reloading a bad config: %v, want its error", err)
+	}
+	failed := LoadedPipelineConfig()
+	if activeRoutes.Load() != first || failed.Version != status.Version ||
+		failed.LastError == "" || failed.LastErrorAt == nil {
+		t.Errorf("after a bad config: table replaced %v, status %+v", activeRoutes.Load() != first, failed)
+	}
+	os.Remove(path)
+	if err := reloadRoutes(); err == nil || activeRoutes.Load() != first {
+		t.Errorf("reloading a missing file: %v, table replaced %v", err, activeRoutes.Load() != first)
+	}
+
+	// a good one replaces it, and clears the error
+	writeRoutes(t, path, 2)
+	if err := reloadRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := LoadedPipelineConfig()
+	if routeCount() != 2 || reloaded.Routes != 2 || reloaded.Version == status.Version ||
+		reloaded.LastError != "" || reloaded.LastErrorAt != nil {
+		t.Errorf("after a good config: %d routes, status %+v", routeCount(), reloaded)
+	}
+}
+
+func TestWatchRoutesPolling(t *testing.T) {
+	path := routesFile(t, "pipelines.yaml")
+	writeRoutes(t, path, 1)
+	if err := reloadRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchRoutes(path, 5*time.Millisecond, stop)
+	// let the watcher see the file as it is
+	time.Sleep(20 * time.Millisecond)
+
+	writeRoutes(t, path, 2)
+	eventually(t, "the changed config", func() bool { return routeCount() == 2 })
+	table := activeRoutes.Load()
+	writeRoutes(t, path, 0)
+	eventually(t, "the bad config", func() bool { return LoadedPipelineConfig().LastError != "" })
+	if activeRoutes.Load() != table {
+		t.Error("a bad config replaced the one in use")
+	}
+	// a missing file is skipped until it's back
+	os.Remove(path)
+	time.Sleep(20 * time.Millisecond)
+	writeRoutes(t, path, 3)
+	eventually(t, "the replaced config", func() bool { return routeCount() == 3 })
+}
+
+func TestWatchRoutesSIGHUP(t *testing.T) {
+	path := routesFile(t, "pipelines.json")
+	writeRoutes(t, path, 1)
+	if err := reloadRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchRoutes(path, 0, stop)
+	// give the watcher time to ask for SIGHUP, which kills the process
+	// otherwise
+	time.Sleep(50 * time.Millisecond)
+
+	// without polling, changes wait for SIGHUP
+	writeRoutes(t, path, 2)
+	time.Sleep(20 * time.Millisecond)
+	if routeCount() != 1 {
+		t.Fatal("reloaded without SIGHUP")
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the reload on SIGHUP", func() bool { return routeCount() == 2 })
+}
+
+func TestSetupRoutesErrors(t *testing.T) {
+	path := routesFile(t, "pipelines.yaml")
+	writeRoutes(t, path, 0)
+	t.Setenv("PIPELINE_CONFIG", path)
+	if err := setupRoutes(); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("a bad config at startup: %v, want an error naming it", err)
+	}
+	t.Setenv("PIPELINE_CONFIG_POLL", "often")
+	if err := setupRoutes(); err == nil || !strings.Contains(err.Error(), "PIPELINE_CONFIG_POLL") {
+		t.Errorf("a bad poll interval: %v, want an error", err)
+	}
+}
@@ -0,0 +1,599 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+	"gopkg.in/yaml.v3"
+)
+
+// PipelineConfig is the layout of the file PIPELINE_CONFIG names, in YAML
+// or JSON.
+type PipelineConfig struct {
+	// Routes are tried in order; the first that matches a response picks
+	// its filters.
+	Routes []RouteConfig `json:"routes" yaml:"routes"`
+	// Tenants hold settings for each x-lpse-id.
+	Tenants map[string]TenantConfig `json:"tenants" yaml:"tenants"`
+	// PrivateReads pick how objects outside /public/ are served; the first
+	// that matches a request applies. Objects none matches are redirected to
+	// a signed URL valid for 6 days, with 301 Moved Permanently.
+	PrivateReads []PrivateReadConfig `json:"privateReads" yaml:"privateReads"`
+}
+
+// RouteConfig maps responses to a pipeline. Empty match fields match
+// anything.
+type RouteConfig struct {
+	// PathPrefix matches the start of the request path.
+	PathPrefix string `json:"pathPrefix" yaml:"pathPrefix"`
+	// Tenant matches the x-lpse-id header.
+	Tenant string `json:"tenant" yaml:"tenant"`
+	// ContentTypes match the media's Content-Type, as "type/subtype" or
+	// "type/*".
+	ContentTypes []string `json:"contentTypes" yaml:"contentTypes"`
+	// Filters are applied in order.
+	Filters []FilterConfig `json:"filters" yaml:"filters"`
+}
+
+// PrivateReadConfig says how private objects are served. Empty match fields
+// match anything.
+type PrivateReadConfig struct {
+	// PathPrefix matches the start of the request path.
+	PathPrefix string `json:"pathPrefix" yaml:"pathPrefix"`
+	// Tenant matches the x-lpse-id header.
+	Tenant string `json:"tenant" yaml:"tenant"`
+	// Mode is "stream", to serve objects through the proxy, with the
+	// routes' filters applied, or "redirect", to redirect to a signed URL.
+	Mode string `json:"mode" yaml:"mode"`
+	// Status is the status of redirects: 302 (the default), 307 or 301.
+	Status int `json:"status" yaml:"status"`
+	// TTL is how long signed URLs are valid, e.g. "10m"; 15 minutes by
+	// default, and 7 days at most.
+	TTL string `json:"ttl" yaml:"ttl"`
+}
+
+// defaultSignedURLTTL is how long signed URLs of redirects are valid unless
+// a PrivateReadConfig says otherwise.
+const defaultSignedURLTTL = 15 * time.Minute
+
+// maxSignedURLTTL is the longest V4 signed URLs can be valid.
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// privateRead is a PrivateReadConfig, ready to match requests.
+type privateRead struct {
+	pathPrefix string
+	tenant     string
+	stream     bool
+	status     int
+	ttl        time.Duration
+}
+
+// matches reports whether the private read applies to request.
+func (p privateRead) matches(request *http.Request) bool {
+	return strings.HasPrefix(request.URL.Path, p.pathPrefix) &&
+		(p.tenant == "" || request.Header.Get("x-lpse-id") == p.tenant)
+}
+
+// TenantConfig holds the settings of a tenant.
+type TenantConfig struct {
+	// ImagePresets are the named transforms the image filter offers the
+	// tenant, as ?preset=name or an @name path segment.
+	ImagePresets map[string]ImagePresetConfig `json:"imagePresets" yaml:"imagePresets"`
+	// StrictImagePresets refuses image transforms other than the presets.
+	StrictImagePresets bool `json:"strictImagePresets" yaml:"strictImagePresets"`
+	// ContentDisposition is "inline" or "attachment", to send objects with
+	// that Content-Disposition unless the request asks otherwise.
+	ContentDisposition string `json:"contentDisposition" yaml:"contentDisposition"`
+}
+
+// ImagePresetConfig is an image transform, with the names and meanings of
+// the query parameters of the image filter (see filter.ParseImageTransform).
+type ImagePresetConfig struct {
+	Width   int    `json:"w" yaml:"w"`
+	Height  int    `json:"h" yaml:"h"`
+	Fit     string `json:"fit" yaml:"fit"`
+	Quality int    `json:"q" yaml:"q"`
+	Format  string `json:"fmt" yaml:"fmt"`
+}
+
+// transform validates the preset, and returns its transform.
+func (p ImagePresetConfig) transform() (filter.ImageTransform, error) {
+	query := url.Values{}
+	set := func(name, value string) {
+		if value != "" && value != "0" {
+			query.Set(name, value)
+		}
+	}
+	set("w", strconv.Itoa(p.Width))
+	set("h", strconv.Itoa(p.Height))
+	set("fit", p.Fit)
+	set("q", strconv.Itoa(p.Quality))
+	set("fmt", p.Format)
+	transform, ok, err := filter.ParseImageTransform(query)
+	if err == nil && !ok {
+		err = errors.New("empty preset")
+	}
+	return transform, err
+}
+
+// FilterConfig names a registered filter, and its parameters. A filter
+// without parameters can be given as just its name.
+type FilterConfig struct {
+	Name   string        `json:"name" yaml:"name"`
+	Params filter.Params `json:"params" yaml:"params"`
+}
+
+func (f *FilterConfig) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.Name); err == nil {
+		return nil
+	}
+	// the type without this method, to decode it as usual
+	type plain FilterConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plain)(f))
+}
+
+func (f *FilterConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Name)
+	}
+	// nodes decode without the file's strictness, so check fields here
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			if key := value.Content[i].Value; key != "name" && key != "params" {
+				return fmt.Errorf("line %d: field %s not found in filter", value.Content[i].Line, key)
+			}
+		}
+	}
+	type plain FilterConfig
+	return value.Decode((*plain)(f))
+}
+
+// route is a RouteConfig, ready to match responses.
+type route struct {
+	pathPrefix   string
+	tenant       string
+	contentTypes []string
+	pipeline     filter.Pipeline
+	// wholeMedia is set if a filter of the pipeline must see the whole
+	// media (see filter.NeedsWholeMedia).
+	wholeMedia bool
+	// mediaHead is set if a filter of the pipeline goes by the first bytes
+	// of the media (see filter.NeedsMediaHead).
+	mediaHead bool
+	// caches is set if the pipeline fills the media caches, so they may
+	// hold its responses.
+	caches bool
+	// hitPipeline is the filters after the pipeline's last cache stage,
+	// which are applied to media served from the caches too.
+	hitPipeline filter.Pipeline
+}
+
+// mayMatch reports whether the route may apply to the response to request,
+// going by the request alone.
+func (r route) mayMatch(request *http.Request) bool {
+	return strings.HasPrefix(request.URL.Path, r.pathPrefix) &&
+		(r.tenant == "" || request.Header.Get("x-lpse-id") == r.tenant)
+}
+
+// matches reports whether the route applies to the response to request,
+// whose headers are header.
+func (r route) matches(request *http.Request, header http.Header) bool {
+	if !r.mayMatch(request) {
+		return false
+	}
+	if len(r.contentTypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	for _, contentType := range r.contentTypes {
+		if contentType == "*/*" || contentType == mediaType ||
+			strings.HasSuffix(contentType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(contentType, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRoutes reads and validates a pipeline config from data, read from
+// path.
+func parseRoutes(path string, data []byte) (*routeTable, error) {
+	config, err := decodeRoutes(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return compileRoutes(config)
+}
+
+// decodeRoutes reads a pipeline config from data, read from path. Files
+// ending in .json are read as JSON, others as YAML.
+func decodeRoutes(path string, data []byte) (PipelineConfig, error) {
+	var config PipelineConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return config, decoder.Decode(&config)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	return config, decoder.Decode(&config)
+}
+
+// compileRoutes validates config and builds its pipelines and presets.
+// Every problem found is reported, by where it is in the config.
+func compileRoutes(config PipelineConfig) (*routeTable, error) {
+	var problems []string
+	problem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+	if len(config.Routes) == 0 {
+		problem("no routes")
+	}
+	compiled := make([]route, 0, len(config.Routes))
+	for i, rc := range config.Routes {
+		r := route{
+			pathPrefix:   rc.PathPrefix,
+			tenant:       rc.Tenant,
+			contentTypes: rc.ContentTypes,
+			pipeline:     filter.Pipeline{},
+		}
+		if r.pathPrefix != "" && !strings.HasPrefix(r.pathPrefix, "/") {
+			problem("routes[%d].pathPrefix: %q must start with /", i, r.pathPrefix)
+		}
+		for j, contentType := range r.contentTypes {
+			if major, minor, ok := strings.Cut(contentType, "/"); !ok || major == "" || minor == "" ||
+				strings.ContainsAny(contentType, "; ") {
+				problem("routes[%d].contentTypes[%d]: %q is not type/subtype or type/*", i, j, contentType)
+			}
+			r.contentTypes[j] = strings.ToLower(contentType)
+		}
+		for j, fc := range rc.Filters {
+			if fc.Name == "" {
+				problem("routes[%d].filters[%d]: missing filter name", i, j)
+				continue
+			}
+			built, err := filter.Build(fc.Name, fc.Params)
+			if err != nil {
+				problem("routes[%d].filters[%d]: %v", i, j, err)
+				continue
+			}
+			r.pipeline = append(r.pipeline, built)
+			if cacheStages[fc.Name] {
+				r.caches, r.hitPipeline = true, filter.Pipeline{}
+			} else if r.caches {
+				r.hitPipeline = append(r.hitPipeline, built)
+			}
+			r.wholeMedia = r.wholeMedia || filter.NeedsWholeMedia(fc.Name)
+			r.mediaHead = r.mediaHead || filter.NeedsMediaHead(fc.Name)
+		}
+		compiled = append(compiled, r)
+	}
+	privateReads := make([]privateRead, 0, len(config.PrivateReads))
+	for i, pc := range config.PrivateReads {
+		p := privateRead{
+			pathPrefix: pc.PathPrefix,
+			tenant:     pc.Tenant,
+			status:     pc.Status,
+			ttl:        defaultSignedURLTTL,
+		}
+		if p.pathPrefix != "" && !strings.HasPrefix(p.pathPrefix, "/") {
+			problem("privateReads[%d].pathPrefix: %q must start with /", i, p.pathPrefix)
+		}
+		switch pc.Mode {
+		case "stream":
+			p.stream = true
+			if pc.Status != 0 || pc.TTL != "" {
+				problem("privateReads[%d]: status and ttl are only for redirects", i)
+			}
+		case "redirect":
+		default:
+			problem("privateReads[%d].mode: %q is not stream or redirect", i, pc.Mode)
+		}
+		switch p.status {
+		case 0:
+			p.status = http.StatusFound
+		case http.StatusFound, http.StatusTemporaryRedirect, http.StatusMovedPermanently:
+		default:
+			problem("privateReads[%d].status: %d is not 302, 307 or 301", i, p.status)
+		}
+		if pc.TTL != "" {
+			ttl, err := time.ParseDuration(pc.TTL)
+			if err != nil || ttl <= 0 || ttl > maxSignedURLTTL {
+				problem("privateReads[%d].ttl: %q is not a duration of up to 7 days", i, pc.TTL)
+			}
+			p.ttl = ttl
+		}
+		privateReads = append(privateReads, p)
+	}
+	imagePresets := map[string]filter.ImagePresets{}
+	dispositions := map[string]string{}
+	for _, tenant := range sortedKeys(config.Tenants) {
+		tc := config.Tenants[tenant]
+		switch tc.ContentDisposition {
+		case "":
+		case "inline", "attachment":
+			dispositions[tenant] = tc.ContentDisposition
+		default:
+			problem("tenants.%s.contentDisposition: %q is not inline or attachment", tenant, tc.ContentDisposition)
+		}
+		presets := filter.ImagePresets{
+			Presets: map[string]filter.ImageTransform{},
+			Strict:  tc.StrictImagePresets,
+		}
+		for _, name := range sortedKeys(tc.ImagePresets) {
+			transform, err := tc.ImagePresets[name].transform()
+			if err != nil {
+				problem("tenants.%s.imagePresets.%s: %v", tenant, name, err)
+			}
+			presets.Presets[name] = transform
+		}
+		imagePresets[tenant] = presets
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return &routeTable{
+		routes:       compiled,
+		privateReads: privateReads,
+		imagePresets: imagePresets,
+		dispositions: dispositions,
+	}, nil
+}
+
+// sortedKeys returns the keys of m, sorted, so problems are reported in the
+// same order every time.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// routeTable is a loaded pipeline config. A reload replaces the table
+// rather than changing it, so responses in flight keep the routes they
+// started with. Requests load the active table once, and use it throughout;
+// its methods treat a nil table as no PIPELINE_CONFIG.
+type routeTable struct {
+	routes []route
+	// privateReads pick how private objects are served, in order.
+	privateReads []privateRead
+	// imagePresets are the tenants' image presets, by x-lpse-id.
+	imagePresets map[string]filter.ImagePresets
+	// dispositions are the tenants' default dispositions, by x-lpse-id.
+	dispositions map[string]string
+}
+
+// mediaPipeline returns the pipeline for media: the table's routes, or
+// LoggingOnly without PIPELINE_CONFIG.
+func (table *routeTable) mediaPipeline() filter.Pipeline {
+	if table == nil {
+		return LoggingOnly
+	}
+	return filter.Pipeline{table.routeMedia}
+}
+
+// hitPipeline returns the pipeline for media served from the caches: the
+// filters after the cache stage of the route that matches.
+func (table *routeTable) hitPipeline() filter.Pipeline {
+	return filter.Pipeline{table.routeHits}
+}
+
+// routeTableKey is the context key of the routeTable a pipeline runs from.
+type routeTableKey struct{}
+
+// routesFrom returns the routeTable the pipeline running with ctx is from,
+// or else the active one.
+func routesFrom(ctx context.Context) *routeTable {
+	if table, ok := ctx.Value(routeTableKey{}).(*routeTable); ok {
+		return table
+	}
+	return activeRoutes.Load()
+}
+
+// routeMedia applies the pipeline of the first route that matches the
+// response. Media no route matches is passed through. The route's filters
+// find the table with routesFrom.
+func (table *routeTable) routeMedia(c context.Context, mfh filter.MediaFilterHandle) error {
+	c = context.WithValue(c, routeTableKey{}, table)
+	return filter.Select(c, mfh, func(request *http.Request, header http.Header) filter.Pipeline {
+		for _, r := range table.routes {
+			if r.matches(request, header) {
+				return r.pipeline
+			}
+		}
+		return nil
+	})
+}
+
+// routeHits applies the filters after the cache stage of the first route
+// that matches the response to media served from the caches.
+func (table *routeTable) routeHits(c context.Context, mfh filter.MediaFilterHandle) error {
+	c = context.WithValue(c, routeTableKey{}, table)
+	return filter.Select(c, mfh, func(request *http.Request, header http.Header) filter.Pipeline {
+		for _, r := range table.routes {
+			if r.matches(request, header) {
+				return r.hitPipeline
+			}
+		}
+		return nil
+	})
+}
+
+// usePresetSegment rewrites a request with an @name path segment naming one
+// of its tenant's image presets, e.g. /public/@thumb/a.jpg, to a request for
+// the object with ?preset=name.
+func (table *routeTable) usePresetSegment(request *http.Request) {
+	if table == nil {
+		return
+	}
+	presets := table.imagePresets[request.Header.Get("x-lpse-id")].Presets
+	if len(presets) == 0 {
+		return
+	}
+	segments := strings.Split(request.URL.Path, "/")
+	for i, segment := range segments {
+		name := strings.TrimPrefix(segment, "@")
+		if _, ok := presets[name]; !ok || name == segment {
+			continue
+		}
+		request.URL.Path = strings.Join(append(segments[:i:i], segments[i+1:]...), "/")
+		request.URL.RawPath = ""
+		query := request.URL.Query()
+		query.Set("preset", name)
+		request.URL.RawQuery = query.Encode()
+		return
+	}
+}
+
+// dropRanges drops the Range of a request whose response needs to be read
+// whole: one for an image transform, since the image filter needs the whole
+// image, and ranges of the variant would be of a different representation
+// anyway; and one a route may apply a filter to that must see the whole
+// media. Which route applies depends on the media's Content-Type, so all
+// that may are considered.
+func (table *routeTable) dropRanges(request *http.Request) {
+	whole := filter.ImageTransformRequested(request.URL.Query())
+	if table != nil {
+		for _, r := range table.routes {
+			whole = whole || r.wholeMedia && r.mayMatch(request)
+		}
+	}
+	if whole {
+		request.Header.Del("Range")
+		request.Header.Del("If-Range")
+	}
+}
+
+// withMediaHead returns ctx, carrying the first bytes of the object of a
+// HEAD request if a route that may apply goes by them, so the response is
+// typed as the GET's would be. Without them, as when the object can't be
+// read, filters make do without.
+func (table *routeTable) withMediaHead(ctx context.Context, request *http.Request) context.Context {
+	if table == nil {
+		return ctx
+	}
+	for _, r := range table.routes {
+		if !r.mediaHead || !r.mayMatch(request) {
+			continue
+		}
+		objectName := common.NormalizePath(request.Header.Get("x-lpse-id"), request.URL.Path)
+		reader, err := store.OpenRange(ctx, objectName, 0, filter.SniffBytes)
+		if err != nil {
+			return ctx
+		}
+		defer reader.Close()
+		head, err := io.ReadAll(reader)
+		if err != nil {
+			return ctx
+		}
+		return filter.WithMediaHead(ctx, head)
+	}
+	return ctx
+}
+
+// setContentDisposition sets the Content-Disposition the request asks for
+// with its download and filename parameters, or else its tenant's default,
+// if either does.
+func (table *routeTable) setContentDisposition(response http.ResponseWriter, request *http.Request) {
+	if disposition := table.disposition(request, request.URL.Path); disposition != "" {
+		response.Header().Set("Content-Disposition", disposition)
+	}
+}
+
+// disposition returns the Content-Disposition for objectName the request
+// asks for, or else its tenant's default, or "" if neither says.
+func (table *routeTable) disposition(request *http.Request, objectName string) string {
+	defaultType := ""
+	if table != nil {
+		defaultType = table.dispositions[request.Header.Get("x-lpse-id")]
+	}
+	return common.RequestedDisposition(request.URL.Query(), defaultType, objectName)
+}
+
+// readPublic serves a public object, from the media caches if a route that
+// may apply fills them.
+func (table *routeTable) readPublic(ctx context.Context, output http.ResponseWriter, input *http.Request) {
+	if table != nil {
+		for _, r := range table.routes {
+			if r.caches && r.mayMatch(input) {
+				backends.ReadWithCache(ctx, store, output, input, table.mediaPipeline(),
+					cacheGetter, diskCacheGetter, table.hitPipeline())
+				return
+			}
+		}
+	}
+	backends.Read(ctx, store, output, input, table.mediaPipeline())
+}
+
+// readPrivate serves a private object as the first private read that
+// matches the request says, or else redirects to a signed URL valid for 6
+// days.
+func (table *routeTable) readPrivate(ctx context.Context, output http.ResponseWriter, input *http.Request) {
+	if table != nil {
+		for _, p := range table.privateReads {
+			if !p.matches(input) {
+				continue
+			}
+			if p.stream {
+				backends.ReadPrivate(ctx, store, output, input, table.mediaPipeline())
+			} else {
+				backends.ReadWithSignedRedirect(ctx, store, output, input, table.mediaPipeline(), p.ttl, p.status)
+			}
+			return
+		}
+	}
+	backends.ReadWithSignatureURL(ctx, store, output, input, table.mediaPipeline())
+}
+
+// cacheStages are the filters that fill the media caches.
+var cacheStages = map[string]bool{
+	"cache":      true,
+	"disk_cache": true,
+}
+
+func init() {
+	// filters that use the caches are set up here, like the caches
+	filter.Register("cache", func(params filter.Params) (filter.MediaFilter, error) {
+		return cacheMedia, params.Decode(&struct{}{})
+	})
+	filter.Register("disk_cache", func(params filter.Params) (filter.MediaFilter, error) {
+		return cacheMediaOnDisk, params.Decode(&struct{}{})
+	})
+	filter.Register("image", func(params filter.Params) (filter.MediaFilter, error) {
+		return resizeImage, params.Decode(&struct{}{})
+	})
+	filter.Register("translate", func(params filter.Params) (filter.MediaFilter, error) {
+		return filter.TranslateFactory(translator, variantCacheGetter, cacheSetter)(params)
+	})
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/local"
+)
+
+// parseBoth parses a config written in JSON both as JSON and, since JSON is
+// YAML too, as YAML.
+func parseBoth(t *testing.T, config string) (fromJSON, fromYAML error) {
+	t.Helper()
+	_, fromJSON = parseRoutes("pipelines.json", []byte(config))
+	_, fromYAML = parseRoutes("pipelines.yaml", []byte(config))
+	return
+}
+
+func TestParseRoutesFormats(t *testing.T) {
+	yamlConfig := `
+routes:
+  - pathPrefix: /public/docs/
+    tenant: lpse1
+    contentTypes: [text/html, TEXT/*]
+    filters:
+      - sniff
+      - name: redact
+        params:
+          patterns: [email]
+          window: 64
+      - cache
+      - name: compress
+        params: {encodings: [gzip]}
+  - filters: [log]
+privateReads:
+  - pathPrefix: /private/
+    mode: redirect
+    status: 307
+    ttl: 10m
+  - mode: stream
+tenants:
+  lpse1:
+    contentDisposition: attachment
+    strictImagePresets: true
+    imagePresets:
+      thumb: {w: 100, h: 100, fit: cover}
+`
+	jsonConfig := `{
+  "routes": [
+    {
+      "pathPrefix": "/public/docs/",
+      "tenant": "lpse1",
+      "contentTypes": ["text/html", "TEXT/*"],
+      "filters": [
+        "sniff",
+        {"name": "redact", "params": {"patterns": ["email"], "window": 64}},
+        "cache",
+        {"name": "compress", "params": {"encodings": ["gzip"]}}
+      ]
+    },
+    {"filters": ["log"]}
+  ],
+  "privateReads": [
+    {"pathPrefix": "/private/", "mode": "redirect", "status": 307, "ttl": "10m"},
+    {"mode": "stream"}
+  ],
+  "tenants": {
+    "lpse1": {
+      "contentDisposition": "attachment",
+      "strictImagePresets": true,
+      "imagePresets": {"thumb": {"w": 100, "h": 100, "fit": "cover"}}
+    }
+  }
+}`
+	fromYAML, err := decodeRoutes("pipelines.yml", []byte(yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := decodeRoutes("pipelines.JSON", []byte(jsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// YAML and JSON decode numbers as different types, so compare the
+	// configs as JSON
+	yamlJSON, _ := json.Marshal(fromYAML)
+	jsonJSON, _ := json.Marshal(fromJSON)
+	if string(yamlJSON) != string(jsonJSON) {
+		t.Errorf("YAML and JSON decode differently:\n%s\n%s", yamlJSON, jsonJSON)
+	}
+
+	yamlTable, err := compileRoutes(fromYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonTable, err := compileRoutes(fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []*routeTable{yamlTable, jsonTable} {
+		if len(table.routes) != 2 {
+			t.Fatalf("%d routes, want 2", len(table.routes))
+		}
+		r := table.routes[0]
+		if r.pathPrefix != "/public/docs/" || r.tenant != "lpse1" ||
+			!reflect.DeepEqual(r.contentTypes, []string{"text/html", "text/*"}) {
+			t.Errorf("route 0 matches %q, %q, %q", r.pathPrefix, r.tenant, r.contentTypes)
+		}
+		if len(r.pipeline) != 4 || !r.wholeMedia || !r.mediaHead || !r.caches || len(r.hitPipeline) != 1 {
+			t.Errorf("route 0: %d filters, %d after the cache; whole media %v, media head %v, caches %v",
+				len(r.pipeline), len(r.hitPipeline), r.wholeMedia, r.mediaHead, r.caches)
+		}
+		if r := table.routes[1]; len(r.pipeline) != 1 || r.wholeMedia || r.mediaHead || r.caches {
+			t.Errorf("route 1: %d filters; whole media %v, media head %v, caches %v",
+				len(r.pipeline), r.wholeMedia, r.mediaHead, r.caches)
+		}
+	}
+	if !reflect.DeepEqual(yamlTable.privateReads, jsonTable.privateReads) ||
+		!reflect.DeepEqual(yamlTable.imagePresets, jsonTable.imagePresets) ||
+		!reflect.DeepEqual(yamlTable.dispositions, jsonTable.dispositions) {
+		t.Errorf("YAML and JSON compile differently")
+	}
+	want := []privateRead{
+		{pathPrefix: "/private/", status: http.StatusTemporaryRedirect, ttl: 10 * time.Minute},
+		{stream: true, status: http.StatusFound, ttl: defaultSignedURLTTL},
+	}
+	if !reflect.DeepEqual(jsonTable.privateReads, want) {
+		t.Errorf("private reads %+v, want %+v", jsonTable.privateReads, want)
+	}
+	if jsonTable.dispositions["lpse1"] != "attachment" || !jsonTable.imagePresets["lpse1"].Strict ||
+		len(jsonTable.imagePresets["lpse1"].Presets) != 1 {
+		t.Errorf("tenant lpse1: %q, %+v", jsonTable.dispositions["lpse1"], jsonTable.imagePresets["lpse1"])
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		// want are in the error, both from JSON and YAML
+		want []string
+	}{
+		{`{"routes": []}`, []string{"no routes"}},
+		{`{"rutes": [{"filters": ["log"]}]}`, []string{"rutes"}},
+		{`{"routes": [{"filters": ["log"], "prefix": "/"}]}`, []string{"prefix"}},
+		// filters
+		{`{"routes": [{"filters": ["nope"]}]}`, []string{`routes[0].filters[0]: unknown filter "nope"`}},
+		{`{"routes": [{"filters": [{"params": {}}]}]}`, []string{"routes[0].filters[0]: missing filter name"}},
+		{`{"routes": [{"filters": [{"name": "sniff", "colour": "red"}]}]}`, []string{"colour"}},
+		{`{"routes": [{"filters": [{"name": "log", "params": {"level": 1}}]}]}`, []string{`log: unknown parameter "level"`}},
+		{`{"routes": [{"filters": [{"name": "sniff", "params": {"strct": true}}]}]}`, []string{`sniff: unknown parameter "strct"`}},
+		{`{"routes": [{"filters": [{"name": "sniff", "params": {"strict": "yes"}}]}]}`, []string{`parameter "strict" must be bool`}},
+		{`{"routes": [{"filters": [{"name": "compress", "params": {"encodings": "br"}}]}]}`, []string{`parameter "encodings" must be []string`}},
+		{`{"routes": [{"filters": [{"name": "compress", "params": {"encodings": ["deflate"]}}]}]}`, []string{`encodings[0]: unsupported encoding "deflate"`}},
+		{`{"routes": [{"filters": ["block_regex"]}]}`, []string{`parameter "patterns" is required`}},
+		{`{"routes": [{"filters": [{"name": "block_regex", "params": {"patterns": ["("]}}]}]}`, []string{"block_regex: patterns[0]"}},
+		{`{"routes": [{"filters": [{"name": "redact", "params": {"patterns": ["pin"]}}]}]}`, []string{`unknown pattern "pin"`}},
+		{`{"routes": [{"filters": ["translate"]}]}`, []string{"routes[0].filters[0]: translate"}},
+		{`{"routes": [{"filters": [{"name": "cache", "params": {"ttl": 60}}]}]}`, []string{`cache: unknown parameter "ttl"`}},
+		// matching
+		{`{"routes": [{"pathPrefix": "public/", "filters": ["log"]}]}`, []string{`routes[0].pathPrefix: "public/" must start with /`}},
+		{`{"routes": [{"contentTypes": ["text"], "filters": ["log"]}]}`, []string{`routes[0].contentTypes[0]: "text" is not type/subtype`}},
+		{`{"routes": [{"contentTypes": ["text/html; charset=utf-8"], "filters": ["log"]}]}`, []string{"routes[0].contentTypes[0]"}},
+		// private reads
+		{`{"routes": [{"filters": ["log"]}], "privateReads": [{"mode": "proxy"}]}`, []string{`privateReads[0].mode: "proxy" is not stream or redirect`}},
+		{`{"routes": [{"filters": ["log"]}], "privateReads": [{"mode": "redirect", "status": 303}]}`, []string{"privateReads[0].status: 303 is not 302, 307 or 301"}},
+		{`{"routes": [{"filters": ["log"]}], "privateReads": [{"mode": "redirect", "ttl": "200h"}]}`, []string{`privateReads[0].ttl: "200h" is not a duration of up to 7 days`}},
+		{`{"routes": [{"filters": ["log"]}], "privateReads": [{"mode": "redirect", "ttl": "soon"}]}`, []string{`privateReads[0].ttl: "soon"`}},
+		{`{"routes": [{"filters": ["log"]}], "privateReads": [{"mode": "stream", "ttl": "1m"}]}`, []string{"privateReads[0]: status and ttl are only for redirects"}},
+		// tenants
+		{`{"routes": [{"filters": ["log"]}], "tenants": {"lpse1": {"contentDisposition": "download"}}}`, []string{`tenants.lpse1.contentDisposition: "download" is not inline or attachment`}},
+		{`{"routes": [{"filters": ["log"]}], "tenants": {"lpse1": {"imagePresets": {"thumb": {"fit": "stretch"}}}}}`, []string{"tenants.lpse1.imagePresets.thumb"}},
+		// every problem is reported
+		{`{"routes": [{"filters": ["nope"]}, {"pathPrefix": "x", "filters": ["log", "nope"]}]}`,
+			[]string{"routes[0].filters[0]", "routes[1].pathPrefix", "routes[1].filters[1]"}},
+	} {
+		fromJSON, fromYAML := parseBoth(t, test.config)
+		for format, err := range map[string]error{"JSON": fromJSON, "YAML": fromYAML} {
+			if err == nil {
+				t.Errorf("%s as %s: no error, want one", test.config, format)
+				continue
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("%s as %s: %v, want %s", test.config, format, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestGETFromCache(t *testing.T) {
+	table, err := parseRoutes("pipelines.yaml", []byte(`
+routes:
+  - pathPrefix: /public/cached/
+    filters: [cache, lower]
+  - filters: [lower]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer activeRoutes.Store(activeRoutes.Load())
+	activeRoutes.Store(table)
+	dir := t.TempDir()
+	testStore, err := local.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous backends.Backend) { store = previous }(store)
+	store = testStore
+	mediaCache.Flush()
+	defer mediaCache.Flush()
+	backends.MetadataCache().Flush()
+	defer backends.MetadataCache().Flush()
+
+	put := func(name, content string) {
+		t.Helper()
+		attrs := backends.ObjectAttrs{ContentType: "text/plain", CacheControl: "public, max-age=60"}
+		if err := testStore.Put(context.Background(), name, attrs, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(path string) string {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("x-lpse-id", "lpse1")
+		response := httptest.NewRecorder()
+		GET(context.Background(), response, request)
+		return response.Body.String()
+	}
+	put("lpse1/public/cached/a.txt", "FIRST")
+	put("lpse1/public/other/a.txt", "FIRST")
+	for _, path := range []string{"/public/cached/a.txt", "/public/other/a.txt"} {
+		if got := get(path); got != "first" {
+			t.Fatalf("%s: %q, want %q", path, got, "first")
+		}
+	}
+	// the object changes, but its metadata is still cached, so a cached
+	// copy of it is served, with the filters after the cache applied
+	put("lpse1/public/cached/a.txt", "OTHER")
+	put("lpse1/public/other/a.txt", "OTHER")
+	if got := get("/public/cached/a.txt"); got != "first" {
+		t.Errorf("from a route that caches: %q, want the cached %q", got, "first")
+	}
+	if got := get("/public/other/a.txt"); got != "other" {
+		t.Errorf("from a route that doesn't cache: %q, want %q", got, "other")
+	}
+}
@@ -18,8 +18,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
@@ -28,33 +26,123 @@ import (
 
 type CacheSet func(string, []byte, time.Duration)
 
+// CacheGet gets media a filter made, such as a variant of an image, from a
+// cache.
+type CacheGet func(string) ([]byte, bool)
+
 // FillCache will tee the media it recieves into a cache, using the normalized
 // request URL as the key. Supply a cache setter with the setter argument.
-func FillCache(ctx context.Context, handle MediaFilterHandle, setter CacheSet) error {
+//
+// Media bigger than maxBytes is streamed without being cached, and the
+// buffer is dropped as soon as it would grow past maxBytes. Media whose
+// Cache-Control forbids shared caching (no-store, no-cache, private) is never
+// cached, and neither are partial responses, one range or several.
+func FillCache(ctx context.Context, handle MediaFilterHandle, setter CacheSet, maxBytes int64) error {
 	defer handle.input.Close()
 	defer handle.output.Close()
+	// media that may not be cached, and partial content, which is not the
+	// whole object, are passed through without buffering
+	expiration, ok := cacheExpiration(handle)
+	if !ok || partialContent(handle) {
+		if _, err := io.Copy(handle.output, handle.input); err != nil {
+			return fmt.Errorf("fillcache: %v", err)
+		}
+		return nil
+	}
 	// create a buffer for the media
-	cachedMedia := new(bytes.Buffer)
+	cachedMedia := &limitedBuffer{max: maxBytes}
 	// create a tee from the input that writes to cachedMedia
 	tee := io.TeeReader(handle.input, cachedMedia)
 	// write the response through the tee
 	if _, err := io.Copy(handle.output, tee); err != nil {
 		return fmt.Errorf("fillcache: %v", err)
 	}
-	// determine expiration
-	cacheExpiration := 0 * time.Second
-	cacheControl := handle.response.Header().Get("Cache-Control")
-	if cacheControl != "" &&
-		strings.HasPrefix(cacheControl, "max-age") {
-		ccSecs, err := strconv.Atoi(strings.Split(cacheControl, "=")[1])
-		if err != nil {
-			log.Error().Msgf("fillcache: %v", err)
-		} else {
-			cacheExpiration = time.Second * time.Duration(ccSecs)
-		}
+	if cachedMedia.overflowed {
+		log.Debug().Msgf("fillcache: media exceeds %v bytes, not cached", maxBytes)
+		return nil
 	}
 	// cache the media
-	cacheKey := common.NormalizePath(handle.request.Header.Get("x-lpse-id"), handle.request.URL.String())
-	setter(cacheKey, cachedMedia.Bytes(), cacheExpiration)
+	setter(cacheKey(handle), cachedMedia.Bytes(), expiration)
+	return nil
+}
+
+// CacheWriter receives media for a streaming cache tier.
+type CacheWriter interface {
+	io.Writer
+	// Commit adds the written media to the cache.
+	Commit() error
+	// Abort discards the written media.
+	Abort()
+}
+
+// StreamCacheSet starts a streaming cache entry with the given key and
+// expiration.
+type StreamCacheSet func(string, time.Duration) (CacheWriter, error)
+
+// FillStreamCache will tee the media it recieves into a streaming cache tier,
+// such as a disk cache, using the normalized request URL as the key. Unlike
+// FillCache, the media is never buffered in memory. Like FillCache, it
+// passes partial responses through.
+func FillStreamCache(ctx context.Context, handle MediaFilterHandle, setter StreamCacheSet) error {
+	defer handle.input.Close()
+	defer handle.output.Close()
+	// pass through media that may not be cached, and partial content, which
+	// is not the whole object
+	expiration, ok := cacheExpiration(handle)
+	if !ok || partialContent(handle) {
+		if _, err := io.Copy(handle.output, handle.input); err != nil {
+			return fmt.Errorf("fillstreamcache: %v", err)
+		}
+		return nil
+	}
+	writer, err := setter(cacheKey(handle), expiration)
+	if err != nil {
+		log.Error().Msgf("fillstreamcache: %v", err)
+		if _, err := io.Copy(handle.output, handle.input); err != nil {
+			return fmt.Errorf("fillstreamcache: %v", err)
+		}
+		return nil
+	}
+	// write the response through a tee; a failed response leaves a partial
+	// entry, which must not be cached
+	tee := io.TeeReader(handle.input, writer)
+	if _, err := io.Copy(handle.output, tee); err != nil {
+		writer.Abort()
+		return fmt.Errorf("fillstreamcache: %v", err)
+	}
+	if err := writer.Commit(); err != nil {
+		log.Error().Msgf("fillstreamcache: %v", err)
+	}
 	return nil
 }
+
+// cacheKey returns the key media for the request is cached under.
+func cacheKey(handle MediaFilterHandle) string {
+	return common.NormalizePath(handle.request.Header.Get("x-lpse-id"), handle.request.URL.String())
+}
+
+// cacheExpiration determines how long to cache media for, from the
+// response's Cache-Control header, and whether it may be cached at all.
+func cacheExpiration(handle MediaFilterHandle) (time.Duration, bool) {
+	return common.ParseCacheControl(handle.Header().Get("Cache-Control")).CacheFor()
+}
+
+// limitedBuffer buffers writes up to a maximum size. Once a write would
+// exceed it, the buffer is released and further writes are discarded.
+type limitedBuffer struct {
+	bytes.Buffer
+	max        int64
+	overflowed bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflowed {
+		return len(p), nil
+	}
+	if int64(b.Len()+len(p)) > b.max {
+		b.overflowed = true
+		b.Buffer = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
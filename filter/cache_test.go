@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// memoryCache records what FillCache and FillStreamCache store.
+type memoryCache map[string]string
+
+func (c memoryCache) set(key string, media []byte, expiration time.Duration) {
+	c[key] = string(media)
+}
+
+func (c memoryCache) streamSet(key string, expiration time.Duration) (CacheWriter, error) {
+	return &memoryWriter{cache: c, key: key}, nil
+}
+
+// memoryWriter is a CacheWriter into a memoryCache.
+type memoryWriter struct {
+	cache memoryCache
+	key   string
+	media []byte
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	w.media = append(w.media, p...)
+	return len(p), nil
+}
+
+func (w *memoryWriter) Commit() error {
+	w.cache[w.key] = string(w.media)
+	return nil
+}
+
+func (w *memoryWriter) Abort() {}
+
+// withStatus sets the status of the response, as backends do for ranges.
+func withStatus(status int) MediaFilter {
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		handle.SetStatus(status)
+		return NoOp(ctx, handle)
+	}
+}
+
+func TestFillCache(t *testing.T) {
+	multipart := "--b\r\nContent-Range: bytes 0-0/10\r\n\r\n0\r\n--b--\r\n"
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		cached bool
+	}{
+		{"whole", 0, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"private", 0, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"one range", http.StatusPartialContent,
+			http.Header{"Cache-Control": {"public, max-age=60"}, "Content-Range": {"bytes 0-0/10"}}, false},
+		{"several ranges", http.StatusPartialContent,
+			http.Header{"Cache-Control": {"public, max-age=60"}, "Content-Type": {"multipart/byteranges; boundary=b"}}, false},
+		{"multipart without status", 0,
+			http.Header{"Cache-Control": {"public, max-age=60"}, "Content-Type": {"multipart/byteranges; boundary=b"}}, false},
+		{"206 without headers", http.StatusPartialContent, http.Header{"Cache-Control": {"public, max-age=60"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, disk := memoryCache{}, memoryCache{}
+			fill := func(ctx context.Context, handle MediaFilterHandle) error {
+				return FillCache(ctx, handle, memory.set, 1<<20)
+			}
+			fillStream := func(ctx context.Context, handle MediaFilterHandle) error {
+				return FillStreamCache(ctx, handle, disk.streamSet)
+			}
+			response, err := run(t, Pipeline{withStatus(tt.status), fill, fillStream}, nil, tt.header, multipart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Body.String() != multipart {
+				t.Errorf("body = %q, want the media", response.Body)
+			}
+			if _, ok := memory["/public/a.txt"]; ok != tt.cached {
+				t.Errorf("FillCache cached = %v, want %v", ok, tt.cached)
+			}
+			if _, ok := disk["/public/a.txt"]; ok != tt.cached {
+				t.Errorf("FillStreamCache cached = %v, want %v", ok, tt.cached)
+			}
+		})
+	}
+}
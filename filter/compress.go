@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultEncodings are the content codings Compress offers, in order of
+// preference.
+var DefaultEncodings = []string{"br", "zstd", "gzip"}
+
+// compressMinBytes is the smallest media worth compressing, when its length
+// is known.
+const compressMinBytes = 1024
+
+// encoders start compressed streams, by content coding.
+var encoders = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, 6)
+	},
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, 5), nil
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+}
+
+// decoders read compressed streams, by content coding.
+var decoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"br": func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(brotli.NewReader(r)), nil
+	},
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+}
+
+// Compress encodes the media with the best of DefaultEncodings the client
+// accepts, going by Accept-Encoding.
+//
+// Media that is already compressed, like images, video and archives, is
+// sent as is, as are partial responses. Objects stored with a Content-Encoding are sent
+// as stored to clients that accept it, and decoded (and encoded again, if
+// possible) for those that don't.
+//
+// Responses vary by Accept-Encoding, but cache keys don't, so cache fill
+// filters belong before this one in a pipeline.
+func Compress(ctx context.Context, handle MediaFilterHandle) error {
+	return CompressWith(ctx, handle, DefaultEncodings)
+}
+
+// CompressWith is Compress, offering only the given content codings, in
+// order of preference.
+//
+// This function should be called from a lambda that applies desired
+// encodings, leaving only ctx and handle for use as a MediaFilter.
+func CompressWith(ctx context.Context, handle MediaFilterHandle, encodings []string) error {
+	defer handle.input.Close()
+	defer handle.output.Close()
+	header := handle.Header()
+	common.AddVary(header, "Accept-Encoding")
+	accepted := common.ParseAcceptEncoding(handle.request.Header.Get("Accept-Encoding"))
+
+	var media io.Reader = handle.input
+	stored := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if stored != "" {
+		decode, known := decoders[stored]
+		if accepted.Allows(stored) || !known || partialContent(handle) {
+			return copyMedia(handle.output, media)
+		}
+		decoder, err := decode(media)
+		if err != nil {
+			return FilterError(handle, http.StatusInternalServerError, "compress filter: decoding %s: %v", stored, err)
+		}
+		defer decoder.Close()
+		media = decoder
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		weakenETag(header)
+	}
+
+	encoding := ""
+	if compressible(handle) {
+		encoding = accepted.Choose(encodings)
+	}
+	encode, known := encoders[encoding]
+	if !known {
+		return copyMedia(handle.output, media)
+	}
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	weakenETag(header)
+	encoder, err := encode(handle.output)
+	if err != nil {
+		return FilterError(handle, http.StatusInternalServerError, "compress filter: %v", err)
+	}
+	if _, err := io.Copy(encoder, media); err != nil {
+		encoder.Close()
+		return fmt.Errorf("compress filter: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("compress filter: %w", err)
+	}
+	return nil
+}
+
+// copyMedia copies media to output as is.
+func copyMedia(output io.Writer, media io.Reader) error {
+	if _, err := io.Copy(output, media); err != nil {
+		return fmt.Errorf("copying media: %w", err)
+	}
+	return nil
+}
+
+// compressible reports whether compressing the media is worthwhile: it
+// isn't already compressed, partial, or tiny.
+func compressible(handle MediaFilterHandle) bool {
+	if partialContent(handle) {
+		return false
+	}
+	header := handle.Header()
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < compressMinBytes {
+		return false
+	}
+	return common.CompressibleType(header.Get("Content-Type"))
+}
+
+// weakenETag marks a strong ETag weak, since a different encoding of the
+// media is not byte for byte the same.
+func weakenETag(header http.Header) {
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", "W/"+etag)
+	}
+}
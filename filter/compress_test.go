@@ -0,0 +1,202 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// text is media worth compressing.
+var text = strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+
+// compress is a pipeline offering encodings, or DefaultEncodings if nil.
+func compress(encodings []string) Pipeline {
+	if encodings == nil {
+		return Pipeline{Compress}
+	}
+	return Pipeline{func(ctx context.Context, handle MediaFilterHandle) error {
+		return CompressWith(ctx, handle, encodings)
+	}}
+}
+
+// acceptingEncoding returns a request accepting the given encodings.
+func acceptingEncoding(acceptEncoding string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/public/a.txt", nil)
+	if acceptEncoding != "" {
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	return request
+}
+
+// decoded returns the body of response, decoded as its Content-Encoding
+// says.
+func decoded(t *testing.T, response *httptest.ResponseRecorder) string {
+	t.Helper()
+	encoding := response.Header().Get("Content-Encoding")
+	if encoding == "" {
+		return response.Body.String()
+	}
+	decoder, err := decoders[encoding](bytes.NewReader(response.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", encoding, err)
+	}
+	defer decoder.Close()
+	media, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", encoding, err)
+	}
+	return string(media)
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding string
+		offered        []string
+		want           string
+	}{
+		{"gzip, deflate, br, zstd", nil, "br"},
+		{"gzip", nil, "gzip"},
+		{"x-gzip", nil, "gzip"},
+		{"zstd", nil, "zstd"},
+		{"gzip;q=1, br;q=0.5", nil, "gzip"},
+		{"br;q=0.5, zstd;q=0.5, gzip;q=0.5", nil, "br"},
+		{"*", nil, "br"},
+		{"br;q=0, *", nil, "zstd"},
+		{"gzip;q=0", nil, ""},
+		{"identity", nil, ""},
+		{"deflate", nil, ""},
+		{"", nil, ""},
+		{"br, gzip", []string{"gzip"}, "gzip"},
+		{"br", []string{"gzip", "zstd"}, ""},
+	} {
+		header := http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"4400"}, "Etag": {`"v1"`}}
+		response, err := run(t, compress(test.offered), acceptingEncoding(test.acceptEncoding), header, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := response.Header()
+		if encoding := got.Get("Content-Encoding"); encoding != test.want {
+			t.Errorf("%q offering %v: Content-Encoding %q, want %q", test.acceptEncoding, test.offered, encoding, test.want)
+			continue
+		}
+		if decoded(t, response) != text {
+			t.Errorf("%q offering %v: media doesn't decode to the object", test.acceptEncoding, test.offered)
+		}
+		if got.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q offering %v: Vary %q", test.acceptEncoding, test.offered, got.Get("Vary"))
+		}
+		wantLength, wantETag := "4400", `"v1"`
+		if test.want != "" {
+			wantLength, wantETag = "", `W/"v1"`
+		}
+		if got.Get("Content-Length") != wantLength || got.Get("Etag") != wantETag {
+			t.Errorf("%q offering %v: Content-Length %q, ETag %s; want %q, %s", test.acceptEncoding, test.offered,
+				got.Get("Content-Length"), got.Get("Etag"), wantLength, wantETag)
+		}
+	}
+}
+
+func TestCompressSkips(t *testing.T) {
+	multipart := "--b\r\nContent-Range: bytes 0-0/10\r\n\r\n0\r\n--b--\r\n"
+	for _, test := range []struct {
+		name     string
+		pipeline Pipeline
+		header   http.Header
+		media    string
+		want     string
+	}{
+		{"text", compress(nil), http.Header{"Content-Type": {"text/html; charset=utf-8"}}, text, "br"},
+		{"json", compress(nil), http.Header{"Content-Type": {"application/json"}}, text, "br"},
+		{"svg", compress(nil), http.Header{"Content-Type": {"image/svg+xml"}}, text, "br"},
+		{"untyped", compress(nil), nil, text, "br"},
+		{"png", compress(nil), http.Header{"Content-Type": {"image/png"}}, text, ""},
+		{"video", compress(nil), http.Header{"Content-Type": {"video/mp4"}}, text, ""},
+		{"zip", compress(nil), http.Header{"Content-Type": {"application/zip"}}, text, ""},
+		{"woff2", compress(nil), http.Header{"Content-Type": {"font/woff2"}}, text, ""},
+		// media known to be tiny isn't worth it
+		{"under the minimum", compress(nil),
+			http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"1023"}}, text[:1023], ""},
+		{"at the minimum", compress(nil),
+			http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"1024"}}, text[:1024], "br"},
+		// partial responses are never compressed
+		{"one range", compress(nil),
+			http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-4399/8800"}}, text, ""},
+		{"several ranges", Pipeline{withStatus(http.StatusPartialContent), Compress},
+			http.Header{"Content-Type": {"multipart/byteranges; boundary=b"}}, multipart, ""},
+		{"multipart without a status", compress(nil),
+			http.Header{"Content-Type": {"multipart/byteranges; boundary=b"}}, multipart, ""},
+		{"206 alone", Pipeline{withStatus(http.StatusPartialContent), Compress},
+			http.Header{"Content-Type": {"text/plain"}}, text, ""},
+	} {
+		response, err := run(t, test.pipeline, acceptingEncoding("br, gzip"), test.header, test.media)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding := response.Header().Get("Content-Encoding"); encoding != test.want {
+			t.Errorf("%s: Content-Encoding %q, want %q", test.name, encoding, test.want)
+			continue
+		}
+		if decoded(t, response) != test.media {
+			t.Errorf("%s: media doesn't decode to the object", test.name)
+		}
+	}
+}
+
+func TestCompressStoredEncoding(t *testing.T) {
+	var stored bytes.Buffer
+	writer := gzip.NewWriter(&stored)
+	writer.Write([]byte(text))
+	writer.Close()
+	for _, test := range []struct {
+		name           string
+		acceptEncoding string
+		header         http.Header
+		want           string
+		asStored       bool
+	}{
+		{"accepted", "gzip, br", nil, "gzip", true},
+		{"encoded again", "br", nil, "br", false},
+		{"decoded", "", nil, "", false},
+		{"a range", "br", http.Header{"Content-Range": {"bytes 0-99/1000"}}, "gzip", true},
+		{"unknown", "", http.Header{"Content-Encoding": {"compress"}}, "compress", true},
+	} {
+		header := http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"},
+			"Content-Length": {"1000"}}
+		for key, values := range test.header {
+			header[key] = values
+		}
+		response, err := run(t, compress(nil), acceptingEncoding(test.acceptEncoding), header, stored.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding := response.Header().Get("Content-Encoding"); encoding != test.want {
+			t.Errorf("%s: Content-Encoding %q, want %q", test.name, encoding, test.want)
+			continue
+		}
+		if test.asStored {
+			if response.Body.String() != stored.String() || response.Header().Get("Content-Length") != "1000" {
+				t.Errorf("%s: not sent as stored", test.name)
+			}
+		} else if decoded(t, response) != text {
+			t.Errorf("%s: media doesn't decode to the object", test.name)
+		}
+	}
+}
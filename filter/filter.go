@@ -15,9 +15,11 @@ package filter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 )
@@ -29,46 +31,145 @@ type MediaFilter func(context.Context, MediaFilterHandle) error
 type Pipeline []MediaFilter
 
 // MediaFilterHandle is a pair of input and output for the filter to read and write.
-// Request and response are also included in case the filter needs to refer to
-// or modify those.
+// The request is also included in case the filter needs to refer to it, and
+// the response headers and status can be changed with Header and SetStatus.
 type MediaFilterHandle struct {
-	input    *io.PipeReader
-	output   *io.PipeWriter
-	request  *http.Request
-	response http.ResponseWriter
+	input   *io.PipeReader
+	output  *stageWriter
+	request *http.Request
 }
 
 // Performs a copy of input to response, with filters applied to the input.
+//
+// Each filter runs in its own goroutine. PipelineCopy returns once they have
+// all finished, with the error that ended the pipeline, if any. When a
+// filter fails, the filters before it fail in turn as their output is
+// closed, so the error furthest down the pipeline is the cause; it is the
+// one returned, and the pipeline's context is canceled.
+//
+// Response headers and status pass down the pipeline ahead of the media:
+// each filter may change them before it writes its output (see Header), and
+// the response gets them from the last filter. If the pipeline fails before
+// any of the body is written, the response is an error with the status of
+// the failure (see FilterError). Afterwards, it's too late, and callers
+// should abort the response so clients don't mistake it for a complete one.
 func PipelineCopy(ctx context.Context, response http.ResponseWriter, input io.Reader, request *http.Request, pipeline Pipeline) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	deferred := deferWriteHeader(response)
+	// errors are recorded at 0 for the input, i+1 for filter i, and last
+	// for the copy to the response
+	failed := &failures{errs: make([]error, len(pipeline)+2), cancel: cancel}
+
 	inputReader, inputWriter := io.Pipe()
 	// prime the pump by writing the input to the first pipe
 	go func() {
-		io.Copy(inputWriter, input)
-		inputWriter.Close()
+		_, err := io.Copy(inputWriter, input)
+		if err != nil {
+			failed.fail(0, fmt.Errorf("pipeline input: %w", err))
+		}
+		inputWriter.CloseWithError(err)
 	}()
-	// variable for last pipe's reader (output) in outer scope
-	var lastFilterReader *io.PipeReader
+	// the headers so far, which the first filter starts from
+	firstStage := committedHeaderStage(response.Header().Clone(), deferred.pending())
+	var filters sync.WaitGroup
+	output, lastStage := startFilters(ctx, &filters, failed, inputReader, firstStage, request, pipeline)
+	// the response takes the headers the last filter passes on
+	<-lastStage.done
+	header := response.Header()
+	for key := range header {
+		delete(header, key)
+	}
+	for key, values := range lastStage.sent {
+		header[key] = values
+	}
+	if lastStage.sentStatus != 0 {
+		deferred.WriteHeader(lastStage.sentStatus)
+	}
+	written, err := io.Copy(deferred, output)
+	if err != nil {
+		failed.fail(len(pipeline)+1, err)
+		// unblock the last filter
+		output.CloseWithError(err)
+	}
+	filters.Wait()
+
+	if err := failed.cause(); err != nil {
+		if !deferred.committed() {
+			writeErrorStatus(response, statusOf(err))
+		}
+		return written, err
+	}
+	// an empty body, as for HEAD, never wrote the status
+	deferred.send()
+	return written, nil
+}
+
+// startFilters runs each filter of pipeline in its own goroutine, added to
+// wg. The first filter reads input, and starts from the headers stage passes
+// on; the others read the filter before. It returns the last filter's output
+// and header stage, or input and stage if the pipeline is empty. Filter i's
+// error is recorded in failed at i+1.
+func startFilters(ctx context.Context, wg *sync.WaitGroup, failed *failures,
+	input *io.PipeReader, stage *headerStage, request *http.Request,
+	pipeline Pipeline) (*io.PipeReader, *headerStage) {
 	for i, filter := range pipeline {
-		// make a new pipe
 		filterReader, filterWriter := io.Pipe()
-		// decide whether to read from input, or the last filter
-		var inputSource *io.PipeReader
-		if i == 0 {
-			inputSource = inputReader
-		} else {
-			inputSource = lastFilterReader
-		}
-		// run filter goroutine
-		go filter(ctx, MediaFilterHandle{
-			input:    inputSource,
-			output:   filterWriter,
-			request:  request,
-			response: response,
+		filterStage := newHeaderStage(stage)
+		wg.Add(1)
+		go func(i int, filter MediaFilter, handle MediaFilterHandle) {
+			defer wg.Done()
+			err := filter(ctx, handle)
+			if err != nil {
+				failed.fail(i+1, err)
+			}
+			// filters should close their pipes, but make sure; if the
+			// filter failed without closing its output, the next one
+			// sees the error
+			handle.input.CloseWithError(err)
+			handle.output.CloseWithError(err)
+		}(i, filter, MediaFilterHandle{
+			input:   input,
+			output:  &stageWriter{PipeWriter: filterWriter, stage: filterStage},
+			request: request,
 		})
-		// update last filter pipereader for next filter or output
-		lastFilterReader = filterReader
+		input, stage = filterReader, filterStage
+	}
+	return input, stage
+}
+
+// failures records the errors of a pipeline by position, and cancels the
+// pipeline at the first one.
+type failures struct {
+	mu     sync.Mutex
+	errs   []error
+	cancel context.CancelFunc
+}
+
+func (f *failures) fail(i int, err error) {
+	// a closed pipe means the next filter stopped reading, which is its
+	// business; if it failed, its own error is reported
+	if errors.Is(err, io.ErrClosedPipe) {
+		return
 	}
-	return io.Copy(response, lastFilterReader)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[i] = err
+	f.cancel()
+}
+
+// cause returns the error furthest down the pipeline. When a filter fails,
+// the ones before it fail in turn as their output is closed, so that is the
+// one that ended it.
+func (f *failures) cause() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.errs) - 1; i >= 0; i-- {
+		if f.errs[i] != nil {
+			return f.errs[i]
+		}
+	}
+	return nil
 }
 
 // NoOp does nothing to the media.
@@ -90,10 +191,47 @@ func FilterIf(ctx context.Context, handle MediaFilterHandle,
 	return NoOp(ctx, handle)
 }
 
-// FilterError is the preferred way to return errors from filters.
+// StatusError is an error that decides the status of the response, if it
+// happens before any of the body is written.
+type StatusError struct {
+	StatusCode int
+	Err        error
+	// cause is the error that caused Err, if known
+	cause error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	if e.cause != nil {
+		return e.cause
+	}
+	return e.Err
+}
+
+// FilterError is the preferred way to return errors from filters. The
+// statusCode is used for the response if none of it has been sent yet.
 func FilterError(handle MediaFilterHandle, statusCode int, msg string, v ...interface{}) error {
-	err := fmt.Errorf(msg, v...)
+	err := &StatusError{StatusCode: statusCode, Err: fmt.Errorf(msg, v...)}
+	// keep an error among the arguments as the cause, so errors.Is and
+	// errors.As see through the message
+	for _, arg := range v {
+		if cause, ok := arg.(error); ok {
+			err.cause = cause
+			break
+		}
+	}
 	log.Error().Msgf("filter error! %v", err)
-	http.Error(handle.response, http.StatusText(statusCode), statusCode)
 	return err
 }
+
+// statusOf returns the response status for err.
+func statusOf(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
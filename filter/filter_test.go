@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// run sends media through pipeline as the response to request, or to a GET
+// for /public/a.txt if request is nil, with header as the response headers
+// so far.
+func run(t *testing.T, pipeline Pipeline, request *http.Request, header http.Header, media string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	if request == nil {
+		request = httptest.NewRequest(http.MethodGet, "/public/a.txt", nil)
+	}
+	response := httptest.NewRecorder()
+	for key, values := range header {
+		response.Header()[key] = values
+	}
+	_, err := PipelineCopy(context.Background(), response, strings.NewReader(media), request, pipeline)
+	return response, err
+}
+
+func TestPipelineCopy(t *testing.T) {
+	response, err := run(t, Pipeline{NoOp, ToLower, NoOp}, nil, nil, "Hello, World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != http.StatusOK || response.Body.String() != "hello, world" {
+		t.Errorf("response = %d %q, want 200 %q", response.Code, response.Body, "hello, world")
+	}
+}
+
+func TestPipelineCopyStatusWithoutBody(t *testing.T) {
+	// a status set by a filter is sent even if no body follows, as for HEAD
+	notFound := func(ctx context.Context, handle MediaFilterHandle) error {
+		defer handle.input.Close()
+		defer handle.output.Close()
+		handle.SetStatus(http.StatusNotFound)
+		_, err := io.Copy(handle.output, handle.input)
+		return err
+	}
+	for _, media := range []string{"", "body"} {
+		response, err := run(t, Pipeline{notFound, NoOp}, nil, nil, media)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != http.StatusNotFound || response.Body.String() != media {
+			t.Errorf("response = %d %q, want 404 %q", response.Code, response.Body, media)
+		}
+	}
+}
+
+func TestPipelineCopyFilterError(t *testing.T) {
+	refuse := func(ctx context.Context, handle MediaFilterHandle) error {
+		defer handle.input.Close()
+		defer handle.output.Close()
+		return FilterError(handle, http.StatusForbidden, "refused")
+	}
+	response, err := run(t, Pipeline{NoOp, refuse, NoOp}, nil,
+		http.Header{"Etag": {`"1"`}, "Content-Length": {"4"}}, "body")
+	if statusOf(err) != http.StatusForbidden {
+		t.Errorf("error = %v, want a 403 StatusError", err)
+	}
+	if response.Code != http.StatusForbidden || response.Header().Get("ETag") != "" || response.Header().Get("Content-Length") != "" {
+		t.Errorf("response = %d %v, want 403 without the media's headers", response.Code, response.Header())
+	}
+}
+
+// failingReader fails after its content.
+type failingReader struct {
+	io.Reader
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("backend down")
+	}
+	return n, err
+}
+
+func TestGZip(t *testing.T) {
+	response, err := run(t, Pipeline{GZip}, nil, http.Header{"Content-Length": {"11"}}, "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header().Get("Content-Encoding") != "gzip" || response.Header().Get("Content-Length") != "" {
+		t.Errorf("headers = %v, want gzip without Content-Length", response.Header())
+	}
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(reader); err != nil || string(body) != "hello world" {
+		t.Errorf("body = %q, %v, want %q", body, err, "hello world")
+	}
+
+	// a failed read isn't passed off as the end of the media
+	request := httptest.NewRequest(http.MethodGet, "/public/a.txt", nil)
+	_, err = PipelineCopy(context.Background(), httptest.NewRecorder(),
+		failingReader{bytes.NewReader([]byte("hello"))}, request, Pipeline{GZip})
+	if err == nil {
+		t.Error("GZip of a failing read succeeded")
+	}
+}
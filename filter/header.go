@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+)
+
+// Header returns the response headers as this filter passes them on. They
+// start as the headers passed on by the filter before, so the first call
+// waits for that filter to finish its header phase.
+//
+// A filter's header phase ends when it first writes its output, or closes
+// it; changes after that are not seen. So, to change Content-Type,
+// Content-Length, Content-Encoding and the like, a filter changes them
+// before it writes anything.
+func (handle MediaFilterHandle) Header() http.Header {
+	return handle.output.stage.Header()
+}
+
+// SetStatus sets the response status this filter passes on. Like the
+// headers, it must be set before the filter writes its output.
+func (handle MediaFilterHandle) SetStatus(statusCode int) {
+	handle.output.stage.setStatus(statusCode)
+}
+
+// Status returns the response status as this filter passes it on so far,
+// or 0 if none is set yet, which is 200 OK.
+func (handle MediaFilterHandle) Status() int {
+	return handle.output.stage.Status()
+}
+
+// partialContent reports whether the response is part of the media rather
+// than all of it: 206 Partial Content, with a Content-Range for one range
+// or a multipart/byteranges body for several.
+func partialContent(handle MediaFilterHandle) bool {
+	header := handle.Header()
+	if handle.Status() == http.StatusPartialContent || header.Get("Content-Range") != "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "multipart/byteranges"
+}
+
+// headerStage holds the headers and status one filter passes on to the
+// next. The last stage's become the response's.
+type headerStage struct {
+	mu     sync.Mutex
+	prev   *headerStage
+	header http.Header
+	status int
+	// sent and sentStatus are the snapshot passed on, valid once done is
+	// closed
+	sent       http.Header
+	sentStatus int
+	committed  bool
+	done       chan struct{}
+}
+
+// newHeaderStage returns a stage that starts from the headers prev passes
+// on.
+func newHeaderStage(prev *headerStage) *headerStage {
+	return &headerStage{prev: prev, done: make(chan struct{})}
+}
+
+// committedHeaderStage returns a stage that has already passed on header
+// and status, to start a pipeline.
+func committedHeaderStage(header http.Header, status int) *headerStage {
+	s := &headerStage{
+		header:     header,
+		status:     status,
+		sent:       header,
+		sentStatus: status,
+		committed:  true,
+		done:       make(chan struct{}),
+	}
+	close(s.done)
+	return s
+}
+
+// init copies the previous stage's headers, waiting for them if need be.
+// Callers must hold s.mu.
+func (s *headerStage) init() {
+	if s.header != nil {
+		return
+	}
+	<-s.prev.done
+	s.header = s.prev.sent.Clone()
+	s.status = s.prev.sentStatus
+}
+
+func (s *headerStage) Header() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.header
+}
+
+func (s *headerStage) Status() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.status
+}
+
+func (s *headerStage) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if !s.committed {
+		s.status = status
+	}
+}
+
+// commit ends the header phase, passing a snapshot of the headers on.
+func (s *headerStage) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.committed {
+		return
+	}
+	s.init()
+	s.sent = s.header.Clone()
+	s.sentStatus = s.status
+	s.committed = true
+	close(s.done)
+}
+
+// stageWriter is a filter's output. Writing to it, or closing it, ends the
+// filter's header phase.
+type stageWriter struct {
+	*io.PipeWriter
+	stage *headerStage
+}
+
+func (w *stageWriter) Write(p []byte) (int, error) {
+	w.stage.commit()
+	return w.PipeWriter.Write(p)
+}
+
+func (w *stageWriter) Close() error {
+	w.stage.commit()
+	return w.PipeWriter.Close()
+}
+
+func (w *stageWriter) CloseWithError(err error) error {
+	w.stage.commit()
+	return w.PipeWriter.CloseWithError(err)
+}
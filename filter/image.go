@@ -0,0 +1,363 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxImageDimension bounds the width and height of transformed images,
+	// matching the largest images tenants may upload.
+	maxImageDimension = 2048
+	// maxImageBytes bounds the images that are read for transformation.
+	maxImageBytes = 40 << 20
+	// defaultImageQuality is the JPEG quality used unless q is given.
+	defaultImageQuality = 85
+)
+
+// MaxImagePixels bounds the images that are decoded for transformation, by
+// width times height. Decoding takes up to 4 bytes a pixel, so the default
+// of 16 megapixels takes up to 64 MiB per image.
+var MaxImagePixels = 16 << 20
+
+// imageTypes are the Content-Types of the formats images can be decoded
+// from and encoded to, by name.
+var imageTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// ImageTransform describes how to transform an image.
+type ImageTransform struct {
+	// Width and Height bound the result; zero leaves a dimension to follow
+	// from the other.
+	Width, Height int
+	// Fit is "contain" to fit within the bounds, "cover" to fill them and
+	// crop what's outside, or "fill" to stretch to them.
+	Fit string
+	// Quality is the JPEG quality, 1 to 100.
+	Quality int
+	// Format is "jpeg" or "png"; empty keeps the image's format.
+	Format string
+}
+
+// ParseImageTransform reads a transform from the w, h, fit, q and fmt query
+// parameters. ok is false if none of them are given.
+func ParseImageTransform(query url.Values) (transform ImageTransform, ok bool, err error) {
+	transform = ImageTransform{Fit: "contain", Quality: defaultImageQuality}
+	for _, name := range []string{"w", "h", "fit", "q", "fmt"} {
+		if query.Has(name) {
+			ok = true
+		}
+	}
+	if !ok {
+		return transform, false, nil
+	}
+	dimension := func(name string) (int, error) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxImageDimension {
+			return 0, fmt.Errorf("%s must be 1 to %d", name, maxImageDimension)
+		}
+		return n, nil
+	}
+	if transform.Width, err = dimension("w"); err != nil {
+		return transform, true, err
+	}
+	if transform.Height, err = dimension("h"); err != nil {
+		return transform, true, err
+	}
+	if fit := query.Get("fit"); fit != "" {
+		if fit != "contain" && fit != "cover" && fit != "fill" {
+			return transform, true, fmt.Errorf("fit must be contain, cover or fill")
+		}
+		transform.Fit = fit
+	}
+	if q := query.Get("q"); q != "" {
+		if transform.Quality, err = strconv.Atoi(q); err != nil || transform.Quality < 1 || transform.Quality > 100 {
+			return transform, true, fmt.Errorf("q must be 1 to 100")
+		}
+	}
+	if format := query.Get("fmt"); format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if _, known := imageTypes[format]; !known {
+			return transform, true, fmt.Errorf("fmt must be jpeg or png")
+		}
+		transform.Format = format
+	}
+	return transform, true, nil
+}
+
+// String returns the transform in a canonical form, to key cached variants.
+func (t ImageTransform) String() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&q=%d&fmt=%s", t.Width, t.Height, t.Fit, t.Quality, t.Format)
+}
+
+// ResizeImage transforms JPEG and PNG images as the request's w, h, fit, q
+// and fmt query parameters say (see ParseImageTransform). Images are never
+// enlarged, except to fill. Other media, and requests without those
+// parameters, pass through.
+//
+// Transformed images are cached with setter, keyed by the object, its
+// ETag and the transform, and looked up with getter first, so each variant
+// is only computed once. HEAD requests get the variant's headers, with its
+// Content-Length only if it is cached.
+//
+// This is a store-and-forward filter, in that it loads the entire image to
+// transform it.
+func ResizeImage(ctx context.Context, handle MediaFilterHandle, getter CacheGet, setter CacheSet) error {
+	return ResizeImageWith(ctx, handle, nil, getter, setter)
+}
+
+// ImagePresets are the named transforms a tenant offers.
+type ImagePresets struct {
+	// Presets are the transforms, by name.
+	Presets map[string]ImageTransform
+	// Strict refuses transforms other than the presets.
+	Strict bool
+}
+
+// Transform reads the transform a request asks for: the preset named by the
+// preset query parameter, or else the one the w, h, fit, q and fmt
+// parameters give (see ParseImageTransform), which must match a preset if
+// the presets are strict. ok is false if no transform is asked for.
+func (p ImagePresets) Transform(query url.Values) (transform ImageTransform, ok bool, err error) {
+	transform, ok, err = ParseImageTransform(query)
+	if query.Has("preset") {
+		if ok {
+			return transform, true, fmt.Errorf("preset can't be combined with w, h, fit, q or fmt")
+		}
+		name := query.Get("preset")
+		preset, known := p.Presets[name]
+		if !known {
+			return transform, true, fmt.Errorf("unknown preset %q", name)
+		}
+		return preset, true, nil
+	}
+	if !ok || err != nil || !p.Strict {
+		return transform, ok, err
+	}
+	for _, preset := range p.Presets {
+		if transform == preset {
+			return transform, true, nil
+		}
+	}
+	return transform, true, fmt.Errorf("only presets are allowed")
+}
+
+// ImageTransformRequested reports whether query asks for an image transform,
+// valid or not. Transforms need the whole image, so the Range of such
+// requests should be dropped before the object is read.
+func ImageTransformRequested(query url.Values) bool {
+	_, ok, _ := ImagePresets{}.Transform(query)
+	return ok
+}
+
+// ResizeImageWith is ResizeImage, also offering the presets of the
+// request's tenant (the x-lpse-id header), by tenant. Tenants without
+// presets get ResizeImage.
+//
+// This function should be called from a lambda that applies desired
+// presets, getter and setter, leaving only ctx and handle for use as a
+// MediaFilter.
+func ResizeImageWith(ctx context.Context, handle MediaFilterHandle, presets map[string]ImagePresets,
+	getter CacheGet, setter CacheSet) error {
+	tenantPresets := presets[handle.request.Header.Get("x-lpse-id")]
+	transform, ok, err := tenantPresets.Transform(handle.request.URL.Query())
+	if !ok {
+		return NoOp(ctx, handle)
+	}
+	return applyImageTransform(ctx, handle, transform, err, getter, setter)
+}
+
+// TransformImage applies transform to JPEG and PNG images; other media
+// passes through. Variants are cached as with ResizeImage.
+func TransformImage(ctx context.Context, handle MediaFilterHandle, transform ImageTransform,
+	getter CacheGet, setter CacheSet) error {
+	return applyImageTransform(ctx, handle, transform, nil, getter, setter)
+}
+
+// applyImageTransform applies transform to JPEG and PNG images; other media
+// passes through. If parseErr is set, the transform was invalid, and images
+// are refused with 400 Bad Request.
+func applyImageTransform(ctx context.Context, handle MediaFilterHandle, transform ImageTransform,
+	parseErr error, getter CacheGet, setter CacheSet) error {
+	header := handle.Header()
+	sourceFormat := imageFormat(header.Get("Content-Type"))
+	if sourceFormat == "" || header.Get("Content-Encoding") != "" {
+		return NoOp(ctx, handle)
+	}
+	defer handle.input.Close()
+	defer handle.output.Close()
+	if parseErr != nil {
+		return FilterError(handle, http.StatusBadRequest, "image filter: %v", parseErr)
+	}
+	// the whole image is needed; requests that transform images shouldn't
+	// ask for ranges (see ImageTransformRequested)
+	if partialContent(handle) {
+		return FilterError(handle, http.StatusRequestedRangeNotSatisfiable,
+			"image filter: ranges of images can't be transformed")
+	}
+	if transform.Format == "" {
+		transform.Format = sourceFormat
+	}
+	key := fmt.Sprintf("%s?%s#%s",
+		common.NormalizePath(handle.request.Header.Get("x-lpse-id"), handle.request.URL.Path),
+		transform, header.Get("Etag"))
+	head := handle.request.Method == http.MethodHead
+	variant, hit := getter(key)
+	switch {
+	case hit:
+		log.Debug().Msgf("image filter: variant cache hit for %q", key)
+	case head:
+		// there is no image to transform; the variant is described as far
+		// as it's known without it
+	default:
+		data, err := io.ReadAll(io.LimitReader(handle.input, maxImageBytes+1))
+		if err != nil {
+			return fmt.Errorf("image filter: %w", err)
+		}
+		if len(data) > maxImageBytes {
+			return FilterError(handle, http.StatusInternalServerError, "image filter: image larger than %d bytes", maxImageBytes)
+		}
+		if variant, err = renderImage(data, transform); err != nil {
+			return FilterError(handle, http.StatusInternalServerError, "image filter: %v", err)
+		}
+		if expiration, ok := cacheExpiration(handle); ok {
+			setter(key, variant, expiration)
+		}
+	}
+	header.Set("Content-Type", imageTypes[transform.Format])
+	if hit || !head {
+		header.Set("Content-Length", fmt.Sprint(len(variant)))
+	} else {
+		header.Del("Content-Length")
+	}
+	// ranges would be of the object, not the variant
+	header.Del("Accept-Ranges")
+	weakenETag(header)
+	if head {
+		return nil
+	}
+	if _, err := handle.output.Write(variant); err != nil {
+		return fmt.Errorf("image filter: %w", err)
+	}
+	return nil
+}
+
+// imageFormat returns the name of the image format of a Content-Type, or ""
+// if it isn't one that can be transformed.
+func imageFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/jpeg", "image/jpg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	}
+	return ""
+}
+
+// renderImage decodes an image, transforms it, and encodes the result.
+func renderImage(data []byte, transform ImageTransform) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d is too large to transform", config.Width, config.Height)
+	}
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	size, crop := transform.layout(source.Bounds())
+	result := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	op := draw.Src
+	if transform.Format == "jpeg" {
+		// JPEG has no transparency; show it against white
+		draw.Draw(result, result.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	draw.CatmullRom.Scale(result, result.Bounds(), source, crop, op, nil)
+
+	encoded := new(bytes.Buffer)
+	if transform.Format == "png" {
+		err = png.Encode(encoded, result)
+	} else {
+		err = jpeg.Encode(encoded, result, &jpeg.Options{Quality: transform.Quality})
+	}
+	return encoded.Bytes(), err
+}
+
+// layout returns the size of the transformed image, and the part of the
+// source image (bounds) it shows.
+func (t ImageTransform) layout(bounds image.Rectangle) (size image.Point, crop image.Rectangle) {
+	sourceW, sourceH := float64(bounds.Dx()), float64(bounds.Dy())
+	width, height := float64(t.Width), float64(t.Height)
+	crop = bounds
+	switch {
+	case t.Fit == "fill":
+		if width == 0 {
+			width = sourceW
+		}
+		if height == 0 {
+			height = sourceH
+		}
+	case t.Fit == "cover" && width > 0 && height > 0:
+		// the largest part of the source with the aspect ratio of the bounds
+		cropW, cropH := sourceW, sourceW*height/width
+		if cropH > sourceH {
+			cropW, cropH = sourceH*width/height, sourceH
+		}
+		offset := image.Pt(int((sourceW-cropW)/2), int((sourceH-cropH)/2))
+		crop = image.Rectangle{Min: bounds.Min.Add(offset), Max: bounds.Min.Add(offset).Add(image.Pt(int(cropW), int(cropH)))}
+		scale := math.Min(1, width/cropW)
+		width, height = cropW*scale, cropH*scale
+	default:
+		// contain, or cover with only one bound
+		scale := 1.0
+		if width > 0 {
+			scale = math.Min(scale, width/sourceW)
+		}
+		if height > 0 {
+			scale = math.Min(scale, height/sourceH)
+		}
+		width, height = sourceW*scale, sourceH*scale
+	}
+	size = image.Pt(int(math.Max(1, math.Round(width))), int(math.Max(1, math.Round(height))))
+	return size, crop
+}
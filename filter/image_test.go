@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testPNG returns a PNG image of width by height.
+func testPNG(t *testing.T, width, height int) string {
+	t.Helper()
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.String()
+}
+
+// resize is ResizeImage without a cache.
+func resize(ctx context.Context, handle MediaFilterHandle) error {
+	return ResizeImage(ctx, handle, func(string) ([]byte, bool) { return nil, false }, func(string, []byte, time.Duration) {})
+}
+
+func TestResizeImage(t *testing.T) {
+	source := testPNG(t, 40, 20)
+	request := httptest.NewRequest(http.MethodGet, "/public/a.png?w=10", nil)
+	header := http.Header{"Content-Type": {"image/png"}, "Accept-Ranges": {"bytes"}, "Etag": {`"1"`}}
+	response, err := run(t, Pipeline{resize}, request, header, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, format, err := image.DecodeConfig(response.Body)
+	if err != nil || format != "png" || config.Width != 10 || config.Height != 5 {
+		t.Errorf("image = %s %dx%d, %v, want png 10x5", format, config.Width, config.Height, err)
+	}
+	if response.Header().Get("Accept-Ranges") != "" || response.Header().Get("ETag") != `W/"1"` {
+		t.Errorf("headers = %v, want no Accept-Ranges and a weak ETag", response.Header())
+	}
+}
+
+func TestResizeImageRange(t *testing.T) {
+	// a range of an image can't be transformed; it isn't sent as it is
+	request := httptest.NewRequest(http.MethodGet, "/public/a.png?w=10", nil)
+	header := http.Header{"Content-Type": {"image/png"}, "Content-Range": {"bytes 0-9/100"}}
+	response, err := run(t, Pipeline{resize}, request, header, testPNG(t, 40, 20)[:10])
+	if statusOf(err) != http.StatusRequestedRangeNotSatisfiable || response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("response = %d, %v, want 416", response.Code, err)
+	}
+	if got := response.Header().Get("Content-Range"); got != "bytes */100" {
+		t.Errorf("Content-Range = %q, want bytes */100", got)
+	}
+}
+
+func TestResizeImageHEAD(t *testing.T) {
+	variants := map[string][]byte{}
+	cached := func(ctx context.Context, handle MediaFilterHandle) error {
+		return ResizeImage(ctx, handle, func(key string) ([]byte, bool) {
+			variant, ok := variants[key]
+			return variant, ok
+		}, func(key string, variant []byte, expiration time.Duration) {
+			variants[key] = variant
+		})
+	}
+	header := func() http.Header {
+		return http.Header{"Content-Type": {"image/png"}, "Content-Length": {"1000"},
+			"Accept-Ranges": {"bytes"}, "Etag": {`"1"`}, "Cache-Control": {"public, max-age=60"}}
+	}
+	head := httptest.NewRequest(http.MethodHead, "/public/a.png?w=10&fmt=jpeg", nil)
+
+	// HEAD has no image to transform, so the variant's length isn't known
+	response, err := run(t, Pipeline{cached}, head, header(), "")
+	if err != nil || response.Code != http.StatusOK {
+		t.Fatalf("HEAD before GET = %d, %v, want 200", response.Code, err)
+	}
+	got := response.Header()
+	if got.Get("Content-Type") != "image/jpeg" || got.Get("Content-Length") != "" ||
+		got.Get("Accept-Ranges") != "" || got.Get("Etag") != `W/"1"` || len(variants) != 0 {
+		t.Errorf("HEAD before GET: headers = %v, %d variants cached; want the variant's, without a length", got, len(variants))
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/public/a.png?w=10&fmt=jpeg", nil)
+	response, err = run(t, Pipeline{cached}, get, header(), testPNG(t, 40, 20))
+	if err != nil || len(variants) != 1 {
+		t.Fatalf("GET = %d, %v, %d variants cached", response.Code, err, len(variants))
+	}
+	length := response.Header().Get("Content-Length")
+
+	// once it's cached, its length is
+	response, err = run(t, Pipeline{cached}, head, header(), "")
+	if err != nil || response.Code != http.StatusOK || response.Body.Len() != 0 {
+		t.Fatalf("HEAD after GET = %d, %v, %d bytes", response.Code, err, response.Body.Len())
+	}
+	if got := response.Header(); got.Get("Content-Type") != "image/jpeg" || got.Get("Content-Length") != length {
+		t.Errorf("HEAD after GET: headers = %v, want the variant's, with Content-Length %s", got, length)
+	}
+
+	// invalid transforms are refused alike
+	bad := httptest.NewRequest(http.MethodHead, "/public/a.png?w=abc", nil)
+	if response, _ := run(t, Pipeline{cached}, bad, header(), ""); response.Code != http.StatusBadRequest {
+		t.Errorf("HEAD with an invalid transform = %d, want 400", response.Code)
+	}
+}
+
+func TestResizeImageTooLarge(t *testing.T) {
+	defer func(pixels int) { MaxImagePixels = pixels }(MaxImagePixels)
+	MaxImagePixels = 100
+	request := httptest.NewRequest(http.MethodGet, "/public/a.png?w=5", nil)
+	response, err := run(t, Pipeline{resize}, request, http.Header{"Content-Type": {"image/png"}}, testPNG(t, 20, 20))
+	if err == nil || response.Code != http.StatusInternalServerError {
+		t.Errorf("response = %d, %v, want 500", response.Code, err)
+	}
+}
+
+func TestImageTransformRequested(t *testing.T) {
+	tests := map[string]bool{
+		"":                 false,
+		"download=1":       false,
+		"w=100":            true,
+		"fmt=png&q=50":     true,
+		"w=abc":            true,
+		"preset=thumbnail": true,
+	}
+	for query, want := range tests {
+		values, _ := url.ParseQuery(query)
+		if got := ImageTransformRequested(values); got != want {
+			t.Errorf("ImageTransformRequested(%q) = %v, want %v", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	jpegMagic = []byte{0xFF, 0xD8}
+	pngMagic  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+)
+
+// errMalformedImage is returned when an image can't be parsed far enough to
+// find its metadata. The response is aborted rather than sent with it.
+var errMalformedImage = errors.New("malformed image")
+
+// StripMetadata removes metadata that may identify where, when or with what
+// a photo was taken from JPEG and PNG images: EXIF, XMP, IPTC, comments and
+// text chunks, and embedded ICC color profiles. Images are recognized by
+// their content, whatever their Content-Type; other media passes through.
+//
+// The image data itself is copied as is, as it streams, so this doesn't
+// decode or re-encode images. Partial responses are refused, whatever their
+// Content-Type, since an image in one could be neither recognized nor
+// stripped; requests should be for the whole media (see NeedsWholeMedia).
+// Accept-Ranges is not sent for images.
+func StripMetadata(ctx context.Context, handle MediaFilterHandle) error {
+	return StripMetadataWith(ctx, handle, false)
+}
+
+// StripMetadataWith is StripMetadata, keeping ICC color profiles if
+// keepColorProfile is set; they rarely identify anyone, and images of wide
+// gamut look wrong without them.
+//
+// This function should be called from a lambda that applies the desired
+// option, leaving only ctx and handle for use as a MediaFilter.
+func StripMetadataWith(ctx context.Context, handle MediaFilterHandle, keepColorProfile bool) error {
+	defer handle.input.Close()
+	defer handle.output.Close()
+	header := handle.Header()
+	if partialContent(handle) {
+		return FilterError(handle, http.StatusRequestedRangeNotSatisfiable,
+			"metadata filter: ranges of media can't be stripped of metadata")
+	}
+
+	var media io.Reader = handle.input
+	if stored := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))); stored != "" {
+		// only images are decoded, to look inside
+		decode, known := decoders[stored]
+		if imageFormat(header.Get("Content-Type")) == "" || !known {
+			return copyMedia(handle.output, media)
+		}
+		decoder, err := decode(media)
+		if err != nil {
+			return FilterError(handle, http.StatusInternalServerError, "metadata filter: decoding %s: %v", stored, err)
+		}
+		defer decoder.Close()
+		media = decoder
+	}
+	reader := bufio.NewReader(media)
+	magic, _ := reader.Peek(len(pngMagic))
+	var strip func(*bufio.Reader, io.Writer, bool) error
+	switch {
+	case bytes.HasPrefix(magic, jpegMagic):
+		strip = stripJPEG
+	case bytes.Equal(magic, pngMagic):
+		strip = stripPNG
+	default:
+		if media != io.Reader(handle.input) {
+			header.Del("Content-Encoding")
+			header.Del("Content-Length")
+			weakenETag(header)
+		}
+		return copyMedia(handle.output, reader)
+	}
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	weakenETag(header)
+	if err := strip(reader, handle.output, keepColorProfile); err != nil {
+		return fmt.Errorf("metadata filter: %w", err)
+	}
+	return nil
+}
+
+// stripJPEG copies a JPEG image without its APP1 to APP13 and APP15
+// segments, where EXIF, XMP, ICC profiles and IPTC data are kept, and its
+// comments. APP0 (JFIF) and APP14 (Adobe) describe how to decode the image,
+// so they are kept, as is APP2 if keepColorProfile is set. Everything from
+// the first scan on is copied as is.
+func stripJPEG(r *bufio.Reader, w io.Writer, keepColorProfile bool) error {
+	if _, err := io.CopyN(w, r, int64(len(jpegMagic))); err != nil {
+		return err
+	}
+	for {
+		if b, err := r.ReadByte(); err != nil || b != 0xFF {
+			return errMalformedImage
+		}
+		marker := byte(0xFF)
+		var err error
+		for marker == 0xFF {
+			// markers may be padded with any number of 0xFF
+			if marker, err = r.ReadByte(); err != nil {
+				return errMalformedImage
+			}
+		}
+		if marker == 0xD9 {
+			// EOI, without a scan
+			_, err := w.Write([]byte{0xFF, marker})
+			return err
+		}
+		if marker == 0x01 || marker >= 0xD0 && marker <= 0xD7 {
+			// TEM and RSTn have no length
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return errMalformedImage
+		}
+		size := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if size < 0 {
+			return errMalformedImage
+		}
+		if jpegMetadata(marker, keepColorProfile) {
+			if _, err := r.Discard(int(size)); err != nil {
+				return errMalformedImage
+			}
+			continue
+		}
+		if _, err := w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+		if marker == 0xDA {
+			// SOS; the entropy-coded image data follows
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+// jpegMetadata reports whether segments with marker hold metadata.
+func jpegMetadata(marker byte, keepColorProfile bool) bool {
+	switch {
+	case marker == 0xFE:
+		// COM
+		return true
+	case marker == 0xE2:
+		return !keepColorProfile
+	case marker >= 0xE1 && marker <= 0xED, marker == 0xEF:
+		return true
+	}
+	return false
+}
+
+// pngMetadataChunks are the types of PNG chunks that hold metadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true, // XMP is kept in iTXt
+	"tIME": true,
+}
+
+// stripPNG copies a PNG image without its metadata chunks, and its iCCP
+// chunk unless keepColorProfile is set.
+func stripPNG(r *bufio.Reader, w io.Writer, keepColorProfile bool) error {
+	if _, err := io.CopyN(w, r, int64(len(pngMagic))); err != nil {
+		return err
+	}
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return errMalformedImage
+		}
+		// the data, then the CRC
+		size := int64(binary.BigEndian.Uint32(chunk[:4])) + 4
+		chunkType := string(chunk[4:])
+		if pngMetadataChunks[chunkType] || chunkType == "iCCP" && !keepColorProfile {
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return errMalformedImage
+			}
+			continue
+		}
+		if _, err := w.Write(chunk[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
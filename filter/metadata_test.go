@@ -0,0 +1,206 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// jpegSegment returns a JPEG segment with marker and data.
+func jpegSegment(marker byte, data string) string {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(data)+2))
+	return string([]byte{0xFF, marker}) + string(length[:]) + data
+}
+
+// pngChunk returns a PNG chunk of chunkType with data.
+func pngChunk(chunkType, data string) string {
+	var length, crc [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE([]byte(chunkType+data)))
+	return string(length[:]) + chunkType + data + string(crc[:])
+}
+
+// testJPEG returns a JPEG image, as Go encodes it: with no metadata.
+func testJPEG(t *testing.T) string {
+	t.Helper()
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.String()
+}
+
+func TestStripJPEG(t *testing.T) {
+	plain := testJPEG(t)
+	jfif := jpegSegment(0xE0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	icc := jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile")
+	adobe := jpegSegment(0xEE, "Adobe\x00\x64\x00\x00\x00\x00\x01")
+	metadata := jpegSegment(0xE1, "Exif\x00\x00GPS 52.37N 4.89E") +
+		jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>") +
+		jpegSegment(0xED, "Photoshop 3.0\x008BIM IPTC") +
+		jpegSegment(0xEF, "APP15") +
+		// markers may be padded with 0xFF
+		"\xFF" + jpegSegment(0xFE, "shot by someone")
+	// the metadata goes after SOI, among segments that are kept
+	withMetadata := plain[:2] + jfif + metadata + icc + adobe + plain[2:]
+
+	for _, test := range []struct {
+		keepColorProfile bool
+		want             string
+	}{
+		{false, plain[:2] + jfif + adobe + plain[2:]},
+		{true, plain[:2] + jfif + icc + adobe + plain[2:]},
+	} {
+		stripped := new(bytes.Buffer)
+		if err := stripJPEG(bufio.NewReader(strings.NewReader(withMetadata)), stripped, test.keepColorProfile); err != nil {
+			t.Fatal(err)
+		}
+		if stripped.String() != test.want {
+			t.Errorf("keepColorProfile %v: stripped %d bytes to %d, want %d", test.keepColorProfile,
+				len(withMetadata), stripped.Len(), len(test.want))
+		}
+		if _, err := jpeg.Decode(stripped); err != nil {
+			t.Errorf("keepColorProfile %v: stripped image doesn't decode: %v", test.keepColorProfile, err)
+		}
+	}
+
+	// what follows the first scan, like a second image, is image data
+	trailing := plain + jpegSegment(0xE1, "Exif\x00\x00")
+	stripped := new(bytes.Buffer)
+	if err := stripJPEG(bufio.NewReader(strings.NewReader(trailing)), stripped, false); err != nil || stripped.String() != trailing {
+		t.Errorf("data after the scan: %v, or changed", err)
+	}
+
+	for name, malformed := range map[string]string{
+		"truncated length":  plain[:2] + "\xFF\xE1\x00",
+		"truncated segment": plain[:2] + "\xFF\xE1\x00\x20Exif",
+		"short length":      plain[:2] + "\xFF\xE1\x00\x01",
+		"not a marker":      plain[:2] + "\x00\xE1",
+		"no EOI":            plain[:2],
+	} {
+		if err := stripJPEG(bufio.NewReader(strings.NewReader(malformed)), new(bytes.Buffer), false); err != errMalformedImage {
+			t.Errorf("%s: %v, want %v", name, err, errMalformedImage)
+		}
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	plain := testPNG(t, 16, 8)
+	// the signature, then IHDR, whose 13 bytes of data make it 25 bytes
+	head, rest := plain[:8+25], plain[8+25:]
+	gamma := pngChunk("gAMA", "\x00\x00\xB1\x8F")
+	icc := pngChunk("iCCP", "profile\x00\x00compressed")
+	metadata := pngChunk("tEXt", "Author\x00someone") +
+		pngChunk("zTXt", "Comment\x00\x00compressed") +
+		pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>") +
+		pngChunk("eXIf", "MM\x00\x2A GPS") +
+		pngChunk("tIME", "\x07\xEA\x0A\x12\x0C\x00\x00")
+	withMetadata := head + metadata + gamma + icc + rest
+
+	for _, test := range []struct {
+		keepColorProfile bool
+		want             string
+	}{
+		{false, head + gamma + rest},
+		{true, head + gamma + icc + rest},
+	} {
+		stripped := new(bytes.Buffer)
+		if err := stripPNG(bufio.NewReader(strings.NewReader(withMetadata)), stripped, test.keepColorProfile); err != nil {
+			t.Fatal(err)
+		}
+		if stripped.String() != test.want {
+			t.Errorf("keepColorProfile %v: stripped %d bytes to %d, want %d", test.keepColorProfile,
+				len(withMetadata), stripped.Len(), len(test.want))
+		}
+		if _, err := png.Decode(stripped); err != nil {
+			t.Errorf("keepColorProfile %v: stripped image doesn't decode: %v", test.keepColorProfile, err)
+		}
+	}
+
+	for name, malformed := range map[string]string{
+		"truncated chunk header": head + "\x00\x00\x00",
+		"truncated metadata":     head + pngChunk("tEXt", "Author\x00someone")[:12],
+		"no IEND":                head,
+	} {
+		if err := stripPNG(bufio.NewReader(strings.NewReader(malformed)), new(bytes.Buffer), false); err != errMalformedImage {
+			t.Errorf("%s: %v, want %v", name, err, errMalformedImage)
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	plain := testPNG(t, 16, 8)
+	withMetadata := plain[:33] + pngChunk("tEXt", "Author\x00someone") + plain[33:]
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(withMetadata))
+	writer.Close()
+	multipart := "--b\r\nContent-Type: image/png\r\nContent-Range: bytes 0-32/100\r\n\r\n" + plain[:33] + "\r\n--b--\r\n"
+
+	for _, test := range []struct {
+		name     string
+		pipeline Pipeline
+		header   http.Header
+		media    string
+		status   int
+		want     string
+	}{
+		{"png", Pipeline{StripMetadata}, http.Header{"Content-Type": {"image/png"}}, withMetadata, http.StatusOK, plain},
+		// images are recognized by their content
+		{"mistyped", Pipeline{StripMetadata}, http.Header{"Content-Type": {"text/plain"}}, withMetadata, http.StatusOK, plain},
+		{"gzipped", Pipeline{StripMetadata}, http.Header{"Content-Type": {"image/png"}, "Content-Encoding": {"gzip"}},
+			gzipped.String(), http.StatusOK, plain},
+		{"text", Pipeline{StripMetadata}, http.Header{"Content-Type": {"text/plain"}}, "Exif", http.StatusOK, "Exif"},
+		// partial responses are refused, whatever they claim to be
+		{"range of an image", Pipeline{StripMetadata},
+			http.Header{"Content-Type": {"image/png"}, "Content-Range": {"bytes 33-99/100"}}, plain[33:], http.StatusRequestedRangeNotSatisfiable, ""},
+		{"range of text", Pipeline{StripMetadata},
+			http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 33-99/100"}}, plain[33:], http.StatusRequestedRangeNotSatisfiable, ""},
+		{"several ranges", Pipeline{withStatus(http.StatusPartialContent), StripMetadata},
+			http.Header{"Content-Type": {"multipart/byteranges; boundary=b"}}, multipart, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"multipart without a status", Pipeline{StripMetadata},
+			http.Header{"Content-Type": {"multipart/byteranges; boundary=b"}}, multipart, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"206 alone", Pipeline{withStatus(http.StatusPartialContent), StripMetadata},
+			http.Header{"Content-Type": {"application/octet-stream"}}, plain, http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		response, _ := run(t, test.pipeline, nil, test.header, test.media)
+		if response.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, response.Code, test.status)
+			continue
+		}
+		if test.status == http.StatusOK && response.Body.String() != test.want {
+			t.Errorf("%s: sent %d bytes, want %d", test.name, response.Body.Len(), len(test.want))
+		}
+	}
+
+	// stripped images are sent without their length, encoding or ranges
+	header := http.Header{"Content-Type": {"image/png"}, "Content-Encoding": {"gzip"},
+		"Content-Length": {"1000"}, "Accept-Ranges": {"bytes"}, "Etag": {`"1"`}}
+	response, _ := run(t, Pipeline{StripMetadata}, nil, header, gzipped.String())
+	if got := response.Header(); got.Get("Content-Encoding") != "" || got.Get("Content-Length") != "" ||
+		got.Get("Accept-Ranges") != "" || got.Get("Etag") != `W/"1"` {
+		t.Errorf("headers = %v", got)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultRedactMask replaces redacted matches, unless another mask is
+	// given.
+	DefaultRedactMask = "[REDACTED]"
+	// DefaultRedactWindow is the longest match Redact is sure to find,
+	// unless another window is given.
+	DefaultRedactWindow = 256
+	// redactChunkSize is how much media is read at a time.
+	redactChunkSize = 64 << 10
+)
+
+// RedactPattern is a pattern to redact, named for its match counter.
+type RedactPattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+}
+
+// RedactPatterns are patterns for common personal data, by name.
+var RedactPatterns = map[string]*regexp.Regexp{
+	// US Social Security numbers
+	"ssn": regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+	// Indonesian identity card numbers (Nomor Induk Kependudukan)
+	"nik": regexp.MustCompile(`\b[1-9]\d{15}\b`),
+	// Indonesian tax numbers, formatted or not
+	"npwp":  regexp.MustCompile(`\b\d{2}\.\d{3}\.\d{3}\.\d-\d{3}\.\d{3}\b|\b\d{15}\b`),
+	"email": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	// Indonesian mobile numbers, and North American numbers
+	"phone": regexp.MustCompile(`(?:\+62|\b62|\b0)8\d{1,2}[- .]?\d{3,4}[- .]?\d{3,5}\b|` +
+		`(?:\+1[- .]?)?(?:\(\d{3}\)|\b\d{3})[- .]\d{3}[- .]\d{4}\b`),
+}
+
+// redactions counts the matches redacted, by pattern name.
+var redactions = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: map[string]uint64{}}
+
+// Redactions returns how many matches of each pattern have been redacted,
+// by pattern name, since the process started.
+func Redactions() map[string]uint64 {
+	redactions.Lock()
+	defer redactions.Unlock()
+	counts := make(map[string]uint64, len(redactions.counts))
+	for name, count := range redactions.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// Redact replaces matches of patterns in the media with mask, as it
+// streams. Where matches of different patterns overlap, the text they cover
+// together is masked once, counted as a match of each.
+//
+// The media is scanned with window bytes held back, so a match up to window
+// bytes long is found even if it spans the chunks media is read in, and no
+// byte of a match is sent before it is found. Longer matches may be missed,
+// or sent in part.
+//
+// Media stored with a Content-Encoding is decoded to be scanned. Since the
+// length of the media changes, Content-Length and Accept-Ranges are dropped.
+// Ranges of the media are refused, since a match may span two of them;
+// requests should be for the whole media (see NeedsWholeMedia).
+//
+// This function should be called from a lambda that applies the desired
+// patterns, mask and window, leaving only ctx and handle for use as a
+// MediaFilter.
+func Redact(ctx context.Context, handle MediaFilterHandle, patterns []RedactPattern, mask string, window int) error {
+	defer handle.input.Close()
+	defer handle.output.Close()
+	header := handle.Header()
+	if header.Get("Content-Range") != "" {
+		return FilterError(handle, http.StatusRequestedRangeNotSatisfiable, "redact filter: ranges can't be scanned")
+	}
+	var media io.Reader = handle.input
+	if stored := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))); stored != "" {
+		decode, known := decoders[stored]
+		if !known {
+			return FilterError(handle, http.StatusInternalServerError, "redact filter: can't scan %s encoded media", stored)
+		}
+		decoder, err := decode(media)
+		if err != nil {
+			return FilterError(handle, http.StatusInternalServerError, "redact filter: decoding %s: %v", stored, err)
+		}
+		defer decoder.Close()
+		media = decoder
+		header.Del("Content-Encoding")
+	}
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	weakenETag(header)
+
+	counts := map[string]uint64{}
+	defer func() {
+		if len(counts) == 0 {
+			return
+		}
+		log.Info().Msgf("redact filter: redacted %v", counts)
+		redactions.Lock()
+		for name, count := range counts {
+			redactions.counts[name] += count
+		}
+		redactions.Unlock()
+	}()
+
+	// buffer holds the media not sent yet, from sent on, after a few bytes
+	// that were, so patterns can tell where words begin
+	buffer := make([]byte, 0, redactChunkSize+window+utf8.UTFMax)
+	sent := 0
+	for eof := false; !eof; {
+		n, err := io.ReadFull(media, buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return fmt.Errorf("redact filter: %w", err)
+		}
+		// matches starting in the last window bytes may not be whole yet
+		limit := len(buffer)
+		if !eof {
+			limit -= window
+		}
+		for _, span := range redactSpans(buffer, sent, patterns) {
+			if span.start >= limit {
+				break
+			}
+			if _, err := handle.output.Write(buffer[sent:span.start]); err != nil {
+				return fmt.Errorf("redact filter: %w", err)
+			}
+			if _, err := io.WriteString(handle.output, mask); err != nil {
+				return fmt.Errorf("redact filter: %w", err)
+			}
+			for _, name := range span.names {
+				counts[name]++
+			}
+			sent = span.end
+		}
+		if sent < limit {
+			if _, err := handle.output.Write(buffer[sent:limit]); err != nil {
+				return fmt.Errorf("redact filter: %w", err)
+			}
+			sent = limit
+		}
+		// keep what isn't sent, and a little context
+		keep := sent - utf8.UTFMax
+		if keep < 0 {
+			keep = 0
+		}
+		buffer = buffer[:copy(buffer, buffer[keep:])]
+		sent -= keep
+	}
+	return nil
+}
+
+// redactSpan is a part of the media to mask, and the patterns that matched
+// it.
+type redactSpan struct {
+	start, end int
+	names      []string
+}
+
+// redactSpans returns the matches of patterns in buffer that end after
+// from, in order, with overlapping matches merged.
+func redactSpans(buffer []byte, from int, patterns []RedactPattern) []redactSpan {
+	var spans []redactSpan
+	for _, pattern := range patterns {
+		for _, match := range pattern.Regexp.FindAllIndex(buffer, -1) {
+			if match[1] <= from || match[1] == match[0] {
+				continue
+			}
+			// a match that began in what was sent is masked from there
+			if match[0] < from {
+				match[0] = from
+			}
+			spans = append(spans, redactSpan{match[0], match[1], []string{pattern.Name}})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	merged := spans[:0]
+	for _, span := range spans {
+		if last := len(merged) - 1; last >= 0 && span.start < merged[last].end {
+			if span.end > merged[last].end {
+				merged[last].end = span.end
+			}
+			merged[last].names = append(merged[last].names, span.names...)
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// redactWith returns Redact as a MediaFilter, for the named patterns.
+func redactWith(t *testing.T, names ...string) MediaFilter {
+	t.Helper()
+	var patterns []RedactPattern
+	for _, name := range names {
+		pattern, ok := RedactPatterns[name]
+		if !ok {
+			t.Fatalf("no pattern %q", name)
+		}
+		patterns = append(patterns, RedactPattern{Name: name, Regexp: pattern})
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return Redact(ctx, handle, patterns, DefaultRedactMask, DefaultRedactWindow)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	response, err := run(t, Pipeline{redactWith(t, "ssn", "email")}, nil,
+		http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"99"}, "Accept-Ranges": {"bytes"}, "Etag": {`"1"`}},
+		"SSN 123-45-6789, mail ana@example.co.id, not 123-456-789.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SSN [REDACTED], mail [REDACTED], not 123-456-789."; response.Body.String() != want {
+		t.Errorf("body = %q, want %q", response.Body, want)
+	}
+	header := response.Header()
+	if header.Get("Content-Length") != "" || header.Get("Accept-Ranges") != "" || header.Get("ETag") != `W/"1"` {
+		t.Errorf("headers = %v, want no Content-Length or Accept-Ranges, and a weak ETag", header)
+	}
+}
+
+func TestRedactAcrossReads(t *testing.T) {
+	// matches are found wherever the media is split into chunks
+	for _, offset := range []int{-11, -6, -1, 0, 1} {
+		prefix := strings.Repeat("x ", (redactChunkSize+offset)/2) + strings.Repeat("x", (redactChunkSize+offset)%2)
+		media := prefix + " 123-45-6789 " + strings.Repeat("y", 100)
+		response, err := run(t, Pipeline{redactWith(t, "ssn")}, nil, http.Header{"Content-Type": {"text/plain"}}, media)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := prefix + " [REDACTED] " + strings.Repeat("y", 100); response.Body.String() != want {
+			t.Errorf("offset %d: match at %d not redacted", offset, len(prefix)+1)
+		}
+	}
+}
+
+func TestRedactCounts(t *testing.T) {
+	before := Redactions()
+	media := "a@example.com 123-45-6789 b@example.com; 1234567890123456 987-65-4321"
+	if _, err := run(t, Pipeline{redactWith(t, "ssn", "email", "nik")}, nil, http.Header{"Content-Type": {"text/plain"}}, media); err != nil {
+		t.Fatal(err)
+	}
+	after := Redactions()
+	for name, want := range map[string]uint64{"ssn": 2, "email": 2, "nik": 1, "phone": 0} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s counted %d more, want %d", name, got, want)
+		}
+	}
+}
+
+func TestRedactOverlapping(t *testing.T) {
+	// text matched by two patterns is masked once, and counted for both
+	patterns := []RedactPattern{
+		{Name: "test-digits", Regexp: regexp.MustCompile(`\d{4}`)},
+		{Name: "test-code", Regexp: regexp.MustCompile(`AB\d{2}`)},
+	}
+	before := Redactions()
+	redact := func(ctx context.Context, handle MediaFilterHandle) error {
+		return Redact(ctx, handle, patterns, "#", DefaultRedactWindow)
+	}
+	response, err := run(t, Pipeline{redact}, nil, http.Header{"Content-Type": {"text/plain"}}, "code AB1234 end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Body.String() != "code # end" {
+		t.Errorf("body = %q, want %q", response.Body, "code # end")
+	}
+	after := Redactions()
+	if after["test-digits"]-before["test-digits"] != 1 || after["test-code"]-before["test-code"] != 1 {
+		t.Errorf("counts = %v, want one match of each", after)
+	}
+}
+
+func TestRedactGzip(t *testing.T) {
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte("call 0812-3456-7890 now"))
+	gz.Close()
+	response, err := run(t, Pipeline{redactWith(t, "phone")}, nil,
+		http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, compressed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header().Get("Content-Encoding") != "" || response.Body.String() != "call [REDACTED] now" {
+		t.Errorf("response = %v %q, want it decoded and redacted", response.Header(), response.Body)
+	}
+}
+
+func TestRedactRange(t *testing.T) {
+	// a range may hold half a match; it's refused rather than sent as it is
+	response, err := run(t, Pipeline{redactWith(t, "ssn")}, nil,
+		http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-5/20"}}, "SSN 12")
+	if statusOf(err) != http.StatusRequestedRangeNotSatisfiable || response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("response = %d, %v, want 416", response.Code, err)
+	}
+	if strings.Contains(response.Body.String(), "12") {
+		t.Errorf("body = %q, want none of the media", response.Body)
+	}
+}
+
+func TestNeedsWholeMedia(t *testing.T) {
+	for name, want := range map[string]bool{"redact": true, "block_regex": true, "strip_metadata": true, "compress": false, "log": false} {
+		if got := NeedsWholeMedia(name); got != want {
+			t.Errorf("NeedsWholeMedia(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
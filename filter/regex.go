@@ -16,6 +16,7 @@ package filter
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"regexp"
@@ -40,10 +41,13 @@ import (
 // and so on.
 //
 // Partial responses may be sent, but any chunk with a regex match will not be
-// sent, and the first one detected cancels the rest of the copy.
+// sent, and the first one detected cancels the rest of the copy. A match in
+// the first window makes the response a 410 Gone.
 //
 // Patterns which may match more than 4MB of data are not supported; they will
 // not error, but they simply will not be detected.
+//
+// To mask matches rather than refuse the response, use Redact.
 func BlockRegex(ctx context.Context, handle MediaFilterHandle, regexes []*regexp.Regexp) error {
 	defer handle.input.Close()
 	defer handle.output.Close()
@@ -57,10 +61,11 @@ func BlockRegex(ctx context.Context, handle MediaFilterHandle, regexes []*regexp
 		for _, re := range regexes {
 			match := re.Match(buffer.Bytes())
 			if match {
-				// BLOCK -- not an error, but we stop the response right now
-				http.Error(handle.response, "PROHIBITED REGEX PATTERN MATCHED", http.StatusGone)
+				// BLOCK -- stop the response right now. If none of it has
+				// been sent, it becomes a 410.
 				log.Warn().Msgf("blockregex: matched %v", re.String())
-				return nil
+				return &StatusError{StatusCode: http.StatusGone,
+					Err: fmt.Errorf("blockregex: prohibited pattern matched")}
 			}
 		}
 		// send one chunk
@@ -0,0 +1,330 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Params are a filter's parameters, as given in a pipeline config.
+type Params map[string]interface{}
+
+// Decode stores params in the struct v points to, matching parameter names
+// to the fields' json tags. Unknown parameters are an error.
+func (p Params) Decode(v interface{}) error {
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("parameter %q must be %v, not %v", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return errors.New(strings.Replace(err.Error(), "json: unknown field", "unknown parameter", 1))
+	}
+	return nil
+}
+
+// Factory builds a filter from its parameters, or says what is wrong with
+// them.
+type Factory func(Params) (MediaFilter, error)
+
+// registry holds the filters pipeline configs can use, by name.
+var registry = map[string]Factory{
+	"log":            static(LogRequest),
+	"noop":           static(NoOp),
+	"lower":          static(ToLower),
+	"gzip":           static(GZip),
+	"compress":       compressFactory,
+	"intercalate":    intercalateFactory,
+	"block_regex":    blockRegexFactory,
+	"strip_metadata": stripMetadataFactory,
+	"redact":         redactFactory,
+	"sniff":          sniffFactory,
+}
+
+// wholeMedia are the registered filters that must see the whole media:
+// scanning ranges of it one at a time, they could miss what spans two, or
+// not recognize an image from the middle of it.
+var wholeMedia = map[string]bool{
+	"block_regex":    true,
+	"redact":         true,
+	"strip_metadata": true,
+}
+
+// NeedsWholeMedia reports whether the named filter must see the whole
+// media. Ranges of responses it may apply to shouldn't be read; drop the
+// request's Range instead.
+func NeedsWholeMedia(name string) bool {
+	return wholeMedia[name]
+}
+
+// mediaHead are the registered filters that go by the first bytes of the
+// media, and need them for HEAD requests too.
+var mediaHead = map[string]bool{
+	"sniff": true,
+}
+
+// NeedsMediaHead reports whether the named filter goes by the first bytes
+// of the media. HEAD requests for responses it may apply to should carry
+// them; see WithMediaHead.
+func NeedsMediaHead(name string) bool {
+	return mediaHead[name]
+}
+
+// Register makes a filter available to pipeline configs by name. It is meant
+// to be called during setup, before any config is loaded, and panics if the
+// name is taken.
+func Register(name string, factory Factory) {
+	if _, taken := registry[name]; taken {
+		panic(fmt.Sprintf("filter: %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered returns the names of the registered filters, sorted.
+func Registered() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Build returns the named filter, built from params.
+func Build(name string, params Params) (MediaFilter, error) {
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter %q (known filters: %s)", name, strings.Join(Registered(), ", "))
+	}
+	filter, err := factory(params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return filter, nil
+}
+
+// static is a Factory for a filter that takes no parameters.
+func static(filter MediaFilter) Factory {
+	return func(params Params) (MediaFilter, error) {
+		if err := params.Decode(&struct{}{}); err != nil {
+			return nil, err
+		}
+		return filter, nil
+	}
+}
+
+// intercalateFactory builds Intercalate, from the separator to insert at
+// and the value to insert.
+func intercalateFactory(params Params) (MediaFilter, error) {
+	var p struct {
+		Separator string `json:"separator"`
+		Insert    string `json:"insert"`
+	}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Separator == "" {
+		return nil, errors.New(`parameter "separator" is required`)
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return Intercalate(ctx, handle, p.Separator, p.Insert)
+	}, nil
+}
+
+// blockRegexFactory builds BlockRegex, from a list of patterns in RE2
+// syntax.
+func blockRegexFactory(params Params) (MediaFilter, error) {
+	var p struct {
+		Patterns []string `json:"patterns"`
+	}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	if len(p.Patterns) == 0 {
+		return nil, errors.New(`parameter "patterns" is required`)
+	}
+	regexes := make([]*regexp.Regexp, len(p.Patterns))
+	for i, pattern := range p.Patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("patterns[%d]: %v", i, err)
+		}
+		regexes[i] = regex
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return BlockRegex(ctx, handle, regexes)
+	}, nil
+}
+
+// redactFactory builds Redact, from the names of RedactPatterns to redact,
+// and custom patterns in RE2 syntax by name, the mask, and the window.
+func redactFactory(params Params) (MediaFilter, error) {
+	p := struct {
+		Patterns []string          `json:"patterns"`
+		Custom   map[string]string `json:"custom"`
+		Mask     *string           `json:"mask"`
+		Window   int               `json:"window"`
+	}{Window: DefaultRedactWindow}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	var patterns []RedactPattern
+	for i, name := range p.Patterns {
+		regex, ok := RedactPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("patterns[%d]: unknown pattern %q (known patterns: %s)", i, name, strings.Join(sortedPatternNames(), ", "))
+		}
+		patterns = append(patterns, RedactPattern{Name: name, Regexp: regex})
+	}
+	customNames := make([]string, 0, len(p.Custom))
+	for name := range p.Custom {
+		customNames = append(customNames, name)
+	}
+	sort.Strings(customNames)
+	for _, name := range customNames {
+		regex, err := regexp.Compile(p.Custom[name])
+		if err != nil {
+			return nil, fmt.Errorf("custom.%s: %v", name, err)
+		}
+		patterns = append(patterns, RedactPattern{Name: name, Regexp: regex})
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New(`parameter "patterns" or "custom" is required`)
+	}
+	if p.Window < 1 || p.Window > redactChunkSize {
+		return nil, fmt.Errorf(`parameter "window" must be 1 to %d`, redactChunkSize)
+	}
+	mask := DefaultRedactMask
+	if p.Mask != nil {
+		mask = *p.Mask
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return Redact(ctx, handle, patterns, mask, p.Window)
+	}, nil
+}
+
+// sortedPatternNames returns the names of RedactPatterns, sorted.
+func sortedPatternNames() []string {
+	names := make([]string, 0, len(RedactPatterns))
+	for name := range RedactPatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressFactory builds CompressWith, from the encodings to offer in order
+// of preference; DefaultEncodings if none are given.
+func compressFactory(params Params) (MediaFilter, error) {
+	p := struct {
+		Encodings []string `json:"encodings"`
+	}{Encodings: DefaultEncodings}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	for i, encoding := range p.Encodings {
+		if _, ok := encoders[encoding]; !ok {
+			return nil, fmt.Errorf("encodings[%d]: unsupported encoding %q", i, encoding)
+		}
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return CompressWith(ctx, handle, p.Encodings)
+	}, nil
+}
+
+// sniffFactory builds SniffContentTypeWith, from whether to refuse media
+// that isn't of its declared type.
+func sniffFactory(params Params) (MediaFilter, error) {
+	var p struct {
+		Strict bool `json:"strict"`
+	}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return SniffContentTypeWith(ctx, handle, p.Strict)
+	}, nil
+}
+
+// stripMetadataFactory builds StripMetadataWith, from whether to keep ICC
+// color profiles.
+func stripMetadataFactory(params Params) (MediaFilter, error) {
+	var p struct {
+		KeepColorProfile bool `json:"keepColorProfile"`
+	}
+	if err := params.Decode(&p); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		return StripMetadataWith(ctx, handle, p.KeepColorProfile)
+	}, nil
+}
+
+// TranslateFactory returns a Factory for TranslateWith, translating with
+// translator and caching translations with getter and setter. The filter
+// is built from BCP 47 language tags: the language to translate from,
+// which is detected if omitted; the languages to offer, negotiated with
+// Accept-Language; and the language to translate to otherwise. One of the
+// last two is required.
+func TranslateFactory(translator Translator, getter CacheGet, setter CacheSet) Factory {
+	return func(params Params) (MediaFilter, error) {
+		var p struct {
+			From      string   `json:"from"`
+			To        string   `json:"to"`
+			Languages []string `json:"languages"`
+		}
+		if err := params.Decode(&p); err != nil {
+			return nil, err
+		}
+		options := TranslateOptions{Translator: translator, Getter: getter, Setter: setter}
+		var err error
+		if p.From != "" {
+			if options.From, err = language.Parse(p.From); err != nil {
+				return nil, fmt.Errorf(`parameter "from": %v`, err)
+			}
+		}
+		if p.To != "" {
+			if options.To, err = language.Parse(p.To); err != nil {
+				return nil, fmt.Errorf(`parameter "to": %v`, err)
+			}
+		}
+		for i, tag := range p.Languages {
+			parsed, err := language.Parse(tag)
+			if err != nil {
+				return nil, fmt.Errorf("languages[%d]: %v", i, err)
+			}
+			options.Languages = append(options.Languages, parsed)
+		}
+		if options.To == language.Und && len(options.Languages) == 0 {
+			return nil, errors.New(`parameter "to" or "languages" is required`)
+		}
+		return func(ctx context.Context, handle MediaFilterHandle) error {
+			return TranslateWith(ctx, handle, options)
+		}, nil
+	}
+}
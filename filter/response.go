@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+)
+
+// DeferWriteHeader returns a ResponseWriter that holds back the status given
+// to WriteHeader until the first byte of the body is written, so that
+// filters can still change it. PipelineCopy does this itself; callers only
+// need it to set a status before calling PipelineCopy, which the first
+// filter then starts from.
+func DeferWriteHeader(response http.ResponseWriter) http.ResponseWriter {
+	return deferWriteHeader(response)
+}
+
+// deferredResponse is a ResponseWriter that holds back its status until the
+// first byte of the body is written.
+type deferredResponse struct {
+	http.ResponseWriter
+	mu     sync.Mutex
+	status int
+	sent   bool
+}
+
+// deferWriteHeader wraps response in a deferredResponse, unless it already
+// is one.
+func deferWriteHeader(response http.ResponseWriter) *deferredResponse {
+	if deferred, ok := response.(*deferredResponse); ok {
+		return deferred
+	}
+	return &deferredResponse{ResponseWriter: response}
+}
+
+// WriteHeader records the status. The last status given before the body
+// wins.
+func (r *deferredResponse) WriteHeader(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.sent {
+		r.status = status
+	}
+}
+
+func (r *deferredResponse) Write(p []byte) (int, error) {
+	r.send()
+	return r.ResponseWriter.Write(p)
+}
+
+// send sends the status, if it hasn't been already.
+func (r *deferredResponse) send() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.sent {
+		r.sent = true
+		if r.status != 0 {
+			r.ResponseWriter.WriteHeader(r.status)
+		}
+	}
+}
+
+// pending returns the status that will be sent, or zero for the default.
+func (r *deferredResponse) pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// committed reports whether the status has been sent.
+func (r *deferredResponse) committed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent
+}
+
+// Flush sends any buffered body to the client, if the response supports it.
+func (r *deferredResponse) Flush() {
+	r.send()
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeErrorStatus replaces the response with an error, dropping headers
+// that described the media.
+func writeErrorStatus(response http.ResponseWriter, status int) {
+	common.Error(response, http.StatusText(status), status)
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Select runs the pipeline choose picks, as though its filters were in
+// place of this one. choose is given the request, and the headers the filter
+// before passes on, so the pipeline can depend on the media's Content-Type.
+// A nil pipeline passes the media through.
+func Select(ctx context.Context, handle MediaFilterHandle,
+	choose func(*http.Request, http.Header) Pipeline) error {
+	upstream := handle.output.stage.prev
+	<-upstream.done
+	pipeline := choose(handle.request, upstream.sent)
+	if len(pipeline) == 0 {
+		return NoOp(ctx, handle)
+	}
+	defer handle.input.Close()
+	defer handle.output.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// errors are recorded at i+1 for filter i, and last for the copy to
+	// this filter's output
+	failed := &failures{errs: make([]error, len(pipeline)+2), cancel: cancel}
+	var filters sync.WaitGroup
+	output, lastStage := startFilters(ctx, &filters, failed, handle.input, upstream, handle.request, pipeline)
+	// pass on the headers the last filter of the pipeline passes on
+	<-lastStage.done
+	stage := handle.output.stage
+	stage.mu.Lock()
+	stage.header = lastStage.sent.Clone()
+	stage.status = lastStage.sentStatus
+	stage.mu.Unlock()
+	if _, err := io.Copy(handle.output, output); err != nil {
+		failed.fail(len(pipeline)+1, err)
+		output.CloseWithError(err)
+	}
+	filters.Wait()
+	return failed.cause()
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SniffBytes is how much of the media is sniffed. It's enough to find the
+// workbook among the first entries of an XLSX archive.
+const SniffBytes = 4096
+
+// xlsxType is the Content-Type of Excel workbooks.
+const xlsxType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// genericTypes say nothing about the media, and are always corrected.
+var genericTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/unknown":      true,
+}
+
+// typeAliases are other names in use for sniffed types.
+var typeAliases = map[string]string{
+	"image/jpg":         "image/jpeg",
+	"image/pjpeg":       "image/jpeg",
+	"video/mov":         "video/quicktime",
+	"application/x-pdf": "application/pdf",
+}
+
+// SniffType returns the Content-Type of media from its first bytes, or ""
+// if it isn't one of the types recognized: PDF, XLSX, JPEG, PNG, MP4 and
+// QuickTime MOV.
+func SniffType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return "application/pdf"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(head, pngMagic):
+		return "image/png"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		// an Office Open XML archive, with a workbook in it
+		if bytes.Contains(head, []byte("[Content_Types].xml")) && bytes.Contains(head, []byte("xl/")) {
+			return xlsxType
+		}
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		// an ISO base media file; the brand tells MOV from MP4
+		if string(head[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case len(head) >= 8 && binary.BigEndian.Uint32(head[:4]) >= 8:
+		// older QuickTime movies start with an atom other than ftyp
+		switch string(head[4:8]) {
+		case "moov", "mdat", "wide", "free", "skip", "pnot":
+			return "video/quicktime"
+		}
+	}
+	return ""
+}
+
+// canonicalType returns the media type of contentType, by its usual name.
+func canonicalType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if alias, ok := typeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// sameType reports whether the declared media type agrees with the sniffed
+// one. MP4 and MOV share a container, and players take one for the other,
+// so they agree.
+func sameType(declared, sniffed string) bool {
+	if declared == sniffed {
+		return true
+	}
+	video := map[string]bool{"video/mp4": true, "video/quicktime": true}
+	return video[declared] && video[sniffed]
+}
+
+// SniffContentType corrects the Content-Type of media from its first bytes:
+// when it's generic, like application/octet-stream, or wrong. Media that
+// isn't recognized (see SniffType) keeps its Content-Type. Either way, the
+// response says X-Content-Type-Options: nosniff, so clients use the
+// Content-Type as sent.
+//
+// Put this before filters that go by Content-Type in a pipeline.
+func SniffContentType(ctx context.Context, handle MediaFilterHandle) error {
+	return SniffContentTypeWith(ctx, handle, false)
+}
+
+// SniffContentTypeWith is SniffContentType, refusing media with 403
+// Forbidden instead of correcting its Content-Type, if strict is set, when
+// the media is not of the type declared. Generic types are corrected
+// either way.
+//
+// Strict or not, media is sniffed from its first SniffBytes, decoded if it
+// has a known Content-Encoding, and for HEAD requests, from the bytes
+// WithMediaHead gives. If strict is set, media that can't be sniffed, like
+// a range that doesn't start it, is sent as application/octet-stream, and
+// multiple ranges are refused with 416 Range Not Satisfiable.
+//
+// This function should be called from a lambda that applies the desired
+// option, leaving only ctx and handle for use as a MediaFilter.
+func SniffContentTypeWith(ctx context.Context, handle MediaFilterHandle, strict bool) error {
+	defer handle.input.Close()
+	defer handle.output.Close()
+	header := handle.Header()
+	declared := canonicalType(header.Get("Content-Type"))
+	if strict && declared == "multipart/byteranges" {
+		// the parts can't be retyped, and later ones can't be sniffed
+		return FilterError(handle, http.StatusRequestedRangeNotSatisfiable,
+			"sniff filter: multiple ranges of %q can't be checked", handle.request.URL.Path)
+	}
+	reader := bufio.NewReaderSize(handle.input, SniffBytes)
+	head, ok := sniffedHead(ctx, handle, reader)
+	if !ok {
+		if strict {
+			log.Debug().Msgf("sniff filter: %q can't be checked, sending it as application/octet-stream", handle.request.URL.Path)
+			header.Set("Content-Type", "application/octet-stream")
+			header.Set("X-Content-Type-Options", "nosniff")
+		}
+		return copyMedia(handle.output, reader)
+	}
+	sniffed := SniffType(head)
+	switch {
+	case sniffed == "" || sameType(declared, sniffed):
+	case genericTypes[declared]:
+		log.Debug().Msgf("sniff filter: %q is %s", handle.request.URL.Path, sniffed)
+		header.Set("Content-Type", sniffed)
+	case strict:
+		return FilterError(handle, http.StatusForbidden,
+			"sniff filter: %q is %s, not %s as declared", handle.request.URL.Path, sniffed, declared)
+	default:
+		log.Warn().Msgf("sniff filter: %q is %s, not %s as declared", handle.request.URL.Path, sniffed, declared)
+		header.Set("Content-Type", sniffed)
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	return copyMedia(handle.output, reader)
+}
+
+// mediaHeadKey is the context key of the first bytes of the media of a HEAD
+// request.
+type mediaHeadKey struct{}
+
+// WithMediaHead returns ctx, carrying head, the first SniffBytes of the
+// media of a HEAD request, so sniff treats it as it would the GET.
+func WithMediaHead(ctx context.Context, head []byte) context.Context {
+	return context.WithValue(ctx, mediaHeadKey{}, head)
+}
+
+// sniffedHead returns the first bytes of the media to sniff, decoded, or
+// false if they aren't there: the media is a range that doesn't start it,
+// has an unknown encoding, or is the empty media of a HEAD request without
+// WithMediaHead.
+func sniffedHead(ctx context.Context, handle MediaFilterHandle, reader *bufio.Reader) ([]byte, bool) {
+	header := handle.Header()
+	var head []byte
+	if handle.request.Method == http.MethodHead {
+		var ok bool
+		if head, ok = ctx.Value(mediaHeadKey{}).([]byte); !ok {
+			return nil, false
+		}
+	} else {
+		if contentRange := header.Get("Content-Range"); contentRange != "" && !startsMedia(contentRange) {
+			return nil, false
+		}
+		head, _ = reader.Peek(SniffBytes)
+	}
+	stored := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if stored == "" {
+		return head, true
+	}
+	decode, known := decoders[stored]
+	if !known {
+		return nil, false
+	}
+	decoder, err := decode(bytes.NewReader(head))
+	if err != nil {
+		return nil, false
+	}
+	defer decoder.Close()
+	// the head of the encoding decodes to at least the head of the media,
+	// unless it's all there is
+	decoded := make([]byte, SniffBytes)
+	n, _ := io.ReadFull(decoder, decoded)
+	return decoded[:n], true
+}
+
+// startsMedia reports whether the range of contentRange holds as much of
+// the start of the media as sniffing needs.
+func startsMedia(contentRange string) bool {
+	spec := strings.TrimPrefix(contentRange, "bytes 0-")
+	if spec == contentRange {
+		return false
+	}
+	last, size, _ := strings.Cut(spec, "/")
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return false
+	}
+	return end+1 >= SniffBytes || size == strconv.FormatInt(end+1, 10)
+}
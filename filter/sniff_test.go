@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pdf is the start of a PDF, and more, so it's longer than SniffBytes.
+var pdf = "%PDF-1.7\n" + strings.Repeat("0 0 obj\n", SniffBytes/8)
+
+func sniff(strict bool) Pipeline {
+	return Pipeline{func(ctx context.Context, handle MediaFilterHandle) error {
+		return SniffContentTypeWith(ctx, handle, strict)
+	}}
+}
+
+func TestSniffContentType(t *testing.T) {
+	for _, test := range []struct {
+		declared string
+		strict   bool
+		status   int
+		want     string
+	}{
+		{"application/octet-stream", false, http.StatusOK, "application/pdf"},
+		{"application/octet-stream", true, http.StatusOK, "application/pdf"},
+		{"application/x-pdf", true, http.StatusOK, "application/x-pdf"},
+		{"image/png", false, http.StatusOK, "application/pdf"},
+		{"image/png", true, http.StatusForbidden, ""},
+	} {
+		response, _ := run(t, sniff(test.strict), nil, http.Header{"Content-Type": {test.declared}}, pdf)
+		if response.Code != test.status {
+			t.Errorf("%s, strict %v: status %d, want %d", test.declared, test.strict, response.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if got := response.Header().Get("Content-Type"); got != test.want {
+			t.Errorf("%s, strict %v: Content-Type %s, want %s", test.declared, test.strict, got, test.want)
+		}
+		if response.Header().Get("X-Content-Type-Options") != "nosniff" || response.Body.String() != pdf {
+			t.Errorf("%s, strict %v: response isn't the media, with nosniff", test.declared, test.strict)
+		}
+	}
+}
+
+func TestSniffRanges(t *testing.T) {
+	for _, test := range []struct {
+		contentRange string
+		strict       bool
+		status       int
+		want         string
+	}{
+		// a range holding the start of the media is checked
+		{"bytes 0-4999/5000", true, http.StatusForbidden, ""},
+		{"bytes 0-9/10", true, http.StatusForbidden, ""},
+		// others can't be, and strictly aren't sent as what they claim
+		{"bytes 1-4999/5000", true, http.StatusOK, "application/octet-stream"},
+		{"bytes 0-9/5000", true, http.StatusOK, "application/octet-stream"},
+		{"bytes 1-4999/5000", false, http.StatusOK, "image/png"},
+	} {
+		response, _ := run(t, sniff(test.strict), nil,
+			http.Header{"Content-Type": {"image/png"}, "Content-Range": {test.contentRange}}, pdf[:10])
+		if response.Code != test.status {
+			t.Errorf("%s, strict %v: status %d, want %d", test.contentRange, test.strict, response.Code, test.status)
+		} else if got := response.Header().Get("Content-Type"); test.status == http.StatusOK && got != test.want {
+			t.Errorf("%s, strict %v: Content-Type %s, want %s", test.contentRange, test.strict, got, test.want)
+		}
+	}
+	response, _ := run(t, sniff(true), nil,
+		http.Header{"Content-Type": {"multipart/byteranges; boundary=b"}}, "--b\r\nContent-Type: image/png\r\n\r\n%PDF-\r\n--b--\r\n")
+	if response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("multiple ranges: status %d, want 416", response.Code)
+	}
+}
+
+func TestSniffEncoded(t *testing.T) {
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte(pdf))
+	gz.Close()
+	for encoding, want := range map[string]int{"gzip": http.StatusForbidden, "x-unknown": http.StatusOK} {
+		response, _ := run(t, sniff(true), nil,
+			http.Header{"Content-Type": {"image/png"}, "Content-Encoding": {encoding}}, compressed.String())
+		if response.Code != want {
+			t.Errorf("%s: status %d, want %d", encoding, response.Code, want)
+		}
+		if want == http.StatusOK && response.Header().Get("Content-Type") != "application/octet-stream" {
+			t.Errorf("%s: Content-Type %s, want application/octet-stream", encoding, response.Header().Get("Content-Type"))
+		}
+	}
+	response, _ := run(t, sniff(false), nil,
+		http.Header{"Content-Type": {"application/octet-stream"}, "Content-Encoding": {"gzip"}}, compressed.String())
+	if response.Header().Get("Content-Type") != "application/pdf" || response.Body.String() != compressed.String() {
+		t.Errorf("gzip: Content-Type %s, want application/pdf, and the media still encoded", response.Header().Get("Content-Type"))
+	}
+}
+
+func TestSniffHead(t *testing.T) {
+	head := func(ctx context.Context, strict bool, declared string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodHead, "/public/a.png", nil)
+		response := httptest.NewRecorder()
+		response.Header().Set("Content-Type", declared)
+		PipelineCopy(ctx, response, strings.NewReader(""), request, sniff(strict))
+		return response
+	}
+	withPDF := WithMediaHead(context.Background(), []byte(pdf[:SniffBytes]))
+	if response := head(withPDF, true, "image/png"); response.Code != http.StatusForbidden {
+		t.Errorf("strict HEAD of a PDF declared PNG: status %d, want 403 like the GET", response.Code)
+	}
+	if response := head(withPDF, false, "application/octet-stream"); response.Header().Get("Content-Type") != "application/pdf" {
+		t.Errorf("HEAD of a PDF: Content-Type %s, want application/pdf like the GET", response.Header().Get("Content-Type"))
+	}
+	if response := head(context.Background(), true, "image/png"); response.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("strict HEAD without the media: Content-Type %s, want application/octet-stream", response.Header().Get("Content-Type"))
+	}
+}
+
+func TestNeedsMediaHead(t *testing.T) {
+	if !NeedsMediaHead("sniff") || NeedsMediaHead("redact") {
+		t.Error("NeedsMediaHead doesn't name sniff alone")
+	}
+}
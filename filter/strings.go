@@ -16,6 +16,7 @@ package filter
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -30,9 +31,10 @@ func ToLower(ctx context.Context, handle MediaFilterHandle) error {
 	defer handle.output.Close()
 	buf := make([]byte, 4096)
 	for {
-		_, err := handle.input.Read(buf)
-		buf = bytes.ToLower(buf)
-		handle.output.Write(buf)
+		n, err := handle.input.Read(buf)
+		if _, writeErr := handle.output.Write(bytes.ToLower(buf[:n])); writeErr != nil {
+			return fmt.Errorf("lower filter: %w", writeErr)
+		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -4,7 +4,7 @@
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
 //
-//     https://www.apache.org/licenses/LICENSE-2.0
+//	https://www.apache.org/licenses/LICENSE-2.0
 //
 // Unless required by applicable law or agreed to in writing, software
 // distributed under the License is distributed on an "AS IS" BASIS,
@@ -18,28 +18,136 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	translate "cloud.google.com/go/translate/apiv3"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/html"
 	"golang.org/x/text/language"
 	translatepb "google.golang.org/genproto/googleapis/cloud/translate/v3"
 )
 
-var translateClient *translate.TranslationClient
+const (
+	// translateChunkRunes bounds the pieces media is translated in, in code
+	// points.
+	translateChunkRunes = 10000
+	// translateRequestRunes bounds the code points sent to the translator at
+	// once; the Translation API recommends no more than 30k.
+	translateRequestRunes = 30000
+	// maxTranslateBytes bounds the media that is translated.
+	maxTranslateBytes = 8 << 20
+)
+
+// Translator translates text.
+type Translator interface {
+	// Translate translates texts of mimeType, "text/html" or "text/plain",
+	// from one language to another. from may be language.Und, for the
+	// translator to detect it.
+	Translate(ctx context.Context, texts []string, mimeType string, from, to language.Tag) ([]string, error)
+}
 
-// setup performs one-time setup for the GCS backend.
-func setup(ctx context.Context, handle MediaFilterHandle) error {
-	// get Translate client
-	var err error
-	translateClient, err = translate.NewTranslationClient(ctx)
+// cloudTranslator is a Translator that uses the Cloud Translation API.
+type cloudTranslator struct {
+	mu     sync.Mutex
+	client *translate.TranslationClient
+	parent string
+}
+
+// NewCloudTranslator returns a Translator that uses the Cloud Translation
+// API of the project the proxy runs in. The client is created, and the
+// project looked up, on first use, and kept from then on.
+func NewCloudTranslator() Translator {
+	return &cloudTranslator{}
+}
+
+// setup creates the client and looks up the project, if that hasn't been
+// done yet.
+func (t *cloudTranslator) setup(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return nil
+	}
+	projectId, err := common.GetRuntimeProjectId()
+	if err != nil {
+		return err
+	}
+	client, err := translate.NewTranslationClient(ctx)
 	if err != nil {
-		return FilterError(handle, http.StatusInternalServerError, "translate filter: %v", err)
+		return err
 	}
+	t.client, t.parent = client, fmt.Sprintf("projects/%v/locations/global", projectId)
 	return nil
 }
 
+func (t *cloudTranslator) Translate(ctx context.Context, texts []string, mimeType string,
+	from, to language.Tag) ([]string, error) {
+	if err := t.setup(ctx); err != nil {
+		return nil, err
+	}
+	request := translatepb.TranslateTextRequest{
+		Parent:             t.parent,
+		Contents:           texts,
+		TargetLanguageCode: to.String(),
+		MimeType:           mimeType,
+	}
+	if from != language.Und {
+		request.SourceLanguageCode = from.String()
+	}
+	response, err := t.client.TranslateText(ctx, &request)
+	if err != nil {
+		return nil, err
+	}
+	translated := make([]string, len(response.Translations))
+	for i, translation := range response.Translations {
+		translated[i] = translation.TranslatedText
+	}
+	return translated, nil
+}
+
+// FakeTranslator is a Translator for development and tests, that needs no
+// Google services. Rather than translating text, it marks it with the
+// language it would be translated to: each line of plain text, and each
+// run of text between HTML tags, gets a prefix like "[es] ".
+type FakeTranslator struct{}
+
+func (FakeTranslator) Translate(ctx context.Context, texts []string, mimeType string,
+	from, to language.Tag) ([]string, error) {
+	mark := "[" + to.String() + "] "
+	translated := make([]string, len(texts))
+	for i, text := range texts {
+		if mimeType != "text/html" {
+			lines := strings.SplitAfter(text, "\n")
+			for j, line := range lines {
+				if strings.TrimSpace(line) != "" {
+					lines[j] = mark + line
+				}
+			}
+			translated[i] = strings.Join(lines, "")
+			continue
+		}
+		var b strings.Builder
+		tokenizer := html.NewTokenizer(strings.NewReader(text))
+		for tokenType := tokenizer.Next(); tokenType != html.ErrorToken; tokenType = tokenizer.Next() {
+			raw := tokenizer.Raw()
+			if tokenType == html.TextToken && len(bytes.TrimSpace(raw)) > 0 {
+				b.WriteString(mark)
+			}
+			b.Write(raw)
+		}
+		translated[i] = b.String()
+	}
+	return translated, nil
+}
+
+// defaultTranslator is the Translator Translate uses.
+var defaultTranslator = NewCloudTranslator()
+
 // Translate translates the media from one language to another.
 //
 // This function should be called from a lambda that applies desired values for
@@ -47,45 +155,389 @@ func setup(ctx context.Context, handle MediaFilterHandle) error {
 //
 // For example:
 //   func(ctx context.Context, handle MediaFilterHandle) error {
-//   	return Translate(ctx, handle, language.English, language.Spanish, translate.HTML)
+//   	return Translate(ctx, handle, language.English, language.Spanish)
 //   },
 //
 // This is an example of a store-and-forward filter, in that it loads the
 // entire response to perform its transformation, so it will use memory at least
-// equal to the source, and add its processing time to latency.
+// equal to the source, and add its processing time to latency. See
+// TranslateWith for caching and language negotiation.
 func Translate(ctx context.Context, handle MediaFilterHandle,
 	fromLang language.Tag, toLang language.Tag) error {
+	return TranslateWith(ctx, handle, TranslateOptions{
+		From:       fromLang,
+		To:         toLang,
+		Translator: defaultTranslator,
+	})
+}
+
+// TranslateOptions configure TranslateWith.
+type TranslateOptions struct {
+	// From is the language of the media, or language.Und for the translator
+	// to detect it.
+	From language.Tag
+	// To is the language to translate to, or language.Und to not translate,
+	// when none of Languages is acceptable.
+	To language.Tag
+	// Languages are the languages the media is offered in; the best one for
+	// the request's Accept-Language is translated to.
+	Languages []language.Tag
+	// Translator does the translating.
+	Translator Translator
+	// Getter and Setter, if set, cache translations.
+	Getter CacheGet
+	Setter CacheSet
+}
+
+// TranslateWith translates HTML and plain text media to the language the
+// options pick: the best of options.Languages for the Accept-Language of
+// the request, or else options.To. Other media, and media already in the
+// language picked, pass through.
+//
+// The media is translated in pieces of up to 10k code points, split
+// between HTML elements where possible, and then between lines, sentences
+// and words, so the markup stays intact and media of any size can be
+// translated.
+//
+// Translations are cached with options.Setter, keyed by the object, its
+// ETag (and so its generation) and the language, and looked up with
+// options.Getter first. HEAD requests, partial responses and empty media
+// pass through, and are never cached.
+//
+// This function should be called from a lambda that applies desired
+// options, leaving only ctx and handle for use as a MediaFilter.
+func TranslateWith(ctx context.Context, handle MediaFilterHandle, options TranslateOptions) error {
 	defer handle.input.Close()
 	defer handle.output.Close()
-	// run setup if necessary
-	if translateClient == nil {
-		setup(ctx, handle)
-	}
-	// read the content into a string
-	media := new(bytes.Buffer)
-	io.Copy(media, handle.input)
-	// formulate the request
-	projectId, err := common.GetRuntimeProjectId()
-	if err != nil {
-		return FilterError(handle, http.StatusInternalServerError, "translate filter: %v", err)
+	header := handle.Header()
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "text/plain" {
+		return copyMedia(handle.output, handle.input)
+	}
+	to := options.To
+	if len(options.Languages) > 0 {
+		common.AddVary(header, "Accept-Language")
+		accepted, _, _ := language.ParseAcceptLanguage(handle.request.Header.Get("Accept-Language"))
+		if len(accepted) > 0 {
+			_, index, confidence := language.NewMatcher(options.Languages).Match(accepted...)
+			if confidence != language.No {
+				to = options.Languages[index]
+			}
+		}
+	}
+	// media in a known language needn't be translated to it
+	from := options.From
+	if from == language.Und {
+		from, _ = language.Parse(header.Get("Content-Language"))
+	}
+	// HEAD requests and partial responses have no whole media to
+	// translate, and a translation of what they have mustn't be cached
+	if to == language.Und || sameLanguage(from, to) || partialContent(handle) ||
+		handle.request.Method == http.MethodHead {
+		return copyMedia(handle.output, handle.input)
+	}
+
+	var media io.Reader = handle.input
+	if stored := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))); stored != "" {
+		decode, known := decoders[stored]
+		if !known {
+			return copyMedia(handle.output, media)
+		}
+		decoder, err := decode(media)
+		if err != nil {
+			return FilterError(handle, http.StatusInternalServerError, "translate filter: decoding %s: %v", stored, err)
+		}
+		defer decoder.Close()
+		media = decoder
+		header.Del("Content-Encoding")
+	}
+
+	key := fmt.Sprintf("%s?translate=%s#%s",
+		common.NormalizePath(handle.request.Header.Get("x-lpse-id"), handle.request.URL.Path),
+		to, header.Get("Etag"))
+	var translation []byte
+	hit := false
+	if options.Getter != nil {
+		translation, hit = options.Getter(key)
+	}
+	if hit {
+		log.Debug().Msgf("translate filter: cache hit for %q", key)
+	} else {
+		source, err := io.ReadAll(io.LimitReader(media, maxTranslateBytes+1))
+		if err != nil {
+			return fmt.Errorf("translate filter: %w", err)
+		}
+		if len(source) > maxTranslateBytes {
+			return FilterError(handle, http.StatusInternalServerError, "translate filter: media larger than %d bytes", maxTranslateBytes)
+		}
+		if len(source) == 0 {
+			// nothing to translate, or to cache
+			return nil
+		}
+		if !utf8.Valid(source) {
+			return FilterError(handle, http.StatusInternalServerError, "translate filter: media is not UTF-8")
+		}
+		translated, err := translateChunks(ctx, options, string(source), mediaType, to)
+		if err != nil {
+			return FilterError(handle, http.StatusInternalServerError, "translate filter: %v", err)
+		}
+		translation = []byte(translated)
+		if expiration, ok := cacheExpiration(handle); ok && options.Setter != nil {
+			options.Setter(key, translation, expiration)
+		}
+	}
+	header.Set("Content-Language", to.String())
+	header.Set("Content-Length", fmt.Sprint(len(translation)))
+	header.Del("Accept-Ranges")
+	weakenETag(header)
+	if _, err := handle.output.Write(translation); err != nil {
+		return fmt.Errorf("translate filter: %w", err)
 	}
-	request := translatepb.TranslateTextRequest{
-		Parent:             fmt.Sprintf("projects/%v/locations/global", projectId),
-		Contents:           []string{media.String()},
-		SourceLanguageCode: fromLang.String(),
-		TargetLanguageCode: toLang.String(),
-		MimeType:           handle.response.Header().Get("Content-Type"),
-	}
-	// make the request
-	response, err := translateClient.TranslateText(ctx, &request)
-	if err != nil {
-		return FilterError(handle, http.StatusInternalServerError, "translate filter: %v", err)
-	}
-	// get the translation
-	translationString := response.Translations[0].TranslatedText
-	// reset content-length header. It is no longer accurate.
-	handle.response.Header().Set("Content-Length", fmt.Sprint(len(translationString)))
-	// send the translation
-	io.Copy(handle.output, strings.NewReader(translationString))
 	return nil
 }
+
+// sameLanguage reports whether a and b are the same language, whatever
+// their regions; Und is no language.
+func sameLanguage(a, b language.Tag) bool {
+	if a == language.Und || b == language.Und {
+		return false
+	}
+	baseA, _ := a.Base()
+	baseB, _ := b.Base()
+	return baseA == baseB
+}
+
+// translateChunks translates text in chunks, in requests of up to
+// translateRequestRunes code points, and joins the translations.
+func translateChunks(ctx context.Context, options TranslateOptions, text string, mediaType string,
+	to language.Tag) (string, error) {
+	chunks := chunkText(text, mediaType == "text/html", translateChunkRunes)
+	var translated strings.Builder
+	for start := 0; start < len(chunks); {
+		var texts []string
+		end, runes := start, 0
+		for end < len(chunks) {
+			request := chunks[end].request()
+			count := utf8.RuneCountInString(request)
+			if end > start && runes+count > translateRequestRunes {
+				break
+			}
+			texts = append(texts, request)
+			runes += count
+			end++
+		}
+		batch, err := options.Translator.Translate(ctx, texts, mediaType, options.From, to)
+		if err != nil {
+			return "", err
+		}
+		if len(batch) != end-start {
+			return "", fmt.Errorf("%d translations of %d texts", len(batch), end-start)
+		}
+		for i, text := range batch {
+			chunk := chunks[start+i]
+			if !strings.HasPrefix(text, chunk.open) || !strings.HasSuffix(text[len(chunk.open):], chunk.close) {
+				return "", fmt.Errorf("translation of chunk %d changed the tags around it", start+i)
+			}
+			translated.WriteString(text[len(chunk.open) : len(text)-len(chunk.close)])
+		}
+		start = end
+	}
+	return translated.String(), nil
+}
+
+// chunk is a piece of text to translate. HTML chunks are balanced: open
+// reopens the elements open where the chunk starts, and close closes those
+// still open where it ends. Both are trimmed from the translation again.
+type chunk struct {
+	open, text, close string
+}
+
+// request returns the text sent to the translator for c.
+func (c chunk) request() string {
+	return c.open + c.text + c.close
+}
+
+// split is a place text may be split, with a priority: the higher it is,
+// the less splitting there disturbs the text. open is the innermost HTML
+// element open there, if any.
+type split struct {
+	offset, priority int
+	open             *openTag
+}
+
+// htmlBlocks are the elements that end blocks of text, and so make the best
+// places to split HTML.
+var htmlBlocks = map[string]bool{
+	"p": true, "div": true, "li": true, "ul": true, "ol": true, "tr": true,
+	"table": true, "section": true, "article": true, "header": true,
+	"footer": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "br": true, "hr": true, "blockquote": true, "pre": true,
+	"head": true, "body": true, "title": true,
+}
+
+// htmlVoid are the elements that have no end tag.
+var htmlVoid = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// htmlSelfClosing are the elements whose end tag may be left out before
+// another of the same element.
+var htmlSelfClosing = map[string]bool{
+	"p": true, "li": true, "dt": true, "dd": true, "option": true, "tr": true,
+	"td": true, "th": true,
+}
+
+// chunkText splits text into chunks of at most max code points, not
+// counting the tags that balance HTML chunks, whose texts join back into
+// text. It splits at the highest priority place it can in each chunk:
+// between HTML blocks, then between other elements (if isHTML), then
+// between paragraphs, lines, sentences and words, and as a last resort
+// between code points.
+func chunkText(text string, isHTML bool, max int) []chunk {
+	remaining := utf8.RuneCountInString(text)
+	if remaining <= max {
+		return []chunk{{text: text}}
+	}
+	var splits []split
+	if isHTML {
+		splits = htmlSplits(text)
+	} else {
+		splits = textSplits(text, 0)
+	}
+	var chunks []chunk
+	var at split
+	next := 0
+	for remaining > max {
+		// end is max code points on from the start of the chunk
+		end := at.offset
+		for runes := 0; runes < max; runes++ {
+			_, size := utf8.DecodeRuneInString(text[end:])
+			end += size
+		}
+		best := split{offset: end, priority: -1}
+		// splitting between code points leaves the elements open as they
+		// are at the last split before it
+		fallback := at
+		for ; next < len(splits) && splits[next].offset <= end; next++ {
+			if splits[next].offset <= at.offset {
+				continue
+			}
+			fallback = splits[next]
+			if splits[next].priority >= best.priority {
+				best = splits[next]
+			}
+		}
+		if best.priority < 0 {
+			best.open = fallback.open
+		}
+		reopen, _ := balancing(at.open)
+		_, close := balancing(best.open)
+		chunks = append(chunks, chunk{open: reopen, text: text[at.offset:best.offset], close: close})
+		remaining -= utf8.RuneCountInString(text[at.offset:best.offset])
+		at = best
+		// the splits after best are still candidates for the next chunk
+		for next > 0 && splits[next-1].offset > at.offset {
+			next--
+		}
+	}
+	reopen, _ := balancing(at.open)
+	return append(chunks, chunk{open: reopen, text: text[at.offset:]})
+}
+
+// openTag is an HTML element open at some point in a document, in the
+// element it's in, its parent.
+type openTag struct {
+	name, raw string
+	parent    *openTag
+}
+
+// htmlSplits returns the places HTML may be split: after tags, with
+// blocks first, and within text, except that of scripts and styles.
+func htmlSplits(text string) []split {
+	var splits []split
+	var open *openTag
+	tokenizer := html.NewTokenizer(strings.NewReader(text))
+	offset := 0
+	raw := false
+	for tokenType := tokenizer.Next(); tokenType != html.ErrorToken; tokenType = tokenizer.Next() {
+		length := len(tokenizer.Raw())
+		tag := text[offset : offset+length]
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.TextToken:
+			if !raw {
+				for _, s := range textSplits(text[offset:offset+length], offset) {
+					s.open = open
+					splits = append(splits, s)
+				}
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			raw = tokenType == html.StartTagToken && (token.Data == "script" || token.Data == "style")
+			open = updateOpen(open, tokenType, token.Data, tag)
+			priority := 4
+			if htmlBlocks[token.Data] && tokenType != html.StartTagToken || token.Data == "br" {
+				priority = 5
+			}
+			splits = append(splits, split{offset + length, priority, open})
+		default:
+			splits = append(splits, split{offset + length, 4, open})
+		}
+		offset += length
+	}
+	return splits
+}
+
+// updateOpen returns the innermost element open after a tag, given the
+// one open before it.
+func updateOpen(open *openTag, tokenType html.TokenType, name string, tag string) *openTag {
+	switch {
+	case tokenType == html.StartTagToken && !htmlVoid[name]:
+		if open != nil && htmlSelfClosing[name] && open.name == name {
+			open = open.parent
+		}
+		return &openTag{name, tag, open}
+	case tokenType == html.EndTagToken:
+		for element := open; element != nil; element = element.parent {
+			if element.name == name {
+				return element.parent
+			}
+		}
+	}
+	return open
+}
+
+// balancing returns the start tags that reopen open and the elements it's
+// in, and the end tags that close them.
+func balancing(open *openTag) (reopen, close string) {
+	var starts []string
+	for element := open; element != nil; element = element.parent {
+		starts = append(starts, element.raw)
+		close += "</" + element.name + ">"
+	}
+	for i := len(starts) - 1; i >= 0; i-- {
+		reopen += starts[i]
+	}
+	return reopen, close
+}
+
+// textSplits returns the places plain text may be split, offset by base:
+// between paragraphs, lines, sentences and words.
+func textSplits(text string, base int) []split {
+	var splits []split
+	for i := 0; i < len(text); i++ {
+		switch {
+		case strings.HasPrefix(text[i:], "\n\n"):
+			splits = append(splits, split{offset: base + i + 2, priority: 3})
+			i++
+		case text[i] == '\n':
+			splits = append(splits, split{offset: base + i + 1, priority: 2})
+		case text[i] == ' ' && i > 0 && strings.ContainsRune(".!?", rune(text[i-1])):
+			splits = append(splits, split{offset: base + i + 1, priority: 1})
+		case text[i] == ' ':
+			splits = append(splits, split{offset: base + i + 1, priority: 0})
+		}
+	}
+	return splits
+}
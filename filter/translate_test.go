@@ -0,0 +1,282 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/language"
+)
+
+// echoTranslator "translates" texts by upper casing the text between tags.
+type echoTranslator struct {
+	texts [][]string
+}
+
+func (e *echoTranslator) Translate(ctx context.Context, texts []string, mimeType string, from, to language.Tag) ([]string, error) {
+	e.texts = append(e.texts, texts)
+	var translated []string
+	for _, text := range texts {
+		if mimeType != "text/html" {
+			translated = append(translated, strings.ToUpper(text))
+			continue
+		}
+		var out strings.Builder
+		tokenizer := html.NewTokenizer(strings.NewReader(text))
+		for tokenType := tokenizer.Next(); tokenType != html.ErrorToken; tokenType = tokenizer.Next() {
+			if tokenType == html.TextToken {
+				out.WriteString(strings.ToUpper(string(tokenizer.Raw())))
+			} else {
+				out.Write(tokenizer.Raw())
+			}
+		}
+		translated = append(translated, out.String())
+	}
+	return translated, nil
+}
+
+// joined returns the texts of chunks, joined.
+func joined(chunks []chunk) string {
+	var text strings.Builder
+	for _, chunk := range chunks {
+		text.WriteString(chunk.text)
+	}
+	return text.String()
+}
+
+// balanced reports whether every element opened in text is closed in it,
+// and every end tag closes an element opened in it. End tags may close the
+// elements they're in, and p and li may be left open, as HTML allows.
+func balanced(text string) bool {
+	var open []string
+	tokenizer := html.NewTokenizer(strings.NewReader(text))
+	for tokenType := tokenizer.Next(); tokenType != html.ErrorToken; tokenType = tokenizer.Next() {
+		token := tokenizer.Token()
+		switch {
+		case tokenType == html.StartTagToken && !htmlVoid[token.Data]:
+			open = append(open, token.Data)
+		case tokenType == html.EndTagToken:
+			i := len(open) - 1
+			for i >= 0 && open[i] != token.Data {
+				if open[i] != "p" && open[i] != "li" {
+					return false
+				}
+				i--
+			}
+			if i < 0 {
+				return false
+			}
+			open = open[:i]
+		}
+	}
+	return len(open) == 0
+}
+
+func TestChunkText(t *testing.T) {
+	text := strings.Repeat("Kalimat pendek. Kata demi kata lagi\n", 40) + strings.Repeat("é", 50)
+	chunks := chunkText(text, false, 100)
+	if joined(chunks) != text {
+		t.Fatal("chunks don't join back into the text")
+	}
+	for i, chunk := range chunks {
+		if chunk.open != "" || chunk.close != "" {
+			t.Errorf("chunk %d of plain text has tags %q, %q", i, chunk.open, chunk.close)
+		}
+		if runes := utf8.RuneCountInString(chunk.text); runes > 100 {
+			t.Errorf("chunk %d has %d code points", i, runes)
+		}
+		if i < len(chunks)-1 && !strings.HasSuffix(chunk.text, "\n") {
+			t.Errorf("chunk %d = %q, want it split between lines", i, chunk.text)
+		}
+	}
+	if chunks := chunkText("short", false, 100); len(chunks) != 1 || chunks[0].text != "short" {
+		t.Errorf("chunkText(short) = %v", chunks)
+	}
+	// without any place to split, the text is split between code points
+	chunks = chunkText(strings.Repeat("é", 250), false, 100)
+	if len(chunks) != 3 || joined(chunks) != strings.Repeat("é", 250) {
+		t.Errorf("chunkText(é...) = %d chunks", len(chunks))
+	}
+}
+
+func TestChunkTextHTML(t *testing.T) {
+	item := `<li class="item">Satu <b>dua</b> tiga.<br> Empat <a href="/lima">lima</a>.</li>`
+	text := `<!DOCTYPE html><html><head><title>Judul</title></head><body><div id="main"><ul>` +
+		strings.Repeat(item, 30) + `</ul><p>Akhir<p>Lagi</div><script>var a = "<p>";</script></body></html>`
+	for _, max := range []int{40, 100, 300, 1000} {
+		chunks := chunkText(text, true, max)
+		if joined(chunks) != text {
+			t.Fatalf("max %d: chunks don't join back into the text", max)
+		}
+		for i, chunk := range chunks {
+			if !balanced(chunk.request()) {
+				t.Errorf("max %d: chunk %d isn't balanced: %q", max, i, chunk.request())
+			}
+			if runes := utf8.RuneCountInString(chunk.text); runes > max {
+				t.Errorf("max %d: chunk %d has %d code points", max, i, runes)
+			}
+		}
+	}
+	chunks := chunkText(text, true, 300)
+	if !strings.HasPrefix(chunks[1].open, `<html><body><div id="main"><ul>`) || !strings.HasSuffix(chunks[0].close, "</ul></div></body></html>") {
+		t.Errorf("chunks are balanced by %q and %q", chunks[0].close, chunks[1].open)
+	}
+}
+
+func TestTranslateChunks(t *testing.T) {
+	text := "<div><p>" + strings.Repeat("satu dua tiga. ", 3000) + "</p></div>"
+	translator := &echoTranslator{}
+	options := TranslateOptions{Translator: translator}
+	translated, err := translateChunks(context.Background(), options, text, "text/html", language.Indonesian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<div><p>" + strings.Repeat("SATU DUA TIGA. ", 3000) + "</p></div>"; translated != want {
+		t.Errorf("translation = %.100q..., want %.100q...", translated, want)
+	}
+	if len(translator.texts) != 2 {
+		t.Errorf("translated in %d requests, want 2", len(translator.texts))
+	}
+	for _, texts := range translator.texts {
+		runes := 0
+		for _, text := range texts {
+			if !balanced(text) {
+				t.Errorf("sent unbalanced HTML %.100q...", text)
+			}
+			runes += utf8.RuneCountInString(text)
+		}
+		if runes > translateRequestRunes {
+			t.Errorf("sent %d code points at once", runes)
+		}
+	}
+}
+
+// tagDropper is a Translator that loses the tags around texts.
+type tagDropper struct{}
+
+func (tagDropper) Translate(ctx context.Context, texts []string, mimeType string, from, to language.Tag) ([]string, error) {
+	var translated []string
+	for _, text := range texts {
+		translated = append(translated, strings.TrimPrefix(text, "<p>"))
+	}
+	return translated, nil
+}
+
+func TestTranslateChunksChangedTags(t *testing.T) {
+	text := "<p>" + strings.Repeat("kata ", 3000) + "</p>"
+	if _, err := translateChunks(context.Background(), TranslateOptions{Translator: tagDropper{}}, text, "text/html", language.English); err == nil {
+		t.Error("translateChunks didn't notice the translator dropped tags")
+	}
+}
+
+func TestTranslateWithHEAD(t *testing.T) {
+	translator := &echoTranslator{}
+	translations := map[string][]byte{}
+	translate := Pipeline{func(ctx context.Context, handle MediaFilterHandle) error {
+		return TranslateWith(ctx, handle, TranslateOptions{
+			From:       language.Indonesian,
+			To:         language.English,
+			Translator: translator,
+			Getter: func(key string) ([]byte, bool) {
+				translation, ok := translations[key]
+				return translation, ok
+			},
+			Setter: func(key string, translation []byte, expiration time.Duration) {
+				translations[key] = translation
+			},
+		})
+	}}
+	header := func() http.Header {
+		return http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"9"},
+			"Etag": {`"1"`}, "Cache-Control": {"public, max-age=60"}}
+	}
+
+	// a HEAD request has no media to translate, and must not cache the
+	// translation of none
+	head := httptest.NewRequest(http.MethodHead, "/public/a.txt", nil)
+	response, err := run(t, translate, head, header(), "")
+	if err != nil || response.Code != http.StatusOK {
+		t.Fatalf("HEAD = %d, %v, want 200", response.Code, err)
+	}
+	if len(translator.texts) != 0 || len(translations) != 0 {
+		t.Errorf("HEAD: %d translations, %d cached, want none", len(translator.texts), len(translations))
+	}
+	if got := response.Header(); got.Get("Content-Length") != "9" || got.Get("Content-Language") != "" {
+		t.Errorf("HEAD: headers = %v, want the object's", got)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/public/a.txt", nil)
+	response, err = run(t, translate, get, header(), "satu dua.")
+	if err != nil || response.Body.String() != "SATU DUA." {
+		t.Fatalf("GET after HEAD = %q, %v, want the translation", response.Body, err)
+	}
+	if len(translator.texts) != 1 || len(translations) != 1 {
+		t.Errorf("GET after HEAD: %d translations, %d cached, want 1", len(translator.texts), len(translations))
+	}
+	for key, translation := range translations {
+		if string(translation) != "SATU DUA." {
+			t.Errorf("cached %q under %q, want the translation", translation, key)
+		}
+	}
+}
+
+func TestTranslateWithPassThrough(t *testing.T) {
+	multipart := "--b\r\nContent-Type: text/plain\r\nContent-Range: bytes 0-3/9\r\n\r\nsatu\r\n--b--\r\n"
+	for _, test := range []struct {
+		name     string
+		pipeline func(MediaFilter) Pipeline
+		header   http.Header
+		media    string
+	}{
+		{"empty", nil, http.Header{"Content-Type": {"text/plain"}}, ""},
+		{"one range", nil, http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-3/9"}}, "satu"},
+		{"several ranges", func(translate MediaFilter) Pipeline {
+			return Pipeline{withStatus(http.StatusPartialContent), translate}
+		}, http.Header{"Content-Type": {"multipart/byteranges; boundary=b"}}, multipart},
+		{"206 alone", func(translate MediaFilter) Pipeline {
+			return Pipeline{withStatus(http.StatusPartialContent), translate}
+		}, http.Header{"Content-Type": {"text/plain"}}, "satu"},
+	} {
+		translator := &echoTranslator{}
+		cached := 0
+		translate := func(ctx context.Context, handle MediaFilterHandle) error {
+			return TranslateWith(ctx, handle, TranslateOptions{
+				From:       language.Indonesian,
+				To:         language.English,
+				Translator: translator,
+				Getter:     func(string) ([]byte, bool) { return nil, false },
+				Setter:     func(string, []byte, time.Duration) { cached++ },
+			})
+		}
+		pipeline := Pipeline{translate}
+		if test.pipeline != nil {
+			pipeline = test.pipeline(translate)
+		}
+		test.header.Set("Cache-Control", "public, max-age=60")
+		response, err := run(t, pipeline, nil, test.header, test.media)
+		if err != nil || response.Body.String() != test.media {
+			t.Errorf("%s: %q, %v, want the media as is", test.name, response.Body, err)
+		}
+		if len(translator.texts) != 0 || cached != 0 {
+			t.Errorf("%s: %d translations, %d cached, want none", test.name, len(translator.texts), cached)
+		}
+	}
+}
@@ -16,11 +16,13 @@ package filter
 import (
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 )
 
-// GZip applies gzip encoding to the media.
+// GZip applies gzip encoding to the media, whether or not the client
+// accepts it. Compress negotiates the encoding instead.
 //
 // This is an example of a streaming filter. This will use very little memory
 // and add very little latency to responses.
@@ -28,15 +30,20 @@ func GZip(ctx context.Context, handle MediaFilterHandle) error {
 	defer handle.input.Close()
 	defer handle.output.Close()
 	// delete content-length header. It is no longer accurate.
-	handle.response.Header().Del("Content-Length")
+	handle.Header().Del("Content-Length")
 	// add a content-encoding
-	handle.response.Header().Set("Content-Encoding", "gzip")
+	handle.Header().Set("Content-Encoding", "gzip")
 	// zip the content
 	gz, err := gzip.NewWriterLevel(handle.output, 6)
 	if err != nil {
 		return FilterError(handle, http.StatusInternalServerError, "zip filter: %v", err)
 	}
-	defer gz.Close()
-	io.Copy(gz, handle.input)
+	if _, err := io.Copy(gz, handle.input); err != nil {
+		gz.Close()
+		return fmt.Errorf("zip filter: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("zip filter: %w", err)
+	}
 	return nil
 }